@@ -0,0 +1,468 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package defrag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrTooManyFailures is returned by Defragment once Config.MaxFailures
+	// members have failed, in which case the remaining members are not
+	// processed.
+	ErrTooManyFailures = errors.New("defrag: too many failures")
+
+	// ErrSkipMember is returned by Config.Confirm to skip a member.
+	ErrSkipMember = errors.New("defrag: skip member")
+
+	// ErrUnhealthy is wrapped by the error of a member which doesn't become
+	// healthy within Config.HealthTimeout after its defragmentation.
+	ErrUnhealthy = errors.New("defrag: member unhealthy after defragmentation")
+)
+
+// Predicate decides whether the member serving the given endpoint should be
+// defragmented, based on its status.
+type Predicate func(endpoint string, status *clientv3.StatusResponse) bool
+
+// Config is the configuration of a defragmentation run.
+type Config struct {
+	// Endpoints are the endpoints of the members to defragment, in order.
+	Endpoints []string
+
+	// DryRun, if true, only gets the status of each member, so that
+	// Result.Reclaimed returns the estimated reclaimable space, without
+	// defragmenting it. The members are still filtered by Predicate, but
+	// Confirm, Load and Stagger don't apply.
+	DryRun bool
+
+	// MaxConcurrent is the maximum number of members defragmented at once.
+	// 0 or 1 means one at a time. Confirm and OnResult are never called
+	// concurrently, even if the members are.
+	MaxConcurrent int
+
+	// RequestTimeout is the timeout of each request sent to a member.
+	// 0 means no timeout.
+	RequestTimeout time.Duration
+	// DefragTimeout, if set, is the timeout of the defragmentation of each
+	// member, which takes precedence over RequestTimeout, so that a hung
+	// member fails on its own without holding up the run for longer.
+	DefragTimeout time.Duration
+
+	// Predicate, if set, is called with the status of each member before
+	// defragmenting it, and the member is skipped if it returns false.
+	Predicate Predicate
+
+	// Confirm, if set, is called with the status of each member, which is
+	// nil if unavailable, right before defragmenting it. The member is
+	// skipped if it returns ErrSkipMember, and the run is aborted with the
+	// returned error if it returns any other error.
+	Confirm func(endpoint string, status *clientv3.StatusResponse) error
+
+	// Retries is how many times the defragmentation of a member is retried
+	// before the member is considered failed. The backoff before the first
+	// retry is RetryBackoff, 1s if not set, and doubles on each retry. The
+	// DefragTimeout, or RequestTimeout, bounds all the attempts together.
+	Retries      int
+	RetryBackoff time.Duration
+	// OnRetry, if set, is called before each retry with the attempt number,
+	// starting from 1, the backoff before it, and the error of the previous
+	// attempt.
+	OnRetry func(endpoint string, attempt int, backoff time.Duration, err error)
+
+	// HealthTimeout, if set, is how long to wait after each successful
+	// defragmentation for the member to be healthy, i.e. to report its
+	// status without errors and with a leader, before the next member. The
+	// status is polled every HealthPollInterval, 1s if not set. The member
+	// fails with an error wrapping ErrUnhealthy if it isn't healthy in time.
+	HealthTimeout      time.Duration
+	HealthPollInterval time.Duration
+
+	// Stagger is how long to wait after a member has been defragmented,
+	// successfully or not, before defragmenting the next one, to let the
+	// cluster recover in between. There is no wait after the last member,
+	// or after a skipped member. 0 means no wait.
+	Stagger time.Duration
+
+	// MaxFailures aborts the run once this many members have failed.
+	// 0 means unlimited.
+	MaxFailures int
+
+	// Logger, if set, is used to log the status of each member before and
+	// after defragmentation. The db size quota is not part of the status
+	// returned by the members, so it is not logged.
+	Logger *zap.Logger
+
+	// CollectStatus, if true, collects the status of each member before and
+	// after defragmentation into the Result.
+	CollectStatus bool
+
+	// OnResult, if set, is called with the result of each member as soon
+	// as the member is processed.
+	OnResult func(Result)
+
+	// Load, if set, is consulted before defragmenting each member, and the
+	// run is paused, checking again every LoadPollInterval, while the load
+	// is above MaxLoad. This is best-effort: the run isn't paused if the
+	// load can't be obtained.
+	Load             LoadFunc
+	MaxLoad          float64
+	LoadPollInterval time.Duration
+	// LoadWaitTimeout aborts the run once it has been paused for this long
+	// in total. 0 means no limit.
+	LoadWaitTimeout time.Duration
+}
+
+// Result is the result of defragmenting a single member.
+type Result struct {
+	Endpoint string
+	// Skipped is true if the member was skipped by the Predicate.
+	Skipped bool
+	// DryRun is true if the member was not defragmented because of
+	// Config.DryRun.
+	DryRun bool
+	// Took is how long the defragmentation took.
+	Took time.Duration
+	// Err is the error of the defragmentation, if any.
+	Err error
+	// StatusBefore and StatusAfter are the status of the member before and
+	// after defragmentation, if collected and available.
+	StatusBefore *clientv3.StatusResponse
+	StatusAfter  *clientv3.StatusResponse
+}
+
+// Reclaimed returns the DB size reclaimed by the defragmentation, which is
+// 0 if the DB has grown meanwhile, and false if the status of the member
+// before or after the defragmentation is unavailable. For a dry run, it is
+// the estimated reclaimable space, i.e. the DB size not in use.
+func (r Result) Reclaimed() (int64, bool) {
+	if r.DryRun && r.StatusBefore != nil {
+		return r.StatusBefore.DbSize - r.StatusBefore.DbSizeInUse, true
+	}
+	if r.StatusBefore == nil || r.StatusAfter == nil {
+		return 0, false
+	}
+	if r.StatusAfter.DbSize >= r.StatusBefore.DbSize {
+		return 0, true
+	}
+	return r.StatusBefore.DbSize - r.StatusAfter.DbSize, true
+}
+
+// Defragment defragments the members serving the given endpoints, up to
+// Config.MaxConcurrent at once, and returns the results of the members that
+// have been processed, in the order they finished. ErrTooManyFailures is
+// returned if the run is aborted because of Config.MaxFailures,
+// ErrLoadTooHigh if it is aborted because of Config.LoadWaitTimeout, the
+// error of Config.Confirm, or the error of the given context if it is done
+// before all the members are processed. The members already being
+// defragmented are finished when the run is aborted, and the other ones are
+// not processed.
+func Defragment(ctx context.Context, c *clientv3.Client, cfg Config) ([]Result, error) {
+	workers := cfg.MaxConcurrent
+	if workers < 1 {
+		workers = 1
+	}
+	r := &run{c: c, cfg: cfg}
+	gate := &loadGate{cfg: cfg}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for _, ep := range cfg.Endpoints {
+		// Wait for a free worker, so that the failures of the members
+		// processed so far are known.
+		sem <- struct{}{}
+		if r.aborted() {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			r.abort(err)
+			break
+		}
+		if err := r.stagger(ctx); err != nil {
+			r.abort(err)
+			break
+		}
+		if !cfg.DryRun {
+			if err := gate.wait(ctx); err != nil {
+				r.abort(err)
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func(ep string) {
+			defer func() { <-sem }()
+			defer wg.Done()
+			r.process(ctx, ep)
+		}(ep)
+	}
+	wg.Wait()
+	return r.results, r.err
+}
+
+// run is the state of a defragmentation run shared by its workers.
+type run struct {
+	c   *clientv3.Client
+	cfg Config
+
+	// mu guards the fields below, and serializes the calls to
+	// Config.Confirm and Config.OnResult.
+	mu       sync.Mutex
+	results  []Result
+	failures int
+	err      error
+	// staggerDue is true if a member has been defragmented since the last
+	// wait of Config.Stagger.
+	staggerDue bool
+}
+
+// stagger waits for Config.Stagger if a member has been defragmented since
+// the last wait.
+func (r *run) stagger(ctx context.Context) error {
+	r.mu.Lock()
+	due := r.staggerDue
+	r.staggerDue = false
+	r.mu.Unlock()
+	if !due || r.cfg.Stagger <= 0 {
+		return nil
+	}
+
+	if r.cfg.Logger != nil {
+		r.cfg.Logger.Info("waiting before defragmenting the next member", zap.Duration("stagger", r.cfg.Stagger))
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(r.cfg.Stagger):
+		return nil
+	}
+}
+
+// aborted reports whether the run is aborted, i.e. no more members should
+// be processed.
+func (r *run) aborted() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil && r.cfg.MaxFailures > 0 && r.failures >= r.cfg.MaxFailures {
+		r.err = ErrTooManyFailures
+	}
+	return r.err != nil
+}
+
+// abort aborts the run with the given error, unless it is already aborted.
+func (r *run) abort(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// process defragments a single member, and records its result. The run is
+// aborted with the error of Config.Confirm if any.
+func (r *run) process(ctx context.Context, ep string) {
+	res, err := defragmentMember(ctx, r.c, r.cfg, ep, &r.mu)
+	if err != nil {
+		r.abort(err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if res.Err != nil {
+		r.failures++
+	}
+	if !res.Skipped && !res.DryRun {
+		r.staggerDue = true
+	}
+	r.results = append(r.results, res)
+	if r.cfg.OnResult != nil {
+		r.cfg.OnResult(res)
+	}
+}
+
+// defragmentMember defragments a single member, and returns the error of
+// Config.Confirm if it aborts the run. Config.Confirm is called with mu
+// held.
+func defragmentMember(ctx context.Context, c *clientv3.Client, cfg Config, ep string, mu *sync.Mutex) (Result, error) {
+	res := Result{Endpoint: ep}
+	if cfg.Predicate != nil || cfg.Confirm != nil || cfg.Logger != nil || cfg.CollectStatus || cfg.DryRun {
+		status, err := memberStatus(ctx, c, cfg, ep, "before defragmentation")
+		res.StatusBefore = status
+		// Members are defragmented by default if their status is unknown.
+		if cfg.Predicate != nil && err == nil && !cfg.Predicate(ep, status) {
+			res.Skipped = true
+			return res, nil
+		}
+	}
+	if cfg.DryRun {
+		res.DryRun = true
+		return res, nil
+	}
+	if cfg.Confirm != nil {
+		mu.Lock()
+		err := cfg.Confirm(ep, res.StatusBefore)
+		mu.Unlock()
+		if err == ErrSkipMember {
+			res.Skipped = true
+			return res, nil
+		} else if err != nil {
+			return res, err
+		}
+	}
+
+	rctx, cancel := defragContext(ctx, cfg)
+	start := time.Now()
+	res.Err = defragmentWithRetries(rctx, c, cfg, ep, mu)
+	res.Took = time.Since(start)
+	cancel()
+	if res.Err == nil && cfg.HealthTimeout > 0 {
+		res.Err = waitHealthy(ctx, c, cfg, ep)
+	}
+
+	if cfg.Logger != nil || cfg.CollectStatus {
+		res.StatusAfter, _ = memberStatus(ctx, c, cfg, ep, "after defragmentation")
+	}
+	return res, nil
+}
+
+// defaultRetryBackoff is the backoff before the first retry if
+// Config.RetryBackoff is not set.
+const defaultRetryBackoff = time.Second
+
+// defragmentWithRetries defragments the member serving the given endpoint,
+// retrying up to Config.Retries times with an exponential backoff until ctx
+// is done. The error of the last attempt is returned. Config.OnRetry is
+// called with mu held.
+func defragmentWithRetries(ctx context.Context, c *clientv3.Client, cfg Config, ep string, mu *sync.Mutex) error {
+	backoff := cfg.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		_, err := c.Defragment(ctx, ep)
+		if err == nil || attempt > cfg.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		if cfg.Logger != nil {
+			cfg.Logger.Warn(
+				"failed to defragment member, retrying",
+				zap.String("endpoint", ep),
+				zap.Int("attempt", attempt),
+				zap.Duration("backoff", backoff),
+				zap.Error(err),
+			)
+		}
+		if cfg.OnRetry != nil {
+			mu.Lock()
+			cfg.OnRetry(ep, attempt, backoff, err)
+			mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// defaultHealthPollInterval is the interval between two status polls of
+// waitHealthy if Config.HealthPollInterval is not set.
+const defaultHealthPollInterval = time.Second
+
+// waitHealthy polls the status of the member serving the given endpoint
+// until it is healthy, for at most Config.HealthTimeout.
+func waitHealthy(ctx context.Context, c *clientv3.Client, cfg Config, ep string) error {
+	interval := cfg.HealthPollInterval
+	if interval <= 0 {
+		interval = defaultHealthPollInterval
+	}
+	hctx, cancel := context.WithTimeout(ctx, cfg.HealthTimeout)
+	defer cancel()
+
+	for {
+		rctx, rcancel := requestContext(hctx, cfg)
+		status, err := c.Status(rctx, ep)
+		rcancel()
+		switch {
+		case err != nil:
+		case len(status.Errors) > 0:
+			err = fmt.Errorf("member reports errors %v", status.Errors)
+		case status.Leader == 0:
+			err = errors.New("member has no leader")
+		default:
+			return nil
+		}
+
+		select {
+		case <-hctx.Done():
+			return fmt.Errorf("%w: not healthy within %s (%v)", ErrUnhealthy, cfg.HealthTimeout, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// memberStatus gets the status of the member serving the given endpoint,
+// and logs it if a logger is configured.
+func memberStatus(ctx context.Context, c *clientv3.Client, cfg Config, ep string, stage string) (*clientv3.StatusResponse, error) {
+	rctx, cancel := requestContext(ctx, cfg)
+	resp, err := c.Status(rctx, ep)
+	cancel()
+
+	lg := cfg.Logger
+	if lg == nil {
+		return resp, err
+	}
+	if err != nil {
+		lg.Warn("failed to get member status", zap.String("stage", stage), zap.String("endpoint", ep), zap.Error(err))
+		return resp, err
+	}
+	lg.Info(
+		"member status",
+		zap.String("stage", stage),
+		zap.String("endpoint", ep),
+		zap.String("member-id", fmt.Sprintf("%x", resp.Header.MemberId)),
+		zap.Int64("db-size", resp.DbSize),
+		zap.Int64("db-size-in-use", resp.DbSizeInUse),
+		zap.Uint64("raft-index", resp.RaftIndex),
+		zap.Uint64("raft-term", resp.RaftTerm),
+		zap.Uint64("raft-applied-index", resp.RaftAppliedIndex),
+		zap.String("leader", fmt.Sprintf("%x", resp.Leader)),
+		zap.Bool("is-learner", resp.IsLearner),
+	)
+	return resp, nil
+}
+
+// defragContext returns the context of the defragmentation of a member.
+func defragContext(ctx context.Context, cfg Config) (context.Context, context.CancelFunc) {
+	if cfg.DefragTimeout > 0 {
+		return context.WithTimeout(ctx, cfg.DefragTimeout)
+	}
+	return requestContext(ctx, cfg)
+}
+
+func requestContext(ctx context.Context, cfg Config) (context.Context, context.CancelFunc) {
+	if cfg.RequestTimeout > 0 {
+		return context.WithTimeout(ctx, cfg.RequestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,595 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package defrag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// fakeMaintenance only implements the methods used by Defragment.
+type fakeMaintenance struct {
+	clientv3.Maintenance
+	statuses map[string]*clientv3.StatusResponse
+	failures map[string]bool
+	// hangs are the members whose defragmentation never finishes.
+	hangs map[string]bool
+	// flaky are the number of times the defragmentation of each member
+	// fails before it succeeds.
+	flaky map[string]int
+	// unhealthy are the number of times the status of each member reports
+	// an error.
+	unhealthy map[string]int
+	defraged  []string
+}
+
+func (fm *fakeMaintenance) Status(ctx context.Context, endpoint string) (*clientv3.StatusResponse, error) {
+	if fm.unhealthy[endpoint] > 0 {
+		fm.unhealthy[endpoint]--
+		return &clientv3.StatusResponse{Header: &pb.ResponseHeader{}, Errors: []string{"NOSPACE"}}, nil
+	}
+	if st, ok := fm.statuses[endpoint]; ok {
+		return st, nil
+	}
+	return nil, errors.New("status unavailable")
+}
+
+func (fm *fakeMaintenance) Defragment(ctx context.Context, endpoint string) (*clientv3.DefragmentResponse, error) {
+	fm.defraged = append(fm.defraged, endpoint)
+	if fm.hangs[endpoint] {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if fm.failures[endpoint] {
+		return nil, errors.New("defrag failed")
+	}
+	if fm.flaky[endpoint] > 0 {
+		fm.flaky[endpoint]--
+		return nil, errors.New("connection reset")
+	}
+	return &clientv3.DefragmentResponse{}, nil
+}
+
+var errAborted = errors.New("aborted")
+
+func TestDefragment(t *testing.T) {
+	eps := []string{"ep1", "ep2", "ep3"}
+
+	cases := []struct {
+		name            string
+		cfg             Config
+		failures        map[string]bool
+		expectedDefrags []string
+		expectedResults int
+		expectedError   error
+	}{
+		{
+			name:            "all members",
+			cfg:             Config{Endpoints: eps},
+			expectedDefrags: eps,
+			expectedResults: 3,
+		},
+		{
+			name: "members filtered by predicate",
+			cfg: Config{
+				Endpoints: eps,
+				Predicate: func(ep string, status *clientv3.StatusResponse) bool {
+					return status.DbSize > status.DbSizeInUse
+				},
+			},
+			// ep3 is defragmented because its status is unavailable.
+			expectedDefrags: []string{"ep2", "ep3"},
+			expectedResults: 3,
+		},
+		{
+			name:            "continue on failures",
+			cfg:             Config{Endpoints: eps},
+			failures:        map[string]bool{"ep1": true, "ep2": true},
+			expectedDefrags: eps,
+			expectedResults: 3,
+		},
+		{
+			name:            "abort on max failures",
+			cfg:             Config{Endpoints: eps, MaxFailures: 2},
+			failures:        map[string]bool{"ep1": true, "ep2": true},
+			expectedDefrags: []string{"ep1", "ep2"},
+			expectedResults: 2,
+			expectedError:   ErrTooManyFailures,
+		},
+		{
+			name: "confirm each member",
+			cfg: Config{
+				Endpoints: eps,
+				Confirm: func(ep string, status *clientv3.StatusResponse) error {
+					switch ep {
+					case "ep2":
+						return ErrSkipMember
+					case "ep3":
+						return errAborted
+					}
+					return nil
+				},
+			},
+			expectedDefrags: []string{"ep1"},
+			expectedResults: 2,
+			expectedError:   errAborted,
+		},
+		{
+			name: "pause while load is high",
+			cfg: Config{
+				Endpoints:        eps,
+				Load:             fakeLoad(5, 5, 1, 1, 1),
+				MaxLoad:          2,
+				LoadPollInterval: time.Millisecond,
+			},
+			expectedDefrags: eps,
+			expectedResults: 3,
+		},
+		{
+			name: "abort when load stays high",
+			cfg: Config{
+				Endpoints:        eps,
+				Load:             fakeLoad(1, 5),
+				MaxLoad:          2,
+				LoadPollInterval: time.Millisecond,
+				LoadWaitTimeout:  10 * time.Millisecond,
+			},
+			expectedDefrags: []string{"ep1"},
+			expectedResults: 1,
+			expectedError:   ErrLoadTooHigh,
+		},
+		{
+			name: "ignore load errors",
+			cfg: Config{
+				Endpoints: eps,
+				Load: func(ctx context.Context) (float64, error) {
+					return 0, errors.New("no load")
+				},
+				MaxLoad: 2,
+			},
+			expectedDefrags: eps,
+			expectedResults: 3,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := &fakeMaintenance{
+				statuses: map[string]*clientv3.StatusResponse{
+					"ep1": {Header: &pb.ResponseHeader{}, DbSize: 100, DbSizeInUse: 100},
+					"ep2": {Header: &pb.ResponseHeader{}, DbSize: 200, DbSizeInUse: 100},
+				},
+				failures: tc.failures,
+			}
+			c := &clientv3.Client{Maintenance: fm}
+
+			results, err := Defragment(context.Background(), c, tc.cfg)
+			if err != tc.expectedError {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if len(results) != tc.expectedResults {
+				t.Errorf("Unexpected result count, expected: %d, got: %d", tc.expectedResults, len(results))
+			}
+			if len(fm.defraged) != len(tc.expectedDefrags) {
+				t.Fatalf("Unexpected defragmented members, expected: %v, got: %v", tc.expectedDefrags, fm.defraged)
+			}
+			for i, ep := range tc.expectedDefrags {
+				if fm.defraged[i] != ep {
+					t.Errorf("Unexpected defragmented members, expected: %v, got: %v", tc.expectedDefrags, fm.defraged)
+				}
+			}
+		})
+	}
+}
+
+func TestResultReclaimed(t *testing.T) {
+	cases := []struct {
+		name              string
+		before, after     *clientv3.StatusResponse
+		expectedReclaimed int64
+		expectedOK        bool
+	}{
+		{
+			name:              "space reclaimed",
+			before:            &clientv3.StatusResponse{DbSize: 300, DbSizeInUse: 100},
+			after:             &clientv3.StatusResponse{DbSize: 120, DbSizeInUse: 100},
+			expectedReclaimed: 180,
+			expectedOK:        true,
+		},
+		{
+			name:       "db grown meanwhile",
+			before:     &clientv3.StatusResponse{DbSize: 100, DbSizeInUse: 100},
+			after:      &clientv3.StatusResponse{DbSize: 150, DbSizeInUse: 150},
+			expectedOK: true,
+		},
+		{
+			name:   "status after unavailable",
+			before: &clientv3.StatusResponse{DbSize: 300, DbSizeInUse: 100},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res := Result{StatusBefore: tc.before, StatusAfter: tc.after}
+			reclaimed, ok := res.Reclaimed()
+			if reclaimed != tc.expectedReclaimed || ok != tc.expectedOK {
+				t.Errorf("Unexpected reclaimed size, expected: (%d, %v), got: (%d, %v)", tc.expectedReclaimed, tc.expectedOK, reclaimed, ok)
+			}
+		})
+	}
+}
+
+func TestDefragmentDryRun(t *testing.T) {
+	fm := &fakeMaintenance{
+		statuses: map[string]*clientv3.StatusResponse{
+			"ep1": {Header: &pb.ResponseHeader{}, DbSize: 100, DbSizeInUse: 100},
+			"ep2": {Header: &pb.ResponseHeader{}, DbSize: 300, DbSizeInUse: 100},
+		},
+	}
+	c := &clientv3.Client{Maintenance: fm}
+
+	results, err := Defragment(context.Background(), c, Config{
+		Endpoints: []string{"ep1", "ep2", "ep3"},
+		DryRun:    true,
+		Confirm: func(ep string, status *clientv3.StatusResponse) error {
+			t.Errorf("Unexpected confirmation of etcd member[%s] in a dry run", ep)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(fm.defraged) != 0 {
+		t.Errorf("Unexpected defragmented members in a dry run: %v", fm.defraged)
+	}
+
+	expected := []struct {
+		reclaimed int64
+		ok        bool
+	}{{0, true}, {200, true}, {0, false}}
+	if len(results) != len(expected) {
+		t.Fatalf("Unexpected result count, expected: %d, got: %d", len(expected), len(results))
+	}
+	for i, res := range results {
+		reclaimed, ok := res.Reclaimed()
+		if !res.DryRun || reclaimed != expected[i].reclaimed || ok != expected[i].ok {
+			t.Errorf("Unexpected result of etcd member[%s], expected a dry run reclaiming (%d, %v), got: %+v (%d, %v)",
+				res.Endpoint, expected[i].reclaimed, expected[i].ok, res, reclaimed, ok)
+		}
+	}
+}
+
+func TestDefragmentCanceled(t *testing.T) {
+	fm := &fakeMaintenance{}
+	c := &clientv3.Client{Maintenance: fm}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := Defragment(ctx, c, Config{
+		Endpoints: []string{"ep1", "ep2", "ep3"},
+		OnResult: func(res Result) {
+			// The run is interrupted once the first member is done.
+			cancel()
+		},
+	})
+	if err != context.Canceled {
+		t.Errorf("Unexpected error, expected: %v, got: %v", context.Canceled, err)
+	}
+	if len(results) != 1 || len(fm.defraged) != 1 {
+		t.Errorf("Unexpected processed members after the cancellation, results: %d, defragmented: %v", len(results), fm.defraged)
+	}
+}
+
+func TestDefragmentTimeout(t *testing.T) {
+	fm := &fakeMaintenance{hangs: map[string]bool{"ep2": true}}
+	c := &clientv3.Client{Maintenance: fm}
+
+	// The defragmentation timeout takes precedence over the request timeout.
+	results, err := Defragment(context.Background(), c, Config{
+		Endpoints:      []string{"ep1", "ep2", "ep3"},
+		RequestTimeout: time.Hour,
+		DefragTimeout:  10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Unexpected result count, expected: 3, got: %d", len(results))
+	}
+	for _, res := range results {
+		if res.Endpoint == "ep2" {
+			if res.Err != context.DeadlineExceeded {
+				t.Errorf("Unexpected error of the hung member, expected: %v, got: %v", context.DeadlineExceeded, res.Err)
+			}
+		} else if res.Err != nil {
+			t.Errorf("Unexpected error of etcd member[%s]: %v", res.Endpoint, res.Err)
+		}
+	}
+}
+
+func TestDefragmentRetries(t *testing.T) {
+	cases := []struct {
+		name             string
+		cfg              Config
+		expectedDefrags  int
+		expectedRetries  []int
+		expectedFailures int
+	}{
+		{
+			name:            "succeed after retries",
+			cfg:             Config{Endpoints: []string{"ep1"}, Retries: 2, RetryBackoff: time.Millisecond},
+			expectedDefrags: 3,
+			expectedRetries: []int{1, 2},
+		},
+		{
+			name:             "fail once the retries are exhausted",
+			cfg:              Config{Endpoints: []string{"ep2"}, Retries: 2, RetryBackoff: time.Millisecond},
+			expectedDefrags:  3,
+			expectedRetries:  []int{1, 2},
+			expectedFailures: 1,
+		},
+		{
+			name:             "fail once the timeout has elapsed",
+			cfg:              Config{Endpoints: []string{"ep1"}, Retries: 2, RetryBackoff: time.Hour, DefragTimeout: 20 * time.Millisecond},
+			expectedDefrags:  1,
+			expectedRetries:  []int{1},
+			expectedFailures: 1,
+		},
+		{
+			name:             "no retries",
+			cfg:              Config{Endpoints: []string{"ep1"}},
+			expectedDefrags:  1,
+			expectedFailures: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := &fakeMaintenance{flaky: map[string]int{"ep1": 2, "ep2": 5}}
+			c := &clientv3.Client{Maintenance: fm}
+
+			var retries []int
+			tc.cfg.OnRetry = func(ep string, attempt int, backoff time.Duration, err error) {
+				retries = append(retries, attempt)
+			}
+			results, err := Defragment(context.Background(), c, tc.cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(fm.defraged) != tc.expectedDefrags {
+				t.Errorf("Unexpected attempts, expected: %d, got: %d", tc.expectedDefrags, len(fm.defraged))
+			}
+			if fmt.Sprint(retries) != fmt.Sprint(tc.expectedRetries) {
+				t.Errorf("Unexpected retries, expected: %v, got: %v", tc.expectedRetries, retries)
+			}
+			failures := 0
+			for _, res := range results {
+				if res.Err != nil {
+					failures++
+				}
+			}
+			if failures != tc.expectedFailures {
+				t.Errorf("Unexpected failures, expected: %d, got: %d", tc.expectedFailures, failures)
+			}
+		})
+	}
+}
+
+func TestDefragmentHealthCheck(t *testing.T) {
+	healthy := &clientv3.StatusResponse{Header: &pb.ResponseHeader{MemberId: 1}, Leader: 1}
+	fm := &fakeMaintenance{
+		statuses: map[string]*clientv3.StatusResponse{
+			"ep1": healthy,
+			"ep2": healthy,
+			"ep3": healthy,
+		},
+		// ep1 recovers in time, ep2 doesn't.
+		unhealthy: map[string]int{"ep1": 2, "ep2": 100},
+	}
+	c := &clientv3.Client{Maintenance: fm}
+
+	results, err := Defragment(context.Background(), c, Config{
+		Endpoints:          []string{"ep1", "ep2", "ep3"},
+		HealthTimeout:      50 * time.Millisecond,
+		HealthPollInterval: time.Millisecond,
+		MaxFailures:        1,
+	})
+	if err != ErrTooManyFailures {
+		t.Errorf("Unexpected error, expected: %v, got: %v", ErrTooManyFailures, err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Unexpected result count, expected: 2, got: %d", len(results))
+	}
+	if results[0].Err != nil {
+		t.Errorf("Unexpected error of etcd member[ep1]: %v", results[0].Err)
+	}
+	if !errors.Is(results[1].Err, ErrUnhealthy) {
+		t.Errorf("Unexpected error of etcd member[ep2], expected: %v, got: %v", ErrUnhealthy, results[1].Err)
+	}
+}
+
+func TestDefragmentStagger(t *testing.T) {
+	stagger := 50 * time.Millisecond
+	cases := []struct {
+		name        string
+		eps         []string
+		predicate   Predicate
+		expectedMin time.Duration
+		expectedMax time.Duration
+	}{
+		{
+			name:        "between the members",
+			eps:         []string{"ep1", "ep2", "ep3"},
+			expectedMin: 2 * stagger,
+			expectedMax: 3 * stagger,
+		},
+		{
+			name:        "not after the last member",
+			eps:         []string{"ep1"},
+			expectedMax: stagger,
+		},
+		{
+			name: "not after a skipped member",
+			eps:  []string{"ep1", "ep2", "ep3"},
+			predicate: func(ep string, status *clientv3.StatusResponse) bool {
+				return ep != "ep1"
+			},
+			expectedMin: stagger,
+			expectedMax: 2 * stagger,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := &fakeMaintenance{
+				statuses: map[string]*clientv3.StatusResponse{
+					"ep1": {Header: &pb.ResponseHeader{}},
+					"ep2": {Header: &pb.ResponseHeader{}},
+					"ep3": {Header: &pb.ResponseHeader{}},
+				},
+			}
+			c := &clientv3.Client{Maintenance: fm}
+
+			start := time.Now()
+			results, err := Defragment(context.Background(), c, Config{Endpoints: tc.eps, Stagger: stagger, Predicate: tc.predicate})
+			took := time.Since(start)
+			if err != nil || len(results) != len(tc.eps) {
+				t.Fatalf("Unexpected run, expected %d results, got: %d (%v)", len(tc.eps), len(results), err)
+			}
+			if took < tc.expectedMin || took >= tc.expectedMax {
+				t.Errorf("Unexpected run time, expected between %s and %s, got: %s", tc.expectedMin, tc.expectedMax, took)
+			}
+		})
+	}
+}
+
+// fakeConcurrentMaintenance records how many members are defragmented at
+// once.
+type fakeConcurrentMaintenance struct {
+	clientv3.Maintenance
+	failures map[string]bool
+	// delays are how long the members take, 20ms by default.
+	delays map[string]time.Duration
+
+	mu          sync.Mutex
+	inflight    int
+	maxInflight int
+	defraged    int
+}
+
+func (fm *fakeConcurrentMaintenance) Defragment(ctx context.Context, endpoint string) (*clientv3.DefragmentResponse, error) {
+	fm.mu.Lock()
+	fm.inflight++
+	fm.defraged++
+	if fm.inflight > fm.maxInflight {
+		fm.maxInflight = fm.inflight
+	}
+	fm.mu.Unlock()
+
+	delay, ok := fm.delays[endpoint]
+	if !ok {
+		delay = 20 * time.Millisecond
+	}
+	time.Sleep(delay)
+
+	fm.mu.Lock()
+	fm.inflight--
+	fm.mu.Unlock()
+	if fm.failures[endpoint] {
+		return nil, errors.New("defrag failed")
+	}
+	return &clientv3.DefragmentResponse{}, nil
+}
+
+func TestDefragmentConcurrently(t *testing.T) {
+	eps := []string{"ep1", "ep2", "ep3", "ep4", "ep5"}
+
+	cases := []struct {
+		name            string
+		cfg             Config
+		failures        map[string]bool
+		delays          map[string]time.Duration
+		expectedDefrags int
+		expectedError   error
+	}{
+		{
+			name:            "all members",
+			cfg:             Config{Endpoints: eps, MaxConcurrent: 2},
+			failures:        map[string]bool{"ep2": true},
+			expectedDefrags: 5,
+		},
+		{
+			name:     "abort on max failures",
+			cfg:      Config{Endpoints: eps, MaxConcurrent: 2, MaxFailures: 1},
+			failures: map[string]bool{"ep1": true},
+			// ep2 is still finished after ep1 has failed.
+			delays:          map[string]time.Duration{"ep1": 10 * time.Millisecond, "ep2": 50 * time.Millisecond},
+			expectedDefrags: 2,
+			expectedError:   ErrTooManyFailures,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := &fakeConcurrentMaintenance{failures: tc.failures, delays: tc.delays}
+			c := &clientv3.Client{Maintenance: fm}
+
+			inCallback := false
+			failed := 0
+			tc.cfg.OnResult = func(res Result) {
+				if inCallback {
+					t.Errorf("OnResult called concurrently")
+				}
+				inCallback = true
+				if res.Err != nil {
+					failed++
+				}
+				inCallback = false
+			}
+
+			results, err := Defragment(context.Background(), c, tc.cfg)
+			if err != tc.expectedError {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if fm.defraged != tc.expectedDefrags || len(results) != tc.expectedDefrags {
+				t.Errorf("Unexpected defragmented members, expected: %d, got: %d (%d results)", tc.expectedDefrags, fm.defraged, len(results))
+			}
+			if fm.maxInflight != 2 {
+				t.Errorf("Unexpected concurrency, expected: 2, got: %d", fm.maxInflight)
+			}
+			if failed != len(tc.failures) {
+				t.Errorf("Unexpected failures, expected: %d, got: %d", len(tc.failures), failed)
+			}
+		})
+	}
+}
+
+// fakeLoad returns a LoadFunc which returns the given loads in order, and
+// then the last one forever.
+func fakeLoad(loads ...float64) LoadFunc {
+	return func(ctx context.Context) (float64, error) {
+		load := loads[0]
+		if len(loads) > 1 {
+			loads = loads[1:]
+		}
+		return load, nil
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package defrag
+
+import (
+	"go.etcd.io/etcd/client/v3"
+)
+
+// Fragmentation returns the fragmentation ratio of a member, i.e. the
+// fraction of its DB size not in use, between 0 and 1. It returns 0 if the
+// ratio can't be computed, e.g. if the member reports no DB size, or no DB
+// size in use as older members do, or an inconsistent DB size in use larger
+// than the DB size.
+func Fragmentation(status *clientv3.StatusResponse) float64 {
+	if status == nil || status.DbSize <= 0 || status.DbSizeInUse <= 0 || status.DbSizeInUse >= status.DbSize {
+		return 0
+	}
+	return float64(status.DbSize-status.DbSizeInUse) / float64(status.DbSize)
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package defrag
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+func TestFragmentation(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   *clientv3.StatusResponse
+		expected float64
+	}{
+		{
+			name:     "nil status",
+			expected: 0,
+		},
+		{
+			name:     "zero DB size",
+			status:   &clientv3.StatusResponse{},
+			expected: 0,
+		},
+		{
+			name:     "fresh member",
+			status:   &clientv3.StatusResponse{DbSize: 20480, DbSizeInUse: 20480},
+			expected: 0,
+		},
+		{
+			name:     "DB size in use not reported",
+			status:   &clientv3.StatusResponse{DbSize: 20480},
+			expected: 0,
+		},
+		{
+			name:     "DB size in use larger than DB size",
+			status:   &clientv3.StatusResponse{DbSize: 100, DbSizeInUse: 200},
+			expected: 0,
+		},
+		{
+			name:     "fragmented",
+			status:   &clientv3.StatusResponse{DbSize: 400, DbSizeInUse: 100},
+			expected: 0.75,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Fragmentation(tc.status); got != tc.expected {
+				t.Errorf("Unexpected fragmentation, expected: %v, got: %v", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package defrag
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrLoadTooHigh is returned by Defragment once the run has been paused
+	// for Config.LoadWaitTimeout in total because the load stayed above
+	// Config.MaxLoad, in which case the remaining members are not
+	// processed.
+	ErrLoadTooHigh = errors.New("defrag: load too high")
+)
+
+// defaultLoadPollInterval is how often the load is checked again while the
+// run is paused.
+const defaultLoadPollInterval = 10 * time.Second
+
+// LoadFunc returns the current load of the cluster, in a unit comparable
+// with Config.MaxLoad.
+type LoadFunc func(ctx context.Context) (float64, error)
+
+// RaftIndexRate returns a LoadFunc which measures the load as the number of
+// raft entries committed per second by the member serving the given
+// endpoint over the given window, which is a proxy for the write rate of
+// the cluster.
+func RaftIndexRate(c *clientv3.Client, endpoint string, window time.Duration) LoadFunc {
+	return func(ctx context.Context) (float64, error) {
+		before, err := c.Status(ctx, endpoint)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(window):
+		}
+		after, err := c.Status(ctx, endpoint)
+		if err != nil {
+			return 0, err
+		}
+		return float64(after.RaftIndex-before.RaftIndex) / time.Since(start).Seconds(), nil
+	}
+}
+
+// loadGate pauses the run while the load exceeds Config.MaxLoad. It is
+// best-effort: failures to get the load don't pause the run.
+type loadGate struct {
+	cfg Config
+	// paused is how long the run has been paused so far.
+	paused time.Duration
+}
+
+// wait blocks until the load is not above Config.MaxLoad. ErrLoadTooHigh is
+// returned once the run has been paused for Config.LoadWaitTimeout in
+// total.
+func (g *loadGate) wait(ctx context.Context) error {
+	if g.cfg.Load == nil {
+		return nil
+	}
+	interval := g.cfg.LoadPollInterval
+	if interval <= 0 {
+		interval = defaultLoadPollInterval
+	}
+
+	for {
+		load, err := g.cfg.Load(ctx)
+		if err != nil {
+			if g.cfg.Logger != nil {
+				g.cfg.Logger.Warn("failed to get load, not pausing", zap.Error(err))
+			}
+			return nil
+		}
+		if load <= g.cfg.MaxLoad {
+			return nil
+		}
+		if g.cfg.LoadWaitTimeout > 0 && g.paused >= g.cfg.LoadWaitTimeout {
+			return ErrLoadTooHigh
+		}
+		if g.cfg.Logger != nil {
+			g.cfg.Logger.Info(
+				"load too high, pausing defragmentation",
+				zap.Float64("load", load),
+				zap.Float64("max-load", g.cfg.MaxLoad),
+				zap.Duration("retry-in", interval),
+			)
+		}
+
+		start := time.Now()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+		g.paused += time.Since(start)
+	}
+}
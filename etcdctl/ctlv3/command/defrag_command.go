@@ -15,17 +15,89 @@
 package command
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"go.etcd.io/etcd/client/v3"
+	v3defrag "go.etcd.io/etcd/client/v3/defrag"
 	"go.etcd.io/etcd/etcdutl/v3/etcdutl"
 	"go.etcd.io/etcd/pkg/v3/cobrautl"
+	"go.uber.org/zap"
 )
 
+// defragOptions are the flags of the defrag command.
+type defragOptions struct {
+	dataDir       string
+	maxFailures   int
+	stopOnFailure bool
+	maxConcurrent int
+	timeout       time.Duration
+	stagger       time.Duration
+	retries       int
+
+	healthCheck        bool
+	healthCheckTimeout time.Duration
+	logStatus          bool
+	plan               bool
+	dryRun             bool
+	planRate           uint64
+	outputDir          string
+
+	monitor          bool
+	monitorInterval  time.Duration
+	monitorThreshold float64
+
+	interval time.Duration
+
+	maxLoad         float64
+	loadCommand     string
+	loadWaitTimeout time.Duration
+
+	minTotalReclaim  uint64
+	minFragmentation float64
+
+	compact    bool
+	compactRev int64
+
+	analyzeKeyspace       bool
+	analyzeKeyspaceSample int64
+
+	recordToEtcd    bool
+	recordPrefix    string
+	recordMaxBytes  int
+	recordKeepCount int64
+
+	confirmEach bool
+	yes         bool
+	excludes    []string
+	leaderLast  bool
+
+	rolling               bool
+	rollingStepDown       bool
+	rollingCatchUpTimeout time.Duration
+}
+
+var defragOpts defragOptions
+
 var (
-	defragDataDir string
+	// errDefragAborted is returned by confirmDefrag when the operator aborts.
+	errDefragAborted = errors.New("aborted by the operator")
+	// errRollingAborted is returned by rollingDefrag when it stops to keep
+	// the cluster safe.
+	errRollingAborted = errors.New("rolling defragmentation aborted")
 )
 
 // NewDefragCommand returns the cobra command for "Defrag".
@@ -36,37 +108,720 @@ func NewDefragCommand() *cobra.Command {
 		Run:   defragCommandFunc,
 	}
 	cmd.PersistentFlags().BoolVar(&epClusterEndpoints, "cluster", false, "use all endpoints from the cluster member list")
-	cmd.Flags().StringVar(&defragDataDir, "data-dir", "", "Optional. If present, defragments a data directory not in use by etcd.")
+	cmd.Flags().StringArrayVar(&defragOpts.excludes, "exclude", nil, "Endpoint, member name or hex member ID of a member not to defragment, e.g. under maintenance. Can be repeated.")
+	cmd.Flags().StringVar(&defragOpts.dataDir, "data-dir", "", "Optional. If present, defragments a data directory not in use by etcd.")
 	cmd.MarkFlagDirname("data-dir")
+	cmd.Flags().IntVar(&defragOpts.maxFailures, "max-failures", 0, "Abort the defragmentation once this many members have failed. 0 means unlimited.")
+	cmd.Flags().BoolVar(&defragOpts.stopOnFailure, "stop-on-failure", false, "Abort the defragmentation on the first failure, i.e. --max-failures=1, so that scripted procedures don't proceed. By default, all the members are processed and the failures are reported at the end.")
+	cmd.Flags().DurationVar(&defragOpts.timeout, "defrag-timeout", 0, "Timeout of the defragmentation of each member, which takes precedence over --command-timeout. 0 means --command-timeout.")
+	cmd.Flags().IntVar(&defragOpts.retries, "defrag-retries", 0, "Number of times the defragmentation of a member is retried, with an exponential backoff starting at 1s, before it counts as a failure. --defrag-timeout bounds all the attempts together.")
+	cmd.Flags().BoolVar(&defragOpts.healthCheck, "health-check", false, "Wait after defragmenting each member until it is healthy before the next one. A member not healthy within --health-check-timeout counts as a failure.")
+	cmd.Flags().DurationVar(&defragOpts.healthCheckTimeout, "health-check-timeout", time.Minute, "Maximum time to wait for a defragmented member to be healthy, used by --health-check.")
+	cmd.Flags().DurationVar(&defragOpts.stagger, "stagger", 0, "Time to wait after defragmenting a member before the next one, to let the cluster recover in between. There is no wait after the last member. 0 means no wait.")
+	cmd.Flags().IntVar(&defragOpts.maxConcurrent, "max-concurrent", 1, "Maximum number of members defragmented at once. Each defragmentation blocks the member, so only raise it if the cluster can tolerate several members being blocked.")
+	cmd.Flags().BoolVar(&defragOpts.logStatus, "log-status", false, "Log the status of each member before and after defragmentation, i.e. its DB size, DB size in use, raft index, raft term and leader. The DB size quota is not available from the member status, so it is not logged.")
+	cmd.Flags().BoolVar(&defragOpts.plan, "plan", false, "Print the estimated defragmentation time of each member and exit without defragmenting.")
+	cmd.Flags().BoolVar(&defragOpts.dryRun, "dry-run", false, "Print the DB size, the DB size in use and the estimated reclaimable space of each member, without defragmenting it.")
+	cmd.Flags().Uint64Var(&defragOpts.planRate, "plan-rate", defaultDefragPlanRate, "Assumed defragmentation throughput in bytes per second, used by --plan.")
+	cmd.Flags().StringVar(&defragOpts.outputDir, "output-dir", "", "Optional. If present, writes a log file for each member, named by member ID, to this directory.")
+	cmd.MarkFlagDirname("output-dir")
+	cmd.Flags().BoolVar(&defragOpts.monitor, "monitor", false, "Keep running in the foreground, periodically defragmenting the members whose fragmentation exceeds --monitor-threshold.")
+	cmd.Flags().DurationVar(&defragOpts.monitorInterval, "monitor-interval", 10*time.Minute, "Interval between two polls of the members' fragmentation, used by --monitor.")
+	cmd.Flags().Float64Var(&defragOpts.monitorThreshold, "monitor-threshold", 0.5, "Fragmentation ratio, i.e. the fraction of the DB size not in use, above which a member is defragmented, used by --monitor.")
+	cmd.Flags().DurationVar(&defragOpts.interval, "interval", 0, "Keep running in the foreground, repeating the compaction, with --compact, and the defragmentation every interval until interrupted. A failed cycle doesn't stop the loop unless --stop-on-failure is set. 0 means a single run.")
+	cmd.Flags().Float64Var(&defragOpts.maxLoad, "max-load", 0, "Pause before defragmenting the next member while the load is above this value. The load is the output of --load-command, or the raft entries committed per second if not set. 0 means disabled. Best-effort.")
+	cmd.Flags().StringVar(&defragOpts.loadCommand, "load-command", "", "Optional. A shell command, run with \"sh -c\", printing the current load as a single number on stdout, used by --max-load. A non-zero exit status is a failure to get the load, which doesn't pause the defragmentation.")
+	cmd.Flags().DurationVar(&defragOpts.loadWaitTimeout, "load-wait-timeout", time.Hour, "Abort the defragmentation once it has been paused by --max-load for this long in total. 0 means no limit.")
+	cmd.Flags().BoolVar(&defragOpts.compact, "compact", false, "Compact the key space before defragmenting, so that the space of the obsolete revisions is reclaimed too.")
+	cmd.Flags().Int64Var(&defragOpts.compactRev, "compact-rev", 0, "Revision to compact to, used by --compact. 0 means the latest revision.")
+	cmd.Flags().Float64Var(&defragOpts.minFragmentation, "min-fragmentation", 0, "Skip the members whose fragmentation ratio, i.e. the fraction of the DB size not in use, is not above this value, e.g. 0.2. Members whose status is unavailable are defragmented. 0 means disabled.")
+	cmd.Flags().Uint64Var(&defragOpts.minTotalReclaim, "min-total-reclaim", 0, "Skip the whole defragmentation if the estimated reclaimable space of all members, in bytes, is below this value. 0 means disabled.")
+	cmd.Flags().BoolVar(&defragOpts.analyzeKeyspace, "analyze-keyspace", false, "Print a histogram of key counts and value sizes by key prefix before and after defragmentation. Expensive, as it reads the values of up to --analyze-keyspace-sample keys twice.")
+	cmd.Flags().Int64Var(&defragOpts.analyzeKeyspaceSample, "analyze-keyspace-sample", 10000, "Maximum number of keys read by --analyze-keyspace, in key order.")
+	cmd.Flags().BoolVar(&defragOpts.recordToEtcd, "record-to-etcd", false, "Record a summary of the defragmentation under --record-prefix in the etcd cluster, for auditing.")
+	cmd.Flags().StringVar(&defragOpts.recordPrefix, "record-prefix", "/etcdctl/defrag/records/", "Key prefix of the records written by --record-to-etcd.")
+	cmd.Flags().IntVar(&defragOpts.recordMaxBytes, "record-max-bytes", 16*1024, "Maximum size of a record written by --record-to-etcd. The per-member results are truncated to fit.")
+	cmd.Flags().Int64Var(&defragOpts.recordKeepCount, "record-keep", 0, "Number of most recent records to keep under --record-prefix, older ones are deleted. 0 means keep all.")
+	cmd.Flags().BoolVar(&defragOpts.confirmEach, "confirm-each", false, "Print the status of each member and prompt for confirmation before defragmenting it. Requires an interactive terminal.")
+	cmd.Flags().BoolVarP(&defragOpts.yes, "yes", "y", false, "Don't prompt for confirmation before defragmenting all the members with --cluster, e.g. for automation.")
+	cmd.Flags().BoolVar(&defragOpts.leaderLast, "leader-last", false, "Defragment the leader after all the followers, as defragmenting the leader briefly blocks the writes. Use with --cluster.")
+	cmd.Flags().BoolVar(&defragOpts.rolling, "rolling", false, "Defragment the members one at a time, the leader last, waiting for each member to catch up before the next, and abort if the quorum could be lost. Requires --cluster.")
+	cmd.Flags().BoolVar(&defragOpts.rollingStepDown, "rolling-step-down", false, "Move the leadership to the most up to date healthy follower before defragmenting the leader, used by --rolling.")
+	cmd.Flags().DurationVar(&defragOpts.rollingCatchUpTimeout, "rolling-catch-up-timeout", time.Minute, "Maximum time to wait for a defragmented member to catch up, used by --rolling.")
 	return cmd
 }
 
 func defragCommandFunc(cmd *cobra.Command, args []string) {
-	if len(defragDataDir) > 0 {
+	if len(defragOpts.dataDir) > 0 {
 		fmt.Fprintf(os.Stderr, "Use `etcdutl defrag` instead. The --data-dir is going to be decomissioned in v3.6.\n\n")
-		err := etcdutl.DefragData(defragDataDir)
+		err := etcdutl.DefragData(defragOpts.dataDir)
 		if err != nil {
 			cobrautl.ExitWithError(cobrautl.ExitError, err)
 		}
 	}
 
-	failures := 0
+	var lg *zap.Logger
+	if defragOpts.logStatus {
+		var err error
+		if lg, err = zap.NewProduction(); err != nil {
+			cobrautl.ExitWithError(cobrautl.ExitError, err)
+		}
+	}
+
+	timeOut, err := cmd.Flags().GetDuration("command-timeout")
+	if err != nil {
+		cobrautl.ExitWithError(cobrautl.ExitError, err)
+	}
+	if defragOpts.compactRev < 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--compact-rev can't be negative"))
+	}
+	if defragOpts.compactRev > 0 && !defragOpts.compact {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--compact-rev requires --compact"))
+	}
+	if defragOpts.minFragmentation < 0 || defragOpts.minFragmentation >= 1 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--min-fragmentation must be between 0 and 1"))
+	}
+	if defragOpts.stopOnFailure {
+		if cmd.Flags().Changed("max-failures") {
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--stop-on-failure can't be used with --max-failures"))
+		}
+		defragOpts.maxFailures = 1
+	}
+	if defragOpts.retries < 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--defrag-retries can't be negative"))
+	}
+	if defragOpts.healthCheck && defragOpts.healthCheckTimeout <= 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--health-check-timeout must be greater than 0"))
+	}
+	if defragOpts.stagger < 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--stagger can't be negative"))
+	}
+	if defragOpts.timeout < 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--defrag-timeout can't be negative"))
+	}
+	if defragOpts.maxConcurrent < 1 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--max-concurrent must be at least 1"))
+	}
+	if defragOpts.rolling && !epClusterEndpoints {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--rolling checks the quorum of the whole cluster, and requires --cluster"))
+	}
+	if defragOpts.rolling && defragOpts.maxConcurrent > 1 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--rolling defragments one member at a time, and can't be used with --max-concurrent"))
+	}
+	if defragOpts.leaderLast && defragOpts.maxConcurrent > 1 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--leader-last can't be used with --max-concurrent, as the leader could be defragmented along with the followers"))
+	}
+
+	if defragOpts.dryRun {
+		switch {
+		case defragOpts.dataDir != "":
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--dry-run can't be used with --data-dir"))
+		case defragOpts.monitor:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--dry-run can't be used with --monitor"))
+		case defragOpts.plan:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--dry-run can't be used with --plan"))
+		}
+	}
+
+	if defragOpts.interval < 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval can't be negative"))
+	}
+	if defragOpts.interval > 0 {
+		switch {
+		case defragOpts.dataDir != "":
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval can't be used with --data-dir"))
+		case defragOpts.monitor:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval can't be used with --monitor"))
+		case defragOpts.plan || defragOpts.dryRun:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval can't be used with --plan or --dry-run"))
+		case defragOpts.confirmEach:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval runs unattended, and can't be used with --confirm-each"))
+		case defragOpts.analyzeKeyspace:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval can't be used with --analyze-keyspace"))
+		case defragOpts.compactRev > 0:
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--interval compacts to the latest revision in each cycle, and can't be used with --compact-rev"))
+		}
+	}
+
+	if defragOpts.outputDir != "" {
+		if err := os.MkdirAll(defragOpts.outputDir, 0755); err != nil {
+			cobrautl.ExitWithError(cobrautl.ExitError, err)
+		}
+	}
+
 	c := mustClientFromCmd(cmd)
-	for _, ep := range endpointsFromCluster(cmd) {
-		ctx, cancel := commandCtx(cmd)
-		start := time.Now()
-		_, err := c.Defragment(ctx, ep)
-		d := time.Now().Sub(start)
-		cancel()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to defragment etcd member[%s]. took %s. (%v)\n", ep, d.String(), err)
+	eps := endpointsFromCluster(cmd)
+	if len(defragOpts.excludes) > 0 {
+		eps = excludeEndpoints(cmd, c, eps)
+	}
+	if defragOpts.plan {
+		planDefrag(cmd, c, eps)
+		return
+	}
+	stdin := bufio.NewReader(os.Stdin)
+	if epClusterEndpoints && !defragOpts.yes && !defragOpts.dryRun {
+		confirmClusterDefrag(stdin, eps)
+	}
+	if defragOpts.interval > 0 {
+		dcfg := newDefragConfig(c, eps, timeOut, lg, nil)
+		if lg == nil {
+			if lg, err = zap.NewProduction(); err != nil {
+				cobrautl.ExitWithError(cobrautl.ExitError, err)
+			}
+		}
+		loopDefrag(cmd, c, eps, dcfg, lg)
+		return
+	}
+	if defragOpts.compact && !defragOpts.dryRun {
+		compactBeforeDefrag(cmd, c)
+	}
+	if defragOpts.minTotalReclaim > 0 && !defragOpts.dryRun {
+		reclaim := estimateReclaim(cmd, c, eps)
+		if reclaim < defragOpts.minTotalReclaim {
+			fmt.Fprintf(defragInfoOutput(), "Skipped defragmentation, the estimated reclaimable space %s is below --min-total-reclaim %s\n",
+				humanize.Bytes(reclaim), humanize.Bytes(defragOpts.minTotalReclaim))
+			return
+		}
+	}
+	if defragOpts.monitor {
+		if lg == nil {
+			if lg, err = zap.NewProduction(); err != nil {
+				cobrautl.ExitWithError(cobrautl.ExitError, err)
+			}
+		}
+		monitorDefrag(c, eps, timeOut, lg)
+		return
+	}
+
+	if defragOpts.analyzeKeyspace && !defragOpts.dryRun {
+		printKeyspaceHistogram(cmd, c, "before defragmentation")
+	}
+	if defragOpts.leaderLast {
+		eps = leaderLast(cmd, c, eps)
+	}
+
+	var confirm func(string, *clientv3.StatusResponse) error
+	if defragOpts.confirmEach && !defragOpts.dryRun {
+		if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--confirm-each requires an interactive terminal"))
+		}
+		confirm = confirmDefrag(stdin)
+	}
+
+	dcfg := newDefragConfig(c, eps, timeOut, lg, confirm)
+	var results []v3defrag.Result
+	start := time.Now()
+	if defragOpts.rolling && !defragOpts.dryRun {
+		results, err = rollingDefrag(context.Background(), cmd, c, eps, dcfg)
+	} else {
+		results, err = v3defrag.Defragment(context.Background(), c, dcfg)
+	}
+	if !streamDefragResults() {
+		// The structured output is printed even if some members failed.
+		displayDefragResults(results)
+	}
+
+	if defragOpts.analyzeKeyspace && !defragOpts.dryRun {
+		printKeyspaceHistogram(cmd, c, "after defragmentation")
+	}
+
+	failures := 0
+	for _, res := range results {
+		if res.Err != nil {
 			failures++
-		} else {
-			fmt.Printf("Finished defragmenting etcd member[%s]. took %s\n", ep, d.String())
 		}
 	}
+	if defragOpts.maxConcurrent > 1 && streamDefragResults() && !defragOpts.dryRun {
+		// The results are printed as the members finish, so a summary is
+		// printed once all of them have.
+		fmt.Printf("Defragmented %d etcd member(s), %d failed. took %s\n", len(results), failures, time.Since(start))
+	}
+	if defragOpts.recordToEtcd && !defragOpts.dryRun {
+		if rerr := recordDefrag(cmd, c, results, err); rerr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record the defragmentation to etcd. (%v)\n", rerr)
+		}
+	}
+	if errors.Is(err, errRollingAborted) {
+		fmt.Fprintf(os.Stderr, "Aborted defragmentation: %v. completed: %v, skipped: %v\n", err, completedEndpoints(eps, results), unprocessedEndpoints(eps, results))
+		os.Exit(cobrautl.ExitError)
+	}
+	switch err {
+	case v3defrag.ErrTooManyFailures:
+		fmt.Fprintf(os.Stderr, "Aborted defragmentation after %d failure(s). completed: %v, skipped: %v\n", failures, completedEndpoints(eps, results), unprocessedEndpoints(eps, results))
+	case errDefragAborted:
+		fmt.Fprintf(os.Stderr, "Aborted defragmentation. completed: %v, skipped: %v\n", completedEndpoints(eps, results), unprocessedEndpoints(eps, results))
+		os.Exit(cobrautl.ExitInterrupted)
+	case v3defrag.ErrLoadTooHigh:
+		fmt.Fprintf(os.Stderr, "Aborted defragmentation as the load stayed above %v for %s. completed: %v, skipped: %v\n", defragOpts.maxLoad, defragOpts.loadWaitTimeout, completedEndpoints(eps, results), unprocessedEndpoints(eps, results))
+		os.Exit(cobrautl.ExitError)
+	}
 
 	if failures != 0 {
 		os.Exit(cobrautl.ExitError)
 	}
 }
+
+// newDefragConfig returns the v3defrag.Config of the flags, which prints the
+// result of each member as soon as it is processed with the simple output
+// format. lg is only used for --log-status.
+func newDefragConfig(c *clientv3.Client, eps []string, timeOut time.Duration, lg *zap.Logger, confirm func(string, *clientv3.StatusResponse) error) v3defrag.Config {
+	return v3defrag.Config{
+		Endpoints:       eps,
+		DryRun:          defragOpts.dryRun,
+		MaxConcurrent:   defragOpts.maxConcurrent,
+		RequestTimeout:  timeOut,
+		DefragTimeout:   defragOpts.timeout,
+		Stagger:         defragOpts.stagger,
+		Retries:         defragOpts.retries,
+		OnRetry:         printDefragRetry,
+		HealthTimeout:   defragHealthTimeout(),
+		MaxFailures:     defragOpts.maxFailures,
+		Logger:          lg,
+		CollectStatus:   true,
+		Load:            defragLoad(c, eps, timeOut),
+		MaxLoad:         defragOpts.maxLoad,
+		LoadWaitTimeout: defragOpts.loadWaitTimeout,
+		Confirm:         confirm,
+		Predicate:       minFragmentationPredicate(),
+		OnResult: func(res v3defrag.Result) {
+			if streamDefragResults() {
+				display.Defrag([]epDefrag{newEpDefrag(res)})
+			}
+			if defragOpts.outputDir != "" {
+				if err := writeDefragLog(defragOpts.outputDir, res); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to write defragmentation log of etcd member[%s]. (%v)\n", res.Endpoint, err)
+				}
+			}
+		},
+	}
+}
+
+// displayDefragResults prints the results of all the members at once, as
+// done by the structured output formats.
+func displayDefragResults(results []v3defrag.Result) {
+	epResults := make([]epDefrag, 0, len(results))
+	for _, res := range results {
+		epResults = append(epResults, newEpDefrag(res))
+	}
+	display.Defrag(epResults)
+}
+
+// epDefrag is the result of defragmenting a single member, as printed by
+// the structured output formats.
+type epDefrag struct {
+	Ep      string `json:"endpoint"`
+	Success bool   `json:"success"`
+	Skipped bool   `json:"skipped,omitempty"`
+	DryRun  bool   `json:"dry_run,omitempty"`
+	Took    string `json:"took"`
+	// DbSize and DbSizeInUse are the size of the member after the
+	// defragmentation, or its current size in a dry run, or nil if
+	// unavailable.
+	DbSize      *int64 `json:"db_size,omitempty"`
+	DbSizeInUse *int64 `json:"db_size_in_use,omitempty"`
+	// Reclaimed is the number of bytes reclaimed, or the estimated
+	// reclaimable bytes in a dry run, or nil if the size of the member is
+	// unavailable.
+	Reclaimed *int64 `json:"reclaimed_bytes,omitempty"`
+	Error     string `json:"error,omitempty"`
+
+	res v3defrag.Result
+}
+
+func newEpDefrag(res v3defrag.Result) epDefrag {
+	r := epDefrag{
+		Ep:      res.Endpoint,
+		Success: res.Err == nil,
+		Skipped: res.Skipped,
+		DryRun:  res.DryRun,
+		Took:    res.Took.String(),
+		res:     res,
+	}
+	st := res.StatusAfter
+	if res.DryRun {
+		st = res.StatusBefore
+	}
+	if st != nil {
+		r.DbSize, r.DbSizeInUse = &st.DbSize, &st.DbSizeInUse
+	}
+	if res.Err != nil {
+		r.Error = res.Err.Error()
+	} else if reclaimed, ok := res.Reclaimed(); ok && !res.Skipped {
+		r.Reclaimed = &reclaimed
+	}
+	return r
+}
+
+// streamDefragResults reports whether the result of each member is printed
+// as soon as it is processed, which is the case of the default human
+// readable output. The structured output formats print all the results at
+// once instead.
+func streamDefragResults() bool {
+	_, ok := display.(*simplePrinter)
+	return ok
+}
+
+// minFragmentationPredicate returns the predicate skipping the members whose
+// fragmentation ratio is not above --min-fragmentation, or nil if it is
+// disabled.
+func minFragmentationPredicate() v3defrag.Predicate {
+	if defragOpts.minFragmentation <= 0 {
+		return nil
+	}
+	return func(ep string, st *clientv3.StatusResponse) bool {
+		return v3defrag.Fragmentation(st) > defragOpts.minFragmentation
+	}
+}
+
+// completedEndpoints returns the endpoints successfully defragmented, in the
+// order of eps. The members which failed, or were skipped or only planned by
+// a dry run, are not completed.
+func completedEndpoints(eps []string, results []v3defrag.Result) []string {
+	defragmented := make(map[string]bool, len(results))
+	for _, res := range results {
+		if res.Err == nil && !res.Skipped && !res.DryRun {
+			defragmented[res.Endpoint] = true
+		}
+	}
+	var completed []string
+	for _, ep := range eps {
+		if defragmented[ep] {
+			completed = append(completed, ep)
+		}
+	}
+	return completed
+}
+
+// unprocessedEndpoints returns the endpoints without a result, in order. The
+// results are in the order the members finished, which is not the order of
+// the endpoints with --max-concurrent.
+func unprocessedEndpoints(eps []string, results []v3defrag.Result) []string {
+	processed := make(map[string]bool, len(results))
+	for _, res := range results {
+		processed[res.Endpoint] = true
+	}
+	var unprocessed []string
+	for _, ep := range eps {
+		if !processed[ep] {
+			unprocessed = append(unprocessed, ep)
+		}
+	}
+	return unprocessed
+}
+
+// defragHealthTimeout returns the v3defrag.Config.HealthTimeout of
+// --health-check, which is 0 if it is disabled.
+func defragHealthTimeout() time.Duration {
+	if !defragOpts.healthCheck {
+		return 0
+	}
+	return defragOpts.healthCheckTimeout
+}
+
+func printDefragRetry(ep string, attempt int, backoff time.Duration, err error) {
+	fmt.Fprintf(os.Stderr, "Failed to defragment etcd member[%s], retry %d/%d in %s. (%v)\n", ep, attempt, defragOpts.retries, backoff, err)
+}
+
+func printDefragResult(res v3defrag.Result) {
+	if res.Skipped {
+		// The members are only skipped by the --min-fragmentation
+		// predicate if their status is available.
+		if defragOpts.minFragmentation > 0 && res.StatusBefore != nil {
+			if ratio := v3defrag.Fragmentation(res.StatusBefore); ratio <= defragOpts.minFragmentation {
+				fmt.Printf("Skipped defragmenting etcd member[%s] (fragmentation %.2f below threshold %.2f)\n", res.Endpoint, ratio, defragOpts.minFragmentation)
+				return
+			}
+		}
+		fmt.Printf("Skipped defragmenting etcd member[%s]\n", res.Endpoint)
+	} else if res.DryRun {
+		if reclaimed, ok := res.Reclaimed(); ok {
+			fmt.Printf("Would defragment etcd member[%s]. db size %s, in use %s, estimated reclaimable %s\n",
+				res.Endpoint, humanize.Bytes(uint64(res.StatusBefore.DbSize)),
+				humanize.Bytes(uint64(res.StatusBefore.DbSizeInUse)), humanize.Bytes(uint64(reclaimed)))
+		} else {
+			fmt.Printf("Would defragment etcd member[%s]. size info unavailable\n", res.Endpoint)
+		}
+	} else if errors.Is(res.Err, v3defrag.ErrUnhealthy) {
+		fmt.Fprintf(os.Stderr, "Defragmented etcd member[%s], but it is not healthy. took %s. (%v)\n", res.Endpoint, res.Took.String(), res.Err)
+	} else if res.Err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to defragment etcd member[%s]. took %s. (%v)\n", res.Endpoint, res.Took.String(), res.Err)
+	} else if reclaimed, ok := res.Reclaimed(); ok {
+		fmt.Printf("Finished defragmenting etcd member[%s]. took %s, db size %s -> %s, in use %s, reclaimed %s\n",
+			res.Endpoint, res.Took.String(),
+			humanize.Bytes(uint64(res.StatusBefore.DbSize)), humanize.Bytes(uint64(res.StatusAfter.DbSize)),
+			humanize.Bytes(uint64(res.StatusAfter.DbSizeInUse)), humanize.Bytes(uint64(reclaimed)))
+	} else {
+		fmt.Printf("Finished defragmenting etcd member[%s]. took %s, size info unavailable\n", res.Endpoint, res.Took.String())
+	}
+}
+
+// confirmClusterDefrag lists the endpoints defragmented with --cluster, and
+// exits unless the operator confirms. It refuses to prompt if stdin is not a
+// terminal, so that scripts fail instead of hanging, unless --yes is set.
+func confirmClusterDefrag(r *bufio.Reader, eps []string) {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--cluster requires a confirmation from an interactive terminal, use --yes to defragment all the members without it"))
+	}
+
+	w := defragInfoOutput()
+	fmt.Fprintf(w, "The following %d etcd member(s) will be defragmented, which blocks each of them meanwhile:\n", len(eps))
+	for _, ep := range eps {
+		fmt.Fprintf(w, "  %s\n", ep)
+	}
+	fmt.Fprint(w, "Proceed? [y/N]: ")
+	answer, err := r.ReadString('\n')
+	if err == nil {
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Aborted defragmentation.")
+	os.Exit(cobrautl.ExitInterrupted)
+}
+
+// confirmDefrag returns a v3defrag.Config.Confirm which prints the status
+// of each member, and prompts whether to defragment it, skip it, or abort.
+func confirmDefrag(r *bufio.Reader) func(string, *clientv3.StatusResponse) error {
+	return func(ep string, st *clientv3.StatusResponse) error {
+		if st == nil {
+			fmt.Fprintf(defragInfoOutput(), "etcd member[%s]: status unavailable\n", ep)
+		} else {
+			role := "follower"
+			if isLeader(st) {
+				role = "leader"
+			}
+			if st.IsLearner {
+				role = "learner"
+			}
+			var lag uint64
+			if st.RaftIndex > st.RaftAppliedIndex {
+				lag = st.RaftIndex - st.RaftAppliedIndex
+			}
+			fmt.Fprintf(defragInfoOutput(), "etcd member[%s]: db size %s, in use %s, fragmentation %.1f%%, %s, apply lag %d\n",
+				ep, humanize.Bytes(uint64(st.DbSize)), humanize.Bytes(uint64(st.DbSizeInUse)),
+				v3defrag.Fragmentation(st)*100, role, lag)
+		}
+
+		for {
+			fmt.Fprintf(defragInfoOutput(), "Defragment etcd member[%s]? [y]es/[s]kip/[a]bort: ", ep)
+			answer, err := r.ReadString('\n')
+			if err != nil {
+				fmt.Fprintf(defragInfoOutput(), "\nDecision for etcd member[%s]: abort\n", ep)
+				return errDefragAborted
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "y", "yes":
+				fmt.Fprintf(defragInfoOutput(), "Decision for etcd member[%s]: defragment\n", ep)
+				return nil
+			case "s", "skip":
+				fmt.Fprintf(defragInfoOutput(), "Decision for etcd member[%s]: skip\n", ep)
+				return v3defrag.ErrSkipMember
+			case "a", "abort":
+				fmt.Fprintf(defragInfoOutput(), "Decision for etcd member[%s]: abort\n", ep)
+				return errDefragAborted
+			}
+		}
+	}
+}
+
+// writeDefragLog writes the result of defragmenting a single member to its
+// own file in dir. The file is named after the member ID, or after the
+// endpoint when the member could not be reached.
+func writeDefragLog(dir string, res v3defrag.Result) error {
+	name := strings.NewReplacer("://", "_", "/", "_", ":", "_").Replace(res.Endpoint)
+	var b strings.Builder
+	fmt.Fprintf(&b, "endpoint: %s\n", res.Endpoint)
+	for _, st := range []*clientv3.StatusResponse{res.StatusBefore, res.StatusAfter} {
+		if st != nil && st.Header != nil {
+			name = fmt.Sprintf("%x", st.Header.MemberId)
+			fmt.Fprintf(&b, "member-id: %s\n", name)
+			break
+		}
+	}
+	writeDefragStatus(&b, "before", res.StatusBefore)
+	switch {
+	case res.Skipped:
+		b.WriteString("result: skipped\n")
+	case res.DryRun:
+		b.WriteString("result: dry run\n")
+	case res.Err != nil:
+		fmt.Fprintf(&b, "result: failed after %s: %v\n", res.Took, res.Err)
+	default:
+		fmt.Fprintf(&b, "result: finished in %s\n", res.Took)
+	}
+	writeDefragStatus(&b, "after", res.StatusAfter)
+	return os.WriteFile(filepath.Join(dir, name+".log"), []byte(b.String()), 0644)
+}
+
+func writeDefragStatus(b *strings.Builder, stage string, st *clientv3.StatusResponse) {
+	if st == nil {
+		fmt.Fprintf(b, "status-%s: unavailable\n", stage)
+		return
+	}
+	fmt.Fprintf(b, "status-%s: db-size=%d db-size-in-use=%d raft-index=%d raft-term=%d leader=%x\n",
+		stage, st.DbSize, st.DbSizeInUse, st.RaftIndex, st.RaftTerm, st.Leader)
+}
+
+// defragLoad returns the load source used by --max-load, or nil if it is
+// disabled. Without --load-command, the load is the rate of the raft entries
+// committed by the leader, which is looked up before each measurement as the
+// leadership may move during the run.
+//
+// --load-command is run with "sh -c", and must print the load as a single
+// number, e.g. "0.75", on stdout. A non-zero exit status, or an output which
+// is not a number, is a failure to get the load, which doesn't pause the run
+// as --max-load is best-effort.
+func defragLoad(c *clientv3.Client, eps []string, timeOut time.Duration) v3defrag.LoadFunc {
+	if defragOpts.maxLoad <= 0 {
+		return nil
+	}
+	if defragOpts.loadCommand == "" {
+		return func(ctx context.Context) (float64, error) {
+			return v3defrag.RaftIndexRate(c, loadEndpoint(ctx, c, eps, timeOut), time.Second)(ctx)
+		}
+	}
+	return func(ctx context.Context) (float64, error) {
+		out, err := exec.CommandContext(ctx, "sh", "-c", defragOpts.loadCommand).Output()
+		if err != nil {
+			return 0, fmt.Errorf("load command failed: %v", err)
+		}
+		return strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	}
+}
+
+// loadEndpoint returns the endpoint of the leader among the given endpoints,
+// or the first endpoint if the leader is not among them, e.g. as it is
+// excluded, or can't be determined.
+func loadEndpoint(ctx context.Context, c *clientv3.Client, eps []string, timeOut time.Duration) string {
+	for _, ep := range eps {
+		rctx, cancel := context.WithTimeout(ctx, timeOut)
+		st, err := c.Status(rctx, ep)
+		cancel()
+		if err == nil && isLeader(st) {
+			return ep
+		}
+	}
+	return eps[0]
+}
+
+// defragInfoOutput returns where to print the informational messages, which
+// is stderr with the structured output formats to keep them parsable.
+func defragInfoOutput() io.Writer {
+	if !streamDefragResults() {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// excludeEndpoints returns the given endpoints without the ones matching
+// --exclude, i.e. equal to it, or the client URLs of the member with the
+// name or hex ID it holds. Each --exclude must match a cluster member, or
+// one of the endpoints.
+func excludeEndpoints(cmd *cobra.Command, c *clientv3.Client, eps []string) []string {
+	ctx, cancel := commandCtx(cmd)
+	mresp, err := c.MemberList(ctx)
+	cancel()
+	if err != nil {
+		cobrautl.ExitWithError(cobrautl.ExitError, fmt.Errorf("failed to list members to apply --exclude (%v)", err))
+	}
+
+	remaining, excluded, err := filterExcludes(eps, mresp.Members, defragOpts.excludes)
+	if err != nil {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, err)
+	}
+	out := defragInfoOutput()
+	for _, ep := range excluded {
+		fmt.Fprintf(out, "Excluded etcd member[%s]\n", ep)
+	}
+	if len(remaining) == 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, errors.New("all the endpoints are excluded by --exclude"))
+	}
+	return remaining
+}
+
+// filterExcludes splits the given endpoints into the remaining and the
+// excluded ones, in order, as described by excludeEndpoints.
+func filterExcludes(eps []string, members []*etcdserverpb.Member, excludes []string) (remaining, excluded []string, err error) {
+	isExcluded := make(map[string]bool)
+	for _, x := range excludes {
+		matched := false
+		for _, ep := range eps {
+			if ep == x {
+				isExcluded[ep] = true
+				matched = true
+			}
+		}
+		for _, m := range members {
+			if m.Name != x && fmt.Sprintf("%x", m.ID) != x && !containsString(m.ClientURLs, x) {
+				continue
+			}
+			matched = true
+			for _, u := range m.ClientURLs {
+				isExcluded[u] = true
+			}
+		}
+		if !matched {
+			return nil, nil, fmt.Errorf("--exclude %q doesn't match any cluster member", x)
+		}
+	}
+
+	for _, ep := range eps {
+		if isExcluded[ep] {
+			excluded = append(excluded, ep)
+			continue
+		}
+		remaining = append(remaining, ep)
+	}
+	return remaining, excluded, nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// compactBeforeDefrag compacts the key space to --compact-rev, or to the
+// latest revision if it is not set. The compaction is physical, i.e. it
+// waits for the obsolete revisions to be removed from the backend, so that
+// the defragmentation reclaims their space. A revision which is already
+// compacted is not an error.
+func compactBeforeDefrag(cmd *cobra.Command, c *clientv3.Client) {
+	if err := compactKeyspace(cmd, c); err != nil {
+		cobrautl.ExitWithError(cobrautl.ExitError, err)
+	}
+}
+
+// compactKeyspace compacts the key space to --compact-rev, or to the latest
+// revision if it is not set. A revision already compacted is not an error.
+func compactKeyspace(cmd *cobra.Command, c *clientv3.Client) error {
+	out := defragInfoOutput()
+	rev := defragOpts.compactRev
+	if rev == 0 {
+		// Only the revision in the header of the linearizable read is used.
+		ctx, cancel := commandCtx(cmd)
+		resp, err := c.Get(ctx, "/", clientv3.WithCountOnly())
+		cancel()
+		if err != nil {
+			return fmt.Errorf("failed to get the latest revision to compact to (%v)", err)
+		}
+		rev = resp.Header.Revision
+	}
+
+	ctx, cancel := commandCtx(cmd)
+	_, err := c.Compact(ctx, rev, clientv3.WithCompactPhysical())
+	cancel()
+	if err == rpctypes.ErrCompacted {
+		fmt.Fprintf(out, "Skipped compaction, revision %d is already compacted\n", rev)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compact revision %d (%v)", rev, err)
+	}
+	fmt.Fprintf(out, "Compacted revision %d\n", rev)
+	return nil
+}
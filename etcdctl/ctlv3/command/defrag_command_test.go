@@ -0,0 +1,229 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/v3"
+	v3defrag "go.etcd.io/etcd/client/v3/defrag"
+)
+
+func TestFilterExcludes(t *testing.T) {
+	eps := []string{"http://a:2379", "http://b:2379", "http://c:2379"}
+	members := []*pb.Member{
+		{ID: 0xa, Name: "a", ClientURLs: []string{"http://a:2379", "http://a:22379"}},
+		{ID: 0xb, Name: "b", ClientURLs: []string{"http://b:2379"}},
+		{ID: 0xc, Name: "c", ClientURLs: []string{"http://c:2379"}},
+	}
+
+	tt := []struct {
+		name     string
+		excludes []string
+
+		remaining []string
+		excluded  []string
+		err       string
+	}{
+		{
+			name:      "no exclude",
+			remaining: eps,
+		},
+		{
+			name:      "endpoint",
+			excludes:  []string{"http://b:2379"},
+			remaining: []string{"http://a:2379", "http://c:2379"},
+			excluded:  []string{"http://b:2379"},
+		},
+		{
+			name:      "member name and hex ID",
+			excludes:  []string{"c", "a"},
+			remaining: []string{"http://b:2379"},
+			excluded:  []string{"http://a:2379", "http://c:2379"},
+		},
+		{
+			name:      "other client URL of a member",
+			excludes:  []string{"http://a:22379"},
+			remaining: []string{"http://b:2379", "http://c:2379"},
+			excluded:  []string{"http://a:2379"},
+		},
+		{
+			name:     "all the endpoints",
+			excludes: []string{"a", "b", "c"},
+			excluded: eps,
+		},
+		{
+			name:     "no match",
+			excludes: []string{"b", "d"},
+			err:      `--exclude "d" doesn't match any cluster member`,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			remaining, excluded, err := filterExcludes(eps, members, tc.excludes)
+			if tc.err != "" {
+				if err == nil || err.Error() != tc.err {
+					t.Fatalf("Unexpected error, expected: %q, got: %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(remaining, tc.remaining) || !reflect.DeepEqual(excluded, tc.excluded) {
+				t.Errorf("Unexpected endpoints, expected: %v excluding %v, got: %v excluding %v", tc.remaining, tc.excluded, remaining, excluded)
+			}
+		})
+	}
+}
+
+func TestMinFragmentationPredicate(t *testing.T) {
+	defer func(v float64) { defragOpts.minFragmentation = v }(defragOpts.minFragmentation)
+
+	defragOpts.minFragmentation = 0
+	if minFragmentationPredicate() != nil {
+		t.Fatal("Expected no predicate with --min-fragmentation=0")
+	}
+
+	defragOpts.minFragmentation = 0.5
+	pred := minFragmentationPredicate()
+	tt := []struct {
+		dbSize, dbSizeInUse int64
+
+		expected bool
+	}{
+		{dbSize: 100, dbSizeInUse: 40, expected: true},
+		{dbSize: 100, dbSizeInUse: 50, expected: false},
+		{dbSize: 100, dbSizeInUse: 90, expected: false},
+	}
+	for _, tc := range tt {
+		st := &clientv3.StatusResponse{DbSize: tc.dbSize, DbSizeInUse: tc.dbSizeInUse}
+		if defrag := pred("ep", st); defrag != tc.expected {
+			t.Errorf("Unexpected predicate of %d/%d, expected: %v, got: %v", tc.dbSizeInUse, tc.dbSize, tc.expected, defrag)
+		}
+	}
+}
+
+func TestUnprocessedEndpoints(t *testing.T) {
+	eps := []string{"a", "b", "c", "d"}
+	tt := []struct {
+		results []v3defrag.Result
+
+		expected []string
+	}{
+		{results: nil, expected: eps},
+		// The results are in the order the members finished.
+		{results: []v3defrag.Result{{Endpoint: "c"}, {Endpoint: "a"}}, expected: []string{"b", "d"}},
+		{results: []v3defrag.Result{{Endpoint: "d"}, {Endpoint: "b"}, {Endpoint: "a"}, {Endpoint: "c"}}, expected: nil},
+	}
+	for _, tc := range tt {
+		if unprocessed := unprocessedEndpoints(eps, tc.results); !reflect.DeepEqual(unprocessed, tc.expected) {
+			t.Errorf("Unexpected unprocessed endpoints, expected: %v, got: %v", tc.expected, unprocessed)
+		}
+	}
+}
+
+func TestCompletedEndpoints(t *testing.T) {
+	eps := []string{"a", "b", "c", "d"}
+	tt := []struct {
+		results []v3defrag.Result
+
+		expected []string
+	}{
+		{results: nil, expected: nil},
+		// The results are in the order the members finished.
+		{results: []v3defrag.Result{{Endpoint: "c"}, {Endpoint: "a"}}, expected: []string{"a", "c"}},
+		{
+			results: []v3defrag.Result{
+				{Endpoint: "d"},
+				{Endpoint: "b", Err: errors.New("failed")},
+				{Endpoint: "a", Skipped: true},
+				{Endpoint: "c", DryRun: true},
+			},
+			expected: []string{"d"},
+		},
+	}
+	for _, tc := range tt {
+		if completed := completedEndpoints(eps, tc.results); !reflect.DeepEqual(completed, tc.expected) {
+			t.Errorf("Unexpected completed endpoints, expected: %v, got: %v", tc.expected, completed)
+		}
+	}
+}
+
+func TestConfirmDefrag(t *testing.T) {
+	tt := []struct {
+		name  string
+		input string
+
+		expected error
+	}{
+		{name: "yes", input: "y\n", expected: nil},
+		{name: "yes in upper case", input: " YES \n", expected: nil},
+		{name: "skip", input: "s\n", expected: v3defrag.ErrSkipMember},
+		{name: "abort", input: "abort\n", expected: errDefragAborted},
+		{name: "prompts again on an invalid answer", input: "maybe\n\nskip\n", expected: v3defrag.ErrSkipMember},
+		{name: "aborts on EOF", input: "", expected: errDefragAborted},
+		{name: "aborts on EOF after an invalid answer", input: "maybe\n", expected: errDefragAborted},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			confirm := confirmDefrag(bufio.NewReader(strings.NewReader(tc.input)))
+			if err := confirm("ep", &clientv3.StatusResponse{DbSize: 100, DbSizeInUse: 50}); err != tc.expected {
+				t.Errorf("Unexpected decision, expected: %v, got: %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestDefragLoadCommand(t *testing.T) {
+	defer func(maxLoad float64, command string) {
+		defragOpts.maxLoad, defragOpts.loadCommand = maxLoad, command
+	}(defragOpts.maxLoad, defragOpts.loadCommand)
+
+	defragOpts.maxLoad = 0
+	if defragLoad(nil, nil, time.Second) != nil {
+		t.Fatal("Expected no load source with --max-load=0")
+	}
+
+	defragOpts.maxLoad = 1
+	tt := []struct {
+		command string
+
+		expected float64
+		err      bool
+	}{
+		{command: "echo 0.75", expected: 0.75},
+		{command: "echo ' 12 '", expected: 12},
+		{command: "echo 0.75; exit 1", err: true},
+		{command: "echo high", err: true},
+	}
+	for _, tc := range tt {
+		defragOpts.loadCommand = tc.command
+		load, err := defragLoad(nil, nil, time.Second)(context.Background())
+		if (err != nil) != tc.err {
+			t.Errorf("Unexpected error of %q, expected an error: %v, got: %v", tc.command, tc.err, err)
+		}
+		if err == nil && load != tc.expected {
+			t.Errorf("Unexpected load of %q, expected: %v, got: %v", tc.command, tc.expected, load)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/client/v3"
+)
+
+// keyspaceValueSizeBuckets are the upper bounds of the value size buckets of
+// the key-space histogram; the last bucket is unbounded.
+var keyspaceValueSizeBuckets = []int{1024, 16 * 1024, 128 * 1024}
+
+// keyspacePrefixStats is the key-space histogram of a key prefix.
+type keyspacePrefixStats struct {
+	keys       int
+	valueBytes int64
+	// buckets counts the values in each of keyspaceValueSizeBuckets.
+	buckets []int
+}
+
+// printKeyspaceHistogram prints the key counts and value sizes by key prefix,
+// i.e. the first segment of the key, of the first --analyze-keyspace-sample
+// keys. The key space is replicated, so it is read once from the cluster
+// rather than from each member.
+func printKeyspaceHistogram(cmd *cobra.Command, c *clientv3.Client, stage string) {
+	stats := make(map[string]*keyspacePrefixStats)
+	var sampled int64
+	key := "\x00"
+	for sampled < defragOpts.analyzeKeyspaceSample {
+		limit := defragOpts.analyzeKeyspaceSample - sampled
+		if limit > 1000 {
+			limit = 1000
+		}
+		ctx, cancel := commandCtx(cmd)
+		resp, err := c.Get(ctx, key, clientv3.WithFromKey(), clientv3.WithLimit(limit), clientv3.WithSerializable())
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to analyze the key space %s. (%v)\n", stage, err)
+			return
+		}
+		for _, kv := range resp.Kvs {
+			prefix := keyPrefix(string(kv.Key))
+			st, ok := stats[prefix]
+			if !ok {
+				st = &keyspacePrefixStats{buckets: make([]int, len(keyspaceValueSizeBuckets)+1)}
+				stats[prefix] = st
+			}
+			st.keys++
+			st.valueBytes += int64(len(kv.Value))
+			st.buckets[sort.SearchInts(keyspaceValueSizeBuckets, len(kv.Value)+1)]++
+		}
+		sampled += int64(len(resp.Kvs))
+		if !resp.More || len(resp.Kvs) == 0 {
+			break
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+
+	prefixes := make([]string, 0, len(stats))
+	for prefix := range stats {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	fmt.Fprintf(defragInfoOutput(), "Key space %s (%d keys sampled), by prefix: keys, value bytes, values <1KiB/<16KiB/<128KiB/larger\n", stage, sampled)
+	for _, prefix := range prefixes {
+		st := stats[prefix]
+		fmt.Fprintf(defragInfoOutput(), "  %s: %d, %s, %d/%d/%d/%d\n", prefix, st.keys, humanize.Bytes(uint64(st.valueBytes)),
+			st.buckets[0], st.buckets[1], st.buckets[2], st.buckets[3])
+	}
+}
+
+// keyPrefix returns the first segment of the given key, e.g. "/registry"
+// for "/registry/pods/default/foo".
+func keyPrefix(key string) string {
+	start := 0
+	if strings.HasPrefix(key, "/") {
+		start = 1
+	}
+	if i := strings.IndexByte(key[start:], '/'); i >= 0 {
+		return key[:start+i]
+	}
+	return key
+}
@@ -0,0 +1,265 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/client/v3"
+	v3defrag "go.etcd.io/etcd/client/v3/defrag"
+	"go.etcd.io/etcd/pkg/v3/cobrautl"
+	"go.uber.org/zap"
+)
+
+// maxDefragMonitorBackoff is the maximum time the monitor mode waits between
+// two polls after consecutive failures.
+const maxDefragMonitorBackoff = time.Hour
+
+// monitorDefrag polls the fragmentation of the members every
+// --monitor-interval, and defragments the members whose fragmentation
+// exceeds --monitor-threshold. Members which can't be reached, or which
+// report errors, are left alone. The poll interval is doubled, up to
+// maxDefragMonitorBackoff, after each poll with failures. It returns once
+// interrupted.
+func monitorDefrag(c *clientv3.Client, eps []string, timeOut time.Duration, lg *zap.Logger) {
+	if defragOpts.monitorInterval <= 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--monitor-interval must be greater than 0"))
+	}
+	if defragOpts.monitorThreshold <= 0 || defragOpts.monitorThreshold >= 1 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--monitor-threshold must be between 0 and 1"))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	lg.Info(
+		"started monitoring fragmentation",
+		zap.Strings("endpoints", eps),
+		zap.Duration("interval", defragOpts.monitorInterval),
+		zap.Float64("threshold", defragOpts.monitorThreshold),
+	)
+	wait := defragOpts.monitorInterval
+	for {
+		ok := pollDefrag(ctx, c, eps, timeOut, lg)
+		wait = nextMonitorWait(wait, ok)
+		if !ok {
+			lg.Warn("backing off after failures", zap.Duration("next-poll-in", wait))
+		}
+
+		select {
+		case <-ctx.Done():
+			lg.Info("stopped monitoring fragmentation")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// loopDefrag runs a cycle of --interval, i.e. the compaction with --compact
+// and the defragmentation, every interval until SIGINT or SIGTERM is
+// received. A failed cycle is logged, and only stops the loop with
+// --stop-on-failure.
+func loopDefrag(cmd *cobra.Command, c *clientv3.Client, eps []string, dcfg v3defrag.Config, lg *zap.Logger) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	lg.Info(
+		"started defragmentation loop",
+		zap.Strings("endpoints", eps),
+		zap.Duration("interval", defragOpts.interval),
+	)
+	var total int64
+	cycles := 0
+	for ctx.Err() == nil {
+		cycles++
+		reclaimed, err := defragCycle(ctx, cmd, c, eps, dcfg, lg, cycles)
+		total += reclaimed
+		// An interrupted cycle is not a failure.
+		if err != nil && ctx.Err() == nil {
+			lg.Warn("defragmentation cycle failed", zap.Int("cycle", cycles), zap.Error(err))
+			if defragOpts.stopOnFailure {
+				lg.Error("stopped defragmentation loop after a failed cycle", zap.Int("cycle", cycles), zap.Int64("total-reclaimed-bytes", total))
+				os.Exit(cobrautl.ExitError)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(defragOpts.interval):
+		}
+	}
+	lg.Info(
+		"stopped defragmentation loop",
+		zap.Int("cycles", cycles),
+		zap.Int64("total-reclaimed-bytes", total),
+		zap.String("total-reclaimed", humanize.Bytes(uint64(total))),
+	)
+}
+
+// defragCycle runs a single cycle of --interval, and returns the space
+// reclaimed by the members, and an error if the compaction or any member
+// failed.
+func defragCycle(ctx context.Context, cmd *cobra.Command, c *clientv3.Client, eps []string, dcfg v3defrag.Config, lg *zap.Logger, cycle int) (int64, error) {
+	lg.Info("started defragmentation cycle", zap.Int("cycle", cycle))
+	start := time.Now()
+	if defragOpts.compact {
+		if err := compactKeyspace(cmd, c); err != nil {
+			return 0, err
+		}
+	}
+	if defragOpts.minTotalReclaim > 0 {
+		if reclaim := estimateReclaim(cmd, c, eps); reclaim < defragOpts.minTotalReclaim {
+			lg.Info(
+				"skipped defragmentation cycle, the estimated reclaimable space is below --min-total-reclaim",
+				zap.Int("cycle", cycle),
+				zap.Uint64("estimated-reclaimable-bytes", reclaim),
+			)
+			return 0, nil
+		}
+	}
+	// The leader may have changed since the previous cycle.
+	if defragOpts.leaderLast {
+		dcfg.Endpoints = leaderLast(cmd, c, eps)
+	}
+
+	var results []v3defrag.Result
+	var err error
+	if defragOpts.rolling {
+		results, err = rollingDefrag(ctx, cmd, c, dcfg.Endpoints, dcfg)
+	} else {
+		results, err = v3defrag.Defragment(ctx, c, dcfg)
+	}
+	if !streamDefragResults() {
+		displayDefragResults(results)
+	}
+	if defragOpts.recordToEtcd {
+		if rerr := recordDefrag(cmd, c, results, err); rerr != nil {
+			fmt.Fprintf(os.Stderr, "Failed to record the defragmentation to etcd. (%v)\n", rerr)
+		}
+	}
+
+	var reclaimed int64
+	failures, skipped := 0, 0
+	for _, res := range results {
+		switch {
+		case res.Err != nil:
+			failures++
+		case res.Skipped:
+			skipped++
+		default:
+			if n, ok := res.Reclaimed(); ok {
+				reclaimed += n
+			}
+		}
+	}
+	lg.Info(
+		"finished defragmentation cycle",
+		zap.Int("cycle", cycle),
+		zap.Duration("took", time.Since(start)),
+		zap.Int("processed", len(results)),
+		zap.Int("failed", failures),
+		zap.Int("skipped", skipped),
+		zap.Int64("reclaimed-bytes", reclaimed),
+		zap.String("reclaimed", humanize.Bytes(uint64(reclaimed))),
+	)
+	if err != nil {
+		return reclaimed, err
+	}
+	if failures > 0 {
+		return reclaimed, fmt.Errorf("failed to defragment %d etcd member(s)", failures)
+	}
+	return reclaimed, nil
+}
+
+// nextMonitorWait returns the wait before the next poll of the monitor mode,
+// given the wait before the last poll and whether it succeeded. It's
+// --monitor-interval after a successful poll, and doubles after each failed
+// one, up to maxDefragMonitorBackoff.
+func nextMonitorWait(wait time.Duration, ok bool) time.Duration {
+	if ok {
+		return defragOpts.monitorInterval
+	}
+	wait *= 2
+	if wait > maxDefragMonitorBackoff {
+		wait = maxDefragMonitorBackoff
+	}
+	if wait < defragOpts.monitorInterval {
+		wait = defragOpts.monitorInterval
+	}
+	return wait
+}
+
+// pollDefrag runs a single poll of the monitor mode, and returns false if
+// any member failed.
+func pollDefrag(ctx context.Context, c *clientv3.Client, eps []string, timeOut time.Duration, lg *zap.Logger) bool {
+	ok := true
+	var targets []string
+	for _, ep := range eps {
+		rctx, rcancel := context.WithTimeout(ctx, timeOut)
+		resp, err := c.Status(rctx, ep)
+		rcancel()
+		if err != nil {
+			lg.Warn("failed to get member status", zap.String("endpoint", ep), zap.Error(err))
+			ok = false
+			continue
+		}
+		if len(resp.Errors) > 0 {
+			lg.Warn("skipping unhealthy member", zap.String("endpoint", ep), zap.Strings("errors", resp.Errors))
+			ok = false
+			continue
+		}
+		ratio := v3defrag.Fragmentation(resp)
+		if ratio < defragOpts.monitorThreshold {
+			continue
+		}
+		lg.Info(
+			"member fragmentation exceeds threshold",
+			zap.String("endpoint", ep),
+			zap.Float64("fragmentation", ratio),
+			zap.Int64("db-size", resp.DbSize),
+			zap.Int64("db-size-in-use", resp.DbSizeInUse),
+		)
+		targets = append(targets, ep)
+	}
+	if len(targets) == 0 {
+		return ok
+	}
+
+	// The targets are defragmented with the same settings as a single run,
+	// e.g. --defrag-retries and --health-check.
+	dcfg := newDefragConfig(c, eps, timeOut, lg, nil)
+	dcfg.Endpoints = targets
+	results, err := v3defrag.Defragment(ctx, c, dcfg)
+	for _, res := range results {
+		if res.Err != nil {
+			lg.Warn("failed to defragment member", zap.String("endpoint", res.Endpoint), zap.Duration("took", res.Took), zap.Error(res.Err))
+			ok = false
+		} else {
+			lg.Info("defragmented member", zap.String("endpoint", res.Endpoint), zap.Duration("took", res.Took))
+		}
+	}
+	if err != nil {
+		lg.Warn("aborted defragmentation", zap.Error(err))
+		ok = false
+	}
+	return ok
+}
@@ -0,0 +1,44 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextMonitorWait(t *testing.T) {
+	defer func(v time.Duration) { defragOpts.monitorInterval = v }(defragOpts.monitorInterval)
+	defragOpts.monitorInterval = time.Minute
+
+	tt := []struct {
+		wait time.Duration
+		ok   bool
+
+		expected time.Duration
+	}{
+		{wait: time.Minute, ok: true, expected: time.Minute},
+		{wait: 8 * time.Minute, ok: true, expected: time.Minute},
+		{wait: time.Minute, ok: false, expected: 2 * time.Minute},
+		{wait: 2 * time.Minute, ok: false, expected: 4 * time.Minute},
+		{wait: 40 * time.Minute, ok: false, expected: maxDefragMonitorBackoff},
+		{wait: maxDefragMonitorBackoff, ok: false, expected: maxDefragMonitorBackoff},
+	}
+	for _, tc := range tt {
+		if wait := nextMonitorWait(tc.wait, tc.ok); wait != tc.expected {
+			t.Errorf("Unexpected wait after %v (ok: %v), expected: %v, got: %v", tc.wait, tc.ok, tc.expected, wait)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/pkg/v3/cobrautl"
+)
+
+// defaultDefragPlanRate is the assumed defragmentation throughput in bytes
+// per second, as observed on typical SSD-backed hosts.
+const defaultDefragPlanRate = 50 * 1024 * 1024
+
+// estimateReclaim prints the estimated reclaimable space of each member,
+// i.e. the part of its DB size not in use, and returns the total. Members
+// whose status is unavailable are not counted.
+func estimateReclaim(cmd *cobra.Command, c *clientv3.Client, eps []string) uint64 {
+	var total uint64
+	for _, ep := range eps {
+		ctx, cancel := commandCtx(cmd)
+		resp, err := c.Status(ctx, ep)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get status of etcd member[%s], estimate unavailable. (%v)\n", ep, err)
+			continue
+		}
+		reclaim := reclaimableSpace(resp)
+		total += reclaim
+		fmt.Fprintf(defragInfoOutput(), "etcd member[%s]: estimated reclaimable space %s\n", ep, humanize.Bytes(reclaim))
+	}
+	fmt.Fprintf(defragInfoOutput(), "Estimated total reclaimable space %s\n", humanize.Bytes(total))
+	return total
+}
+
+// reclaimableSpace returns the part of the DB size of a member not in use,
+// which a defragmentation is expected to reclaim.
+func reclaimableSpace(st *clientv3.StatusResponse) uint64 {
+	if st.DbSize <= st.DbSizeInUse {
+		return 0
+	}
+	return uint64(st.DbSize - st.DbSizeInUse)
+}
+
+// planDefrag prints the estimated defragmentation time of each member, based
+// on its DB size and the assumed defragmentation throughput.
+func planDefrag(cmd *cobra.Command, c *clientv3.Client, eps []string) {
+	if defragOpts.planRate == 0 {
+		cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("--plan-rate must be greater than 0"))
+	}
+
+	fmt.Fprintf(defragInfoOutput(), "Estimates are approximate, assuming a defragmentation throughput of %s/s.\n", humanize.Bytes(defragOpts.planRate))
+	var total time.Duration
+	for _, ep := range eps {
+		ctx, cancel := commandCtx(cmd)
+		resp, err := c.Status(ctx, ep)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get status of etcd member[%s], estimate unavailable. (%v)\n", ep, err)
+			continue
+		}
+		d := estimateDefragTime(resp.DbSize, defragOpts.planRate)
+		total += d
+		fmt.Fprintf(defragInfoOutput(), "etcd member[%s]: db size %s, estimated defragmentation time ~%s\n", ep, humanize.Bytes(uint64(resp.DbSize)), d)
+	}
+	fmt.Fprintf(defragInfoOutput(), "Estimated total defragmentation time ~%s\n", total)
+}
+
+// estimateDefragTime returns the estimated time to defragment a DB of the
+// given size at the given throughput in bytes per second.
+func estimateDefragTime(dbSize int64, rate uint64) time.Duration {
+	return time.Duration(float64(dbSize) / float64(rate) * float64(time.Second)).Round(time.Millisecond)
+}
@@ -0,0 +1,62 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+)
+
+func TestEstimateDefragTime(t *testing.T) {
+	tt := []struct {
+		dbSize int64
+		rate   uint64
+
+		expected time.Duration
+	}{
+		{dbSize: 0, rate: defaultDefragPlanRate, expected: 0},
+		{dbSize: 100 * 1024 * 1024, rate: 100 * 1024 * 1024, expected: time.Second},
+		{dbSize: 8 * 1024 * 1024 * 1024, rate: 100 * 1024 * 1024, expected: 81920 * time.Millisecond},
+		// Rounded to the millisecond.
+		{dbSize: 1, rate: 3000, expected: 0},
+		{dbSize: 2, rate: 3, expected: 667 * time.Millisecond},
+	}
+	for _, tc := range tt {
+		if d := estimateDefragTime(tc.dbSize, tc.rate); d != tc.expected {
+			t.Errorf("Unexpected estimate of %d bytes at %d bytes/s, expected: %s, got: %s", tc.dbSize, tc.rate, tc.expected, d)
+		}
+	}
+}
+
+func TestReclaimableSpace(t *testing.T) {
+	tt := []struct {
+		dbSize, dbSizeInUse int64
+
+		expected uint64
+	}{
+		{dbSize: 100, dbSizeInUse: 40, expected: 60},
+		{dbSize: 100, dbSizeInUse: 100, expected: 0},
+		// The sizes are not read atomically.
+		{dbSize: 100, dbSizeInUse: 120, expected: 0},
+	}
+	for _, tc := range tt {
+		st := &clientv3.StatusResponse{DbSize: tc.dbSize, DbSizeInUse: tc.dbSizeInUse}
+		if reclaim := reclaimableSpace(st); reclaim != tc.expected {
+			t.Errorf("Unexpected reclaimable space of %d/%d, expected: %d, got: %d", tc.dbSizeInUse, tc.dbSize, tc.expected, reclaim)
+		}
+	}
+}
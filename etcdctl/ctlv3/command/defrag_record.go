@@ -0,0 +1,108 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/client/v3"
+	v3defrag "go.etcd.io/etcd/client/v3/defrag"
+)
+
+// defragRecord is the summary of a defragmentation recorded by
+// --record-to-etcd. It deliberately only contains the operator's user and
+// host names, and no flags, which could contain credentials.
+type defragRecord struct {
+	Time      time.Time            `json:"time"`
+	Operator  string               `json:"operator,omitempty"`
+	Host      string               `json:"host,omitempty"`
+	Aborted   string               `json:"aborted,omitempty"`
+	Truncated bool                 `json:"truncated,omitempty"`
+	Results   []defragRecordResult `json:"results"`
+}
+
+type defragRecordResult struct {
+	Endpoint string `json:"endpoint"`
+	Skipped  bool   `json:"skipped,omitempty"`
+	TookMs   int64  `json:"took_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// recordDefrag writes the summary of the defragmentation to a new key
+// under --record-prefix, and prunes the old records beyond --record-keep.
+func recordDefrag(cmd *cobra.Command, c *clientv3.Client, results []v3defrag.Result, runErr error) error {
+	rec := defragRecord{Time: time.Now().UTC()}
+	if u, err := user.Current(); err == nil {
+		rec.Operator = u.Username
+	}
+	rec.Host, _ = os.Hostname()
+	if runErr != nil {
+		rec.Aborted = runErr.Error()
+	}
+	for _, res := range results {
+		r := defragRecordResult{Endpoint: res.Endpoint, Skipped: res.Skipped, TookMs: res.Took.Milliseconds()}
+		if res.Err != nil {
+			r.Error = res.Err.Error()
+		}
+		rec.Results = append(rec.Results, r)
+	}
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	for len(data) > defragOpts.recordMaxBytes && len(rec.Results) > 0 {
+		rec.Results = rec.Results[:len(rec.Results)-1]
+		rec.Truncated = true
+		if data, err = json.Marshal(rec); err != nil {
+			return err
+		}
+	}
+	if len(data) > defragOpts.recordMaxBytes {
+		return fmt.Errorf("record of %d bytes exceeds --record-max-bytes", len(data))
+	}
+
+	// The keys sort by time, so that the oldest records can be pruned.
+	key := defragOpts.recordPrefix + rec.Time.Format("20060102T150405.000000000Z")
+	ctx, cancel := commandCtx(cmd)
+	_, err = c.Put(ctx, key, string(data))
+	cancel()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(defragInfoOutput(), "Recorded the defragmentation at key %q\n", key)
+
+	if defragOpts.recordKeepCount <= 0 {
+		return nil
+	}
+	ctx, cancel = commandCtx(cmd)
+	defer cancel()
+	resp, err := c.Get(ctx, defragOpts.recordPrefix, clientv3.WithPrefix(), clientv3.WithKeysOnly(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return err
+	}
+	for i := int64(0); i < int64(len(resp.Kvs))-defragOpts.recordKeepCount; i++ {
+		if _, err := c.Delete(ctx, string(resp.Kvs[i].Key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
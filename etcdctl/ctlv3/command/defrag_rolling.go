@@ -0,0 +1,236 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/v3"
+	v3defrag "go.etcd.io/etcd/client/v3/defrag"
+)
+
+// rollingDefrag defragments the members one at a time, the leader last.
+// Before each member, it checks that the other voting members of the
+// cluster, selected or not, are healthy enough to keep the quorum while the
+// member is defragmented, and after each member, it waits for the member to
+// catch up. Any failure aborts the run with an error wrapping
+// errRollingAborted.
+func rollingDefrag(ctx context.Context, cmd *cobra.Command, c *clientv3.Client, eps []string, dcfg v3defrag.Config) ([]v3defrag.Result, error) {
+	lctx, cancel := commandCtx(cmd)
+	mresp, err := c.MemberList(lctx)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to list members (%v)", errRollingAborted, err)
+	}
+	voters := 0
+	epMembers := make(map[string]uint64)
+	for _, m := range mresp.Members {
+		if !m.IsLearner {
+			voters++
+		}
+		for _, u := range m.ClientURLs {
+			epMembers[u] = m.ID
+		}
+	}
+	quorum := voters/2 + 1
+	for _, ep := range eps {
+		if _, ok := epMembers[ep]; !ok {
+			return nil, fmt.Errorf("%w: etcd member[%s] is not a client URL of a cluster member", errRollingAborted, ep)
+		}
+	}
+
+	statuses := rollingStatuses(cmd, c, mresp.Members)
+	var ordered, leaderEps []string
+	for _, ep := range eps {
+		if st := statuses[epMembers[ep]]; isLeader(st) {
+			leaderEps = append(leaderEps, ep)
+			continue
+		}
+		ordered = append(ordered, ep)
+	}
+	ordered = append(ordered, leaderEps...)
+
+	var results []v3defrag.Result
+	staggerDue := false
+	for _, ep := range ordered {
+		if staggerDue && defragOpts.stagger > 0 {
+			time.Sleep(defragOpts.stagger)
+		}
+		// The statuses are refreshed before each member, as the previous
+		// members may have changed the state of the cluster.
+		statuses = rollingStatuses(cmd, c, mresp.Members)
+		id := epMembers[ep]
+		st, ok := statuses[id]
+		if !ok {
+			return results, fmt.Errorf("%w: etcd member[%s] is unavailable", errRollingAborted, ep)
+		}
+		var target uint64
+		for _, ost := range statuses {
+			if ost.RaftIndex > target {
+				target = ost.RaftIndex
+			}
+		}
+		healthy, transferee := rollingHealth(mresp.Members, statuses, id)
+		if !st.IsLearner && healthy < quorum {
+			return results, fmt.Errorf("%w: defragmenting etcd member[%s] would leave %d voting member(s) available, below the quorum of %d",
+				errRollingAborted, ep, healthy, quorum)
+		}
+
+		if isLeader(st) && defragOpts.rollingStepDown && transferee != 0 {
+			if err := moveLeaderFrom(cmd, ep, transferee); err != nil {
+				return results, fmt.Errorf("%w: failed to move the leadership away from etcd member[%s] (%v)", errRollingAborted, ep, err)
+			}
+			fmt.Fprintf(defragInfoOutput(), "Moved the leadership from etcd member[%s] to member %x\n", ep, transferee)
+		}
+
+		dcfg.Endpoints = []string{ep}
+		res, err := v3defrag.Defragment(ctx, c, dcfg)
+		results = append(results, res...)
+		if err != nil {
+			return results, err
+		}
+		if len(res) == 0 || res[0].Skipped {
+			continue
+		}
+		if res[0].Err != nil {
+			return results, fmt.Errorf("%w: failed to defragment etcd member[%s]", errRollingAborted, ep)
+		}
+		staggerDue = true
+		if err := waitCatchUp(cmd, c, ep, target); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// rollingHealth returns the number of healthy voting members of the whole
+// cluster other than the given one, i.e. whose status is available without
+// errors, and the one taking over the leadership from it, which is the most
+// up to date, with the lowest ID on a tie so that the choice is
+// deterministic, or 0 if there is none.
+func rollingHealth(members []*etcdserverpb.Member, statuses map[uint64]*clientv3.StatusResponse, id uint64) (healthy int, transferee uint64) {
+	var applied uint64
+	for _, m := range members {
+		st, ok := statuses[m.ID]
+		if m.ID == id || m.IsLearner || !ok || len(st.Errors) > 0 {
+			continue
+		}
+		healthy++
+		if transferee == 0 || st.RaftAppliedIndex > applied || (st.RaftAppliedIndex == applied && m.ID < transferee) {
+			transferee, applied = m.ID, st.RaftAppliedIndex
+		}
+	}
+	return healthy, transferee
+}
+
+// isLeader returns true if the member of the given status, which may be
+// nil, is the leader.
+func isLeader(st *clientv3.StatusResponse) bool {
+	return st != nil && st.Header != nil && st.Leader == st.Header.MemberId
+}
+
+// leaderLast returns the given endpoints with the endpoint of the leader
+// moved to the end. The endpoints are returned unchanged if the leader is
+// not among them, with a warning if it can't be determined.
+func leaderLast(cmd *cobra.Command, c *clientv3.Client, eps []string) []string {
+	leaderEp := ""
+	unknown := false
+	for _, ep := range eps {
+		ctx, cancel := commandCtx(cmd)
+		st, err := c.Status(ctx, ep)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get status of etcd member[%s]. (%v)\n", ep, err)
+			unknown = true
+			continue
+		}
+		if isLeader(st) {
+			leaderEp = ep
+			break
+		}
+	}
+	if leaderEp == "" {
+		if unknown {
+			fmt.Fprintf(os.Stderr, "Failed to determine the leader, defragmenting the members in the given order\n")
+		}
+		return eps
+	}
+
+	ordered := make([]string, 0, len(eps))
+	for _, ep := range eps {
+		if ep != leaderEp {
+			ordered = append(ordered, ep)
+		}
+	}
+	return append(ordered, leaderEp)
+}
+
+// rollingStatuses gets the status of each started member from its first
+// client URL, by member ID. The members whose status is unavailable are
+// left out, and count as unhealthy.
+func rollingStatuses(cmd *cobra.Command, c *clientv3.Client, members []*etcdserverpb.Member) map[uint64]*clientv3.StatusResponse {
+	statuses := make(map[uint64]*clientv3.StatusResponse, len(members))
+	for _, m := range members {
+		if len(m.ClientURLs) == 0 {
+			continue
+		}
+		ctx, cancel := commandCtx(cmd)
+		st, err := c.Status(ctx, m.ClientURLs[0])
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to get status of etcd member[%s]. (%v)\n", m.ClientURLs[0], err)
+			continue
+		}
+		statuses[m.ID] = st
+	}
+	return statuses
+}
+
+// waitCatchUp waits until the member serving the given endpoint has applied
+// the given raft index, for at most --rolling-catch-up-timeout.
+func waitCatchUp(cmd *cobra.Command, c *clientv3.Client, ep string, index uint64) error {
+	deadline := time.Now().Add(defragOpts.rollingCatchUpTimeout)
+	for {
+		ctx, cancel := commandCtx(cmd)
+		st, err := c.Status(ctx, ep)
+		cancel()
+		if err == nil && st.RaftAppliedIndex >= index {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: etcd member[%s] didn't catch up with raft index %d within %s", errRollingAborted, ep, index, defragOpts.rollingCatchUpTimeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// moveLeaderFrom moves the leadership from the leader serving the given
+// endpoint to the given member.
+func moveLeaderFrom(cmd *cobra.Command, leaderEp string, transferee uint64) error {
+	cfg := clientConfigFromCmd(cmd)
+	cfg.endpoints = []string{leaderEp}
+	cli := cfg.mustClient()
+	defer cli.Close()
+
+	ctx, cancel := commandCtx(cmd)
+	defer cancel()
+	_, err := cli.MoveLeader(ctx, transferee)
+	return err
+}
@@ -0,0 +1,69 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package command
+
+import (
+	"testing"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/v3"
+)
+
+func TestRollingHealth(t *testing.T) {
+	members := []*pb.Member{{ID: 1}, {ID: 2}, {ID: 3}, {ID: 4}, {ID: 5, IsLearner: true}}
+	status := func(applied uint64, errs ...string) *clientv3.StatusResponse {
+		return &clientv3.StatusResponse{RaftAppliedIndex: applied, Errors: errs}
+	}
+
+	tt := []struct {
+		name     string
+		statuses map[uint64]*clientv3.StatusResponse
+
+		healthy    int
+		transferee uint64
+	}{
+		{
+			name:       "most up to date follower",
+			statuses:   map[uint64]*clientv3.StatusResponse{1: status(10), 2: status(9), 3: status(11), 4: status(10), 5: status(20)},
+			healthy:    3,
+			transferee: 3,
+		},
+		{
+			name:       "lowest ID on a tie",
+			statuses:   map[uint64]*clientv3.StatusResponse{1: status(10), 2: status(11), 3: status(11), 4: status(11)},
+			healthy:    3,
+			transferee: 2,
+		},
+		{
+			// The members outside of the selected endpoints still count.
+			name:       "unavailable and unhealthy members",
+			statuses:   map[uint64]*clientv3.StatusResponse{1: status(10), 2: status(12, "NOSPACE"), 4: status(11)},
+			healthy:    1,
+			transferee: 4,
+		},
+		{
+			name:     "no healthy voter",
+			statuses: map[uint64]*clientv3.StatusResponse{1: status(10), 5: status(10)},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			healthy, transferee := rollingHealth(members, tc.statuses, 1)
+			if healthy != tc.healthy || transferee != tc.transferee {
+				t.Errorf("Unexpected health, expected: (%d, %d), got: (%d, %d)", tc.healthy, tc.transferee, healthy, transferee)
+			}
+		})
+	}
+}
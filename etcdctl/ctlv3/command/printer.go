@@ -48,6 +48,7 @@ type printer interface {
 	EndpointHealth([]epHealth)
 	EndpointStatus([]epStatus)
 	EndpointHashKV([]epHashKV)
+	Defrag([]epDefrag)
 	MoveLeader(leader, target uint64, r v3.MoveLeaderResponse)
 
 	Alarm(v3.AlarmResponse)
@@ -161,6 +162,7 @@ func newPrinterUnsupported(n string) printer {
 func (p *printerUnsupported) EndpointHealth([]epHealth) { p.p(nil) }
 func (p *printerUnsupported) EndpointStatus([]epStatus) { p.p(nil) }
 func (p *printerUnsupported) EndpointHashKV([]epHashKV) { p.p(nil) }
+func (p *printerUnsupported) Defrag([]epDefrag)         { p.p(nil) }
 
 func (p *printerUnsupported) MoveLeader(leader, target uint64, r v3.MoveLeaderResponse) { p.p(nil) }
 
@@ -221,6 +223,32 @@ func makeEndpointStatusTable(statusList []epStatus) (hdr []string, rows [][]stri
 	return hdr, rows
 }
 
+func makeDefragTable(results []epDefrag) (hdr []string, rows [][]string) {
+	hdr = []string{"endpoint", "success", "skipped", "dry run", "took", "db size", "in use", "reclaimed", "error"}
+	for _, r := range results {
+		dbSize, inUse := "unavailable", "unavailable"
+		if r.DbSize != nil {
+			dbSize, inUse = humanize.Bytes(uint64(*r.DbSize)), humanize.Bytes(uint64(*r.DbSizeInUse))
+		}
+		reclaimed := "unavailable"
+		if r.Reclaimed != nil {
+			reclaimed = humanize.Bytes(uint64(*r.Reclaimed))
+		}
+		rows = append(rows, []string{
+			r.Ep,
+			fmt.Sprint(r.Success),
+			fmt.Sprint(r.Skipped),
+			fmt.Sprint(r.DryRun),
+			r.Took,
+			dbSize,
+			inUse,
+			reclaimed,
+			r.Error,
+		})
+	}
+	return hdr, rows
+}
+
 func makeEndpointHashKVTable(hashList []epHashKV) (hdr []string, rows [][]string) {
 	hdr = []string{"endpoint", "hash"}
 	for _, h := range hashList {
@@ -151,6 +151,25 @@ func (p *fieldsPrinter) EndpointHealth(hs []epHealth) {
 	}
 }
 
+func (p *fieldsPrinter) Defrag(results []epDefrag) {
+	for _, r := range results {
+		fmt.Printf("\"Endpoint\" : %q\n", r.Ep)
+		fmt.Println(`"Success" :`, r.Success)
+		fmt.Println(`"Skipped" :`, r.Skipped)
+		fmt.Println(`"DryRun" :`, r.DryRun)
+		fmt.Println(`"Took" :`, r.Took)
+		if r.DbSize != nil {
+			fmt.Println(`"DBSize" :`, *r.DbSize)
+			fmt.Println(`"DBSizeInUse" :`, *r.DbSizeInUse)
+		}
+		if r.Reclaimed != nil {
+			fmt.Println(`"Reclaimed" :`, *r.Reclaimed)
+		}
+		fmt.Println(`"Error" :`, r.Error)
+		fmt.Println()
+	}
+}
+
 func (p *fieldsPrinter) EndpointStatus(eps []epStatus) {
 	for _, ep := range eps {
 		p.hdr(ep.Resp.Header)
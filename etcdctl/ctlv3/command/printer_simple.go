@@ -165,6 +165,12 @@ func (s *simplePrinter) EndpointStatus(statusList []epStatus) {
 	}
 }
 
+func (s *simplePrinter) Defrag(results []epDefrag) {
+	for _, r := range results {
+		printDefragResult(r.res)
+	}
+}
+
 func (s *simplePrinter) EndpointHashKV(hashList []epHashKV) {
 	_, rows := makeEndpointHashKVTable(hashList)
 	for _, row := range rows {
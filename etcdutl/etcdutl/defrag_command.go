@@ -16,17 +16,31 @@ package etcdutl
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"runtime"
 	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
+	bolt "go.etcd.io/bbolt"
 	"go.etcd.io/etcd/pkg/v3/cobrautl"
 	"go.etcd.io/etcd/server/v3/storage/backend"
 	"go.etcd.io/etcd/server/v3/storage/datadir"
 )
 
+const (
+	ioPriorityIdle       = "idle"
+	ioPriorityBestEffort = "best-effort"
+)
+
 var (
-	defragDataDir string
+	defragDataDir    string
+	defragIOPriority string
+	defragVerbose    bool
+	defragCheck      bool
+	defragForce      bool
 )
 
 // NewDefragCommand returns the cobra command for "Defrag".
@@ -39,15 +53,129 @@ func NewDefragCommand() *cobra.Command {
 	cmd.Flags().StringVar(&defragDataDir, "data-dir", "", "Required. Defragments a data directory not in use by etcd.")
 	cmd.MarkFlagRequired("data-dir")
 	cmd.MarkFlagDirname("data-dir")
+	cmd.Flags().StringVar(&defragIOPriority, "io-priority", "", fmt.Sprintf("Optional. Lower the I/O scheduling priority of the defragmentation (Linux only). Valid values include %q and %q.", ioPriorityIdle, ioPriorityBestEffort))
+	cmd.Flags().BoolVar(&defragVerbose, "verbose", false, "Optional. Report the sizes of the db file, and of the wal and snap directories.")
+	cmd.Flags().BoolVar(&defragCheck, "check-integrity", false, "Optional, but strongly recommended. Check the integrity of the db file before defragmenting it, and refuse to defragment a corrupted db file.")
+	cmd.Flags().BoolVar(&defragForce, "force", false, "Optional. Defragment the db file even if it fails the --check-integrity check.")
 	return cmd
 }
 
 func defragCommandFunc(cmd *cobra.Command, args []string) {
+	if defragIOPriority != "" {
+		if defragIOPriority != ioPriorityIdle && defragIOPriority != ioPriorityBestEffort {
+			cobrautl.ExitWithError(cobrautl.ExitBadArgs, fmt.Errorf("unknown --io-priority %q", defragIOPriority))
+		}
+		// The I/O priority applies to the calling thread only, and the
+		// defragmentation runs on the current goroutine.
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if err := setIOPriority(defragIOPriority); err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring --io-priority: %v\n", err)
+		}
+	}
+
+	if defragCheck {
+		if err := checkDefragIntegrity(defragDataDir, defragForce); err != nil {
+			cobrautl.ExitWithError(cobrautl.ExitError, err)
+		}
+	}
+
+	if defragVerbose {
+		printDataDirSizes(os.Stdout, defragDataDir, "before defragmentation")
+	}
 	err := DefragData(defragDataDir)
 	if err != nil {
 		cobrautl.ExitWithError(cobrautl.ExitError,
 			fmt.Errorf("Failed to defragment etcd data[%s] (%v)", defragDataDir, err))
 	}
+	if defragVerbose {
+		printDataDirSizes(os.Stdout, defragDataDir, "after defragmentation")
+	}
+}
+
+// printDataDirSizes prints the size of the db file, and the sizes of the wal
+// and snap directories which are not affected by defragmentation.
+func printDataDirSizes(w io.Writer, dataDir string, stage string) {
+	dbPath := datadir.ToBackendFileName(dataDir)
+	fmt.Fprintf(w, "Disk usage of etcd data[%s] %s:\n", dataDir, stage)
+	if fi, err := os.Stat(dbPath); err == nil {
+		fmt.Fprintf(w, "  db: %s\n", humanize.Bytes(uint64(fi.Size())))
+	} else {
+		fmt.Fprintf(w, "  db: unavailable (%v)\n", err)
+	}
+	for _, dir := range []struct {
+		name string
+		path string
+	}{
+		{"wal", datadir.ToWalDir(dataDir)},
+		// The db file is excluded as it's reported separately.
+		{"snap (excluding db)", datadir.ToSnapDir(dataDir)},
+	} {
+		size, err := dirSize(dir.path, dbPath)
+		if err != nil {
+			fmt.Fprintf(w, "  %s: unavailable (%v)\n", dir.name, err)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: %s\n", dir.name, humanize.Bytes(uint64(size)))
+	}
+}
+
+// dirSize returns the total size of the regular files under the given
+// directory, excluding the given file.
+func dirSize(dir string, exclude string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && path != exclude {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// checkDefragIntegrity checks the integrity of the db file of the given data
+// directory, and returns an error if it is corrupted, unless force is set.
+func checkDefragIntegrity(dataDir string, force bool) error {
+	dbPath := datadir.ToBackendFileName(dataDir)
+	errs := checkDBIntegrity(dbPath)
+	if len(errs) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Integrity check of %q failed, %d error(s) found:\n", dbPath, len(errs))
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "  %v\n", err)
+	}
+	if !force {
+		return fmt.Errorf("refusing to defragment a corrupted db file, " +
+			"which may make the recovery harder. Consider restoring the member from a snapshot instead, or use --force")
+	}
+	fmt.Fprintf(os.Stderr, "Defragmenting anyway as --force is given.\n")
+	return nil
+}
+
+// checkDBIntegrity runs the bolt consistency check on the given db file,
+// and returns the errors found.
+func checkDBIntegrity(dbPath string) []error {
+	db, err := bolt.Open(dbPath, 0400, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return []error{fmt.Errorf("failed to open the db file: %v", err)}
+	}
+	defer db.Close()
+
+	var errs []error
+	err = db.View(func(tx *bolt.Tx) error {
+		for err := range tx.Check() {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
 
 func DefragData(dataDir string) error {
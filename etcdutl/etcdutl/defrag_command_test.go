@@ -0,0 +1,228 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package etcdutl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+	"go.etcd.io/etcd/server/v3/storage/datadir"
+)
+
+func TestCheckDefragIntegrity(t *testing.T) {
+	tt := []struct {
+		name    string
+		corrupt func(t *testing.T, dbPath string)
+		force   bool
+
+		err bool
+	}{
+		{name: "valid db"},
+		{name: "valid db with --force", force: true},
+		{name: "corrupted db", corrupt: corruptFreelist, err: true},
+		{name: "corrupted db with --force", corrupt: corruptFreelist, force: true},
+		{name: "not a db", corrupt: overwriteDB, err: true},
+		{name: "not a db with --force", corrupt: overwriteDB, force: true},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			dbPath := datadir.ToBackendFileName(dataDir)
+			createDB(t, dbPath)
+			if tc.corrupt != nil {
+				tc.corrupt(t, dbPath)
+				if errs := checkDBIntegrity(dbPath); len(errs) == 0 {
+					t.Fatal("Expected the integrity check to fail on the corrupted db")
+				}
+			}
+
+			err := checkDefragIntegrity(dataDir, tc.force)
+			if (err != nil) != tc.err {
+				t.Errorf("Unexpected error, expected an error: %v, got: %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir := t.TempDir()
+	for name, size := range map[string]int{"a": 10, "sub/b": 20, "sub/excluded": 40} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	size, err := dirSize(dir, filepath.Join(dir, "sub/excluded"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 30 {
+		t.Errorf("Unexpected directory size, expected: 30, got: %d", size)
+	}
+	if _, err := dirSize(filepath.Join(dir, "missing"), ""); err == nil {
+		t.Error("Expected an error for a missing directory")
+	}
+}
+
+func TestPrintDataDirSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    func(dataDir string) map[string]int
+		expected []string
+	}{
+		{
+			name: "all present",
+			files: func(dataDir string) map[string]int {
+				return map[string]int{
+					datadir.ToBackendFileName(dataDir):                  4000,
+					filepath.Join(datadir.ToSnapDir(dataDir), "1.snap"): 2000,
+					filepath.Join(datadir.ToWalDir(dataDir), "0.wal"):   3000,
+					filepath.Join(datadir.ToWalDir(dataDir), "1.wal"):   1000,
+				}
+			},
+			expected: []string{
+				"  db: 4.0 kB\n",
+				"  wal: 4.0 kB\n",
+				"  snap (excluding db): 2.0 kB\n",
+			},
+		},
+		{
+			name: "missing wal and snap",
+			files: func(dataDir string) map[string]int {
+				return nil
+			},
+			expected: []string{
+				"  db: unavailable (",
+				"  wal: unavailable (",
+				"  snap (excluding db): unavailable (",
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dataDir := t.TempDir()
+			for path, size := range tc.files(dataDir) {
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var buf bytes.Buffer
+			printDataDirSizes(&buf, dataDir, "before defragmentation")
+			out := buf.String()
+			if !strings.HasPrefix(out, "Disk usage of etcd data["+dataDir+"] before defragmentation:\n") {
+				t.Errorf("Unexpected header, got: %q", out)
+			}
+			for _, line := range tc.expected {
+				if !strings.Contains(out, line) {
+					t.Errorf("Expected output to contain %q, got: %q", line, out)
+				}
+			}
+		})
+	}
+}
+
+// createDB creates a db file with free pages, by deleting half of the keys
+// it writes.
+func createDB(t *testing.T, dbPath string) {
+	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	val := make([]byte, 1024)
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("key"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("%03d", i)), val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("key"))
+		for i := 0; i < 100; i += 2 {
+			if err := b.Delete([]byte(fmt.Sprintf("%03d", i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// corruptFreelist empties the freelist of the db file, so that its free
+// pages are neither reachable nor freed.
+func corruptFreelist(t *testing.T, dbPath string) {
+	f, err := os.OpenFile(dbPath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The meta pages are the first two pages, and the most recent one has the
+	// highest txid. See the page and meta structs of bbolt.
+	const pageHeaderSize = 16
+	meta := make([]byte, 64)
+	if _, err := f.ReadAt(meta, pageHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := int64(binary.LittleEndian.Uint32(meta[8:]))
+	freelist, txid := binary.LittleEndian.Uint64(meta[32:]), binary.LittleEndian.Uint64(meta[48:])
+	if _, err := f.ReadAt(meta, pageSize+pageHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint64(meta[48:]) > txid {
+		freelist = binary.LittleEndian.Uint64(meta[32:])
+	}
+
+	// The element count of the freelist page follows its id and flags.
+	if _, err := f.WriteAt([]byte{0, 0}, int64(freelist)*pageSize+10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// overwriteDB replaces the db file with data which is not a db.
+func overwriteDB(t *testing.T, dbPath string) {
+	if err := os.WriteFile(dbPath, make([]byte, 16*1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package etcdutl
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// See linux/ioprio.h.
+const (
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioWhoProcess = 1
+
+	// ioprioLowestBELevel is the lowest priority level in the best-effort class.
+	ioprioLowestBELevel = 7
+)
+
+// setIOPriority sets the I/O scheduling priority of the calling thread, so
+// the caller must lock the goroutine to its OS thread beforehand.
+func setIOPriority(class string) error {
+	prio, err := ioPriorityValue(class)
+	if err != nil {
+		return err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(prio)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// ioPriorityValue returns the ioprio_set value of the given --io-priority,
+// which holds both the class and the priority level within it.
+func ioPriorityValue(class string) (int, error) {
+	switch class {
+	case ioPriorityIdle:
+		return ioprioClassIdle << ioprioClassShift, nil
+	case ioPriorityBestEffort:
+		return ioprioClassBE<<ioprioClassShift | ioprioLowestBELevel, nil
+	default:
+		return 0, fmt.Errorf("unknown I/O priority class %q", class)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build linux
+// +build linux
+
+package etcdutl
+
+import "testing"
+
+func TestIOPriorityValue(t *testing.T) {
+	tt := []struct {
+		class string
+
+		ioClass int
+		level   int
+		err     bool
+	}{
+		{class: ioPriorityIdle, ioClass: ioprioClassIdle, level: 0},
+		{class: ioPriorityBestEffort, ioClass: ioprioClassBE, level: ioprioLowestBELevel},
+		{class: "realtime", err: true},
+		{class: "", err: true},
+	}
+	for _, tc := range tt {
+		prio, err := ioPriorityValue(tc.class)
+		if tc.err {
+			if err == nil {
+				t.Errorf("Expected an error for the I/O priority class %q, got: %d", tc.class, prio)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for the I/O priority class %q: %v", tc.class, err)
+		}
+		// See IOPRIO_PRIO_CLASS and IOPRIO_PRIO_DATA in linux/ioprio.h.
+		class, level := prio>>ioprioClassShift, prio&(1<<ioprioClassShift-1)
+		if class != tc.ioClass || level != tc.level {
+			t.Errorf("Unexpected I/O priority of %q, expected: class %d level %d, got: class %d level %d", tc.class, tc.ioClass, tc.level, class, level)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/version"
+	"go.etcd.io/etcd/client/pkg/v3/tlsutil"
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.etcd.io/etcd/client/v3"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// The following function follows the same logic as etcdctl, refer to
+// https://github.com/etcd-io/etcd/blob/f9a8c49c695b098d66a07948666664ea10d01a82/etcdctl/ctlv3/command/global.go#L191-L250
+func newClientCfg(dcfg *DiscoveryConfig, endpoints []string, lg *zap.Logger) (*clientv3.Config, error) {
+	var cfgtls *transport.TLSInfo
+
+	if dcfg.CertFile != "" || dcfg.KeyFile != "" || dcfg.TrustedCAFile != "" {
+		cfgtls = &transport.TLSInfo{
+			CertFile:      dcfg.CertFile,
+			KeyFile:       dcfg.KeyFile,
+			TrustedCAFile: dcfg.TrustedCAFile,
+			Logger:        lg,
+		}
+	}
+
+	password, err := resolvePassword(dcfg)
+	if err != nil {
+		return nil, err
+	}
+	if dcfg.AuthToken != "" && (dcfg.User != "" || password != "") {
+		return nil, errors.New("discovery: auth token can't be used together with user/password")
+	}
+	if dcfg.Credentials != nil && (dcfg.AuthToken != "" || dcfg.User != "" || password != "") {
+		return nil, errors.New("discovery: credentials provider can't be used together with auth token or user/password")
+	}
+	switch dcfg.ReadConsistency {
+	case "", ReadConsistencyLinearizable, ReadConsistencySerializable:
+	default:
+		return nil, fmt.Errorf("discovery: unknown read consistency %q", dcfg.ReadConsistency)
+	}
+	if dcfg.MaxCallSendMsgSize < 0 || dcfg.MaxCallRecvMsgSize < 0 {
+		return nil, errors.New("discovery: max call send/recv message size can't be negative")
+	}
+	if dcfg.BaseBackoffInterval < 0 || dcfg.MaxBackoffInterval < 0 {
+		return nil, errors.New("discovery: base/max backoff interval can't be negative")
+	}
+	if dcfg.TotalTimeout < 0 {
+		return nil, errors.New("discovery: total timeout can't be negative")
+	}
+	if dcfg.PeerWaitTimeout < 0 {
+		return nil, errors.New("discovery: peer wait timeout can't be negative")
+	}
+	if dcfg.RegistrationTTL < 0 {
+		return nil, errors.New("discovery: registration TTL can't be negative")
+	}
+
+	userAgent := dcfg.UserAgent
+	if userAgent == "" {
+		userAgent = "etcd-v3discovery/" + version.Version
+	}
+
+	cfg := &clientv3.Config{
+		Endpoints:            endpoints,
+		DialTimeout:          dcfg.DialTimeout,
+		DialKeepAliveTime:    dcfg.KeepAliveTime,
+		DialKeepAliveTimeout: dcfg.KeepAliveTimeout,
+		Username:             dcfg.User,
+		Password:             password,
+		MaxCallSendMsgSize:   dcfg.MaxCallSendMsgSize,
+		MaxCallRecvMsgSize:   dcfg.MaxCallRecvMsgSize,
+		DialOptions:          append([]grpc.DialOption{grpc.WithUserAgent(userAgent)}, dcfg.DialOptions...),
+	}
+
+	if len(dcfg.CertPEM) != 0 || len(dcfg.KeyPEM) != 0 || len(dcfg.TrustedCAPEM) != 0 {
+		clientTLS, err := newTLSConfigFromPEM(dcfg.CertPEM, dcfg.KeyPEM, dcfg.TrustedCAPEM)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TLS = clientTLS
+	} else if cfgtls != nil {
+		if clientTLS, err := cfgtls.ClientConfig(); err == nil {
+			cfg.TLS = clientTLS
+		} else {
+			return nil, err
+		}
+	}
+
+	// If key/cert is not given but user wants secure connection, we
+	// should still setup an empty tls configuration for gRPC to setup
+	// secure connection. A local unix socket is secure enough, unless
+	// "unixs" is used explicitly.
+	if cfg.TLS == nil && !dcfg.InsecureTransport && !onlyScheme(endpoints, "unix") {
+		cfg.TLS = &tls.Config{}
+	}
+
+	// If the user wants to skip TLS verification then we should set
+	// the InsecureSkipVerify flag in tls configuration.
+	if cfg.TLS != nil && dcfg.InsecureSkipVerify {
+		cfg.TLS.InsecureSkipVerify = true
+	}
+
+	if cfg.TLS != nil && dcfg.ServerName != "" {
+		cfg.TLS.ServerName = dcfg.ServerName
+	}
+
+	minVersion, cipherSuites, err := parseTLSPolicy(dcfg.MinTLSVersion, dcfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	// The defaults of the TLS configuration are kept unless overridden.
+	if cfg.TLS != nil && minVersion != 0 {
+		cfg.TLS.MinVersion = minVersion
+	}
+	if cfg.TLS != nil && len(cipherSuites) != 0 {
+		cfg.TLS.CipherSuites = cipherSuites
+	}
+
+	if dcfg.AuthToken != "" {
+		header := dcfg.AuthTokenHeader
+		if header == "" {
+			header = defaultAuthTokenHeader
+		}
+		cfg.DialOptions = append(cfg.DialOptions, grpc.WithPerRPCCredentials(&bearerTokenCredential{
+			header:     header,
+			token:      dcfg.AuthToken,
+			requireTLS: cfg.TLS != nil,
+		}))
+	}
+
+	return cfg, nil
+}
+
+// resolvePassword returns the password of the discovery client, from
+// Password, PasswordFile or PasswordEnv in that order of precedence.
+func resolvePassword(dcfg *DiscoveryConfig) (string, error) {
+	switch {
+	case dcfg.Password != "":
+		return dcfg.Password, nil
+	case dcfg.PasswordFile != "":
+		b, err := os.ReadFile(dcfg.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("discovery: failed to read the password file: %w", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	case dcfg.PasswordEnv != "":
+		password, ok := os.LookupEnv(dcfg.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("discovery: password environment variable %q not set", dcfg.PasswordEnv)
+		}
+		return strings.TrimSpace(password), nil
+	}
+	return "", nil
+}
+
+// tlsVersions are the TLS versions accepted by MinTLSVersion.
+var tlsVersions = map[string]uint16{
+	"TLS1.0": tls.VersionTLS10,
+	"TLS1.1": tls.VersionTLS11,
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+// parseTLSPolicy returns the minimum TLS version and the cipher suites of
+// the given names, which are 0 and nil respectively, i.e. the Go defaults,
+// if the names are empty.
+func parseTLSPolicy(minVersion string, cipherSuites []string) (uint16, []uint16, error) {
+	var version uint16
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return 0, nil, fmt.Errorf("discovery: unknown TLS version %q", minVersion)
+		}
+		version = v
+	}
+
+	var suites []uint16
+	for _, name := range cipherSuites {
+		id, ok := tlsutil.GetCipherSuite(name)
+		if !ok {
+			return 0, nil, fmt.Errorf("discovery: unknown cipher suite %q", name)
+		}
+		suites = append(suites, id)
+	}
+	return version, suites, nil
+}
+
+// newTLSConfigFromPEM returns the client TLS configuration with the given
+// PEM encoded certificate, key and trusted CA certificates, any of which may
+// be empty.
+func newTLSConfigFromPEM(certPEM, keyPEM, caPEM []byte) (*tls.Config, error) {
+	cfg := &tls.Config{}
+	if len(certPEM) != 0 || len(keyPEM) != 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("discovery: invalid client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(caPEM) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("discovery: no valid trusted CA certificate")
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// bearerTokenCredential implements credentials.PerRPCCredentials to send a
+// bearer token with every request.
+type bearerTokenCredential struct {
+	header     string
+	token      string
+	requireTLS bool
+}
+
+func (c *bearerTokenCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{c.header: "Bearer " + c.token}, nil
+}
+
+func (c *bearerTokenCredential) RequireTransportSecurity() bool {
+	return c.requireTLS
+}
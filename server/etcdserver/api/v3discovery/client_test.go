@@ -0,0 +1,443 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/version"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestNewClientCfgWithAuthToken(t *testing.T) {
+	cases := []struct {
+		name                string
+		cfg                 *DiscoveryConfig
+		expectError         bool
+		expectedDialOptions int
+	}{
+		{
+			name:                "auth token",
+			cfg:                 &DiscoveryConfig{AuthToken: "token"},
+			expectedDialOptions: 2,
+		},
+		{
+			name:        "auth token with user",
+			cfg:         &DiscoveryConfig{AuthToken: "token", User: "root"},
+			expectError: true,
+		},
+		{
+			name:                "no auth token",
+			cfg:                 &DiscoveryConfig{User: "root", Password: "pass"},
+			expectedDialOptions: 1,
+		},
+		{
+			name:        "credentials provider with user",
+			cfg:         &DiscoveryConfig{Credentials: &fakeCredentialsProvider{}, User: "root"},
+			expectError: true,
+		},
+		{
+			name:        "credentials provider with auth token",
+			cfg:         &DiscoveryConfig{Credentials: &fakeCredentialsProvider{}, AuthToken: "token"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := newClientCfg(tc.cfg, []string{"http://127.0.0.1:2379"}, zap.NewNop())
+			if (err != nil) != tc.expectError {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err == nil && len(cfg.DialOptions) != tc.expectedDialOptions {
+				t.Errorf("Unexpected dial options, expected: %d, got: %d", tc.expectedDialOptions, len(cfg.DialOptions))
+			}
+		})
+	}
+
+	cred := &bearerTokenCredential{header: defaultAuthTokenHeader, token: "token"}
+	md, err := cred.GetRequestMetadata(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md["authorization"] != "Bearer token" {
+		t.Errorf("Unexpected request metadata: %v", md)
+	}
+}
+
+func TestNewClientCfgWithPasswordFile(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("filepass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DISCOVERY_TEST_PASSWORD", " envpass ")
+
+	cases := []struct {
+		name             string
+		cfg              *DiscoveryConfig
+		expectError      bool
+		expectedPassword string
+	}{
+		{
+			name:             "password file",
+			cfg:              &DiscoveryConfig{User: "root", PasswordFile: passwordFile},
+			expectedPassword: "filepass",
+		},
+		{
+			name:             "password env",
+			cfg:              &DiscoveryConfig{User: "root", PasswordEnv: "DISCOVERY_TEST_PASSWORD"},
+			expectedPassword: "envpass",
+		},
+		{
+			name:             "password takes precedence",
+			cfg:              &DiscoveryConfig{User: "root", Password: "pass", PasswordFile: passwordFile, PasswordEnv: "DISCOVERY_TEST_PASSWORD"},
+			expectedPassword: "pass",
+		},
+		{
+			name:             "password file takes precedence over env",
+			cfg:              &DiscoveryConfig{User: "root", PasswordFile: passwordFile, PasswordEnv: "DISCOVERY_TEST_PASSWORD"},
+			expectedPassword: "filepass",
+		},
+		{
+			name:        "missing password file",
+			cfg:         &DiscoveryConfig{User: "root", PasswordFile: filepath.Join(t.TempDir(), "missing")},
+			expectError: true,
+		},
+		{
+			name:        "unset password env",
+			cfg:         &DiscoveryConfig{User: "root", PasswordEnv: "DISCOVERY_TEST_PASSWORD_UNSET"},
+			expectError: true,
+		},
+		{
+			name:        "password file with auth token",
+			cfg:         &DiscoveryConfig{AuthToken: "token", PasswordFile: passwordFile},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := newClientCfg(tc.cfg, []string{"http://127.0.0.1:2379"}, zap.NewNop())
+			if (err != nil) != tc.expectError {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err == nil && cfg.Password != tc.expectedPassword {
+				t.Errorf("Unexpected password, expected: %q, got: %q", tc.expectedPassword, cfg.Password)
+			}
+		})
+	}
+}
+
+func TestNewClientCfgWithMaxMsgSize(t *testing.T) {
+	cfg, err := newClientCfg(&DiscoveryConfig{MaxCallSendMsgSize: 4 * 1024 * 1024, MaxCallRecvMsgSize: 16 * 1024 * 1024}, []string{"http://127.0.0.1:2379"}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.MaxCallSendMsgSize != 4*1024*1024 || cfg.MaxCallRecvMsgSize != 16*1024*1024 {
+		t.Errorf("Unexpected max message sizes, got send: %d, recv: %d", cfg.MaxCallSendMsgSize, cfg.MaxCallRecvMsgSize)
+	}
+
+	if _, err := newClientCfg(&DiscoveryConfig{MaxCallRecvMsgSize: -1}, []string{"http://127.0.0.1:2379"}, zap.NewNop()); err == nil {
+		t.Error("Expected an error for a negative message size")
+	}
+}
+
+func TestNewClientCfgWithDialOptions(t *testing.T) {
+	dialer := grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return nil, errors.New("not dialed")
+	})
+	dcfg := &DiscoveryConfig{
+		InsecureTransport: true,
+		AuthToken:         "fakeToken",
+		DialOptions:       []grpc.DialOption{dialer},
+	}
+	cfg, err := newClientCfg(dcfg, []string{"http://127.0.0.1:2379"}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the user agent, the dialer, followed by the auth token credential.
+	if len(cfg.DialOptions) != 3 {
+		t.Fatalf("Unexpected dial options: %v", cfg.DialOptions)
+	}
+	if len(dcfg.DialOptions) != 1 {
+		t.Errorf("Unexpected dial options of the discovery config: %v", dcfg.DialOptions)
+	}
+}
+
+// fakeKVServerForUserAgent records the user agent of the requests.
+type fakeKVServerForUserAgent struct {
+	etcdserverpb.UnimplementedKVServer
+	userAgents chan string
+}
+
+func (s *fakeKVServerForUserAgent) Range(ctx context.Context, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	s.userAgents <- strings.Join(md.Get("user-agent"), ",")
+	return &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+}
+
+func TestUserAgent(t *testing.T) {
+	cases := []struct {
+		name           string
+		userAgent      string
+		expectedPrefix string
+	}{
+		{
+			name:           "default",
+			expectedPrefix: "etcd-v3discovery/" + version.Version,
+		},
+		{
+			name:           "custom",
+			userAgent:      "my-platform-discovery/1.0",
+			expectedPrefix: "my-platform-discovery/1.0",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs := &fakeKVServerForUserAgent{userAgents: make(chan string, 1)}
+			srv := grpc.NewServer()
+			etcdserverpb.RegisterKVServer(srv, fs)
+			go srv.Serve(l)
+			defer srv.Stop()
+
+			cfg := &DiscoveryConfig{
+				DialTimeout:       5 * time.Second,
+				RequestTimeOut:    5 * time.Second,
+				InsecureTransport: true,
+				UserAgent:         tc.userAgent,
+			}
+			d, err := newDiscovery(context.Background(), zap.NewNop(), "http://"+l.Addr().String()+"/fakeToken", cfg, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.close()
+
+			d.getClusterSize()
+			if ua := <-fs.userAgents; !strings.HasPrefix(ua, tc.expectedPrefix) {
+				t.Errorf("Unexpected user agent, expected prefix: %s, got: %s", tc.expectedPrefix, ua)
+			}
+		})
+	}
+}
+
+// newTestCertPEM returns a PEM encoded self-signed certificate and its key.
+func newTestCertPEM(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "discovery"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestNewClientCfgWithPEM(t *testing.T) {
+	certPEM, keyPEM := newTestCertPEM(t)
+
+	cfg, err := newClientCfg(&DiscoveryConfig{
+		CertPEM:      certPEM,
+		KeyPEM:       keyPEM,
+		TrustedCAPEM: certPEM,
+		// ignored in favor of the PEM fields.
+		CertFile: "/nonexistent/cert.pem",
+		KeyFile:  "/nonexistent/key.pem",
+	}, []string{"https://127.0.0.1:2379"}, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.TLS == nil || len(cfg.TLS.Certificates) != 1 || cfg.TLS.RootCAs == nil {
+		t.Errorf("Unexpected TLS config: %+v", cfg.TLS)
+	}
+
+	cases := []struct {
+		name string
+		dcfg *DiscoveryConfig
+	}{
+		{
+			name: "key without certificate",
+			dcfg: &DiscoveryConfig{KeyPEM: keyPEM},
+		},
+		{
+			name: "invalid CA",
+			dcfg: &DiscoveryConfig{TrustedCAPEM: []byte("not a certificate")},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newClientCfg(tc.dcfg, []string{"https://127.0.0.1:2379"}, zap.NewNop()); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestNewClientCfgWithServerName(t *testing.T) {
+	certPEM, keyPEM := newTestCertPEM(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name               string
+		dcfg               *DiscoveryConfig
+		expectedServerName string
+		expectNoTLS        bool
+	}{
+		{
+			name:               "default TLS",
+			dcfg:               &DiscoveryConfig{ServerName: "discovery.example.com"},
+			expectedServerName: "discovery.example.com",
+		},
+		{
+			name:               "TLS from files",
+			dcfg:               &DiscoveryConfig{CertFile: certFile, KeyFile: keyFile, TrustedCAFile: certFile, ServerName: "discovery.example.com"},
+			expectedServerName: "discovery.example.com",
+		},
+		{
+			name:               "TLS from PEM",
+			dcfg:               &DiscoveryConfig{CertPEM: certPEM, KeyPEM: keyPEM, TrustedCAPEM: certPEM, ServerName: "discovery.example.com"},
+			expectedServerName: "discovery.example.com",
+		},
+		{
+			name: "no server name",
+			dcfg: &DiscoveryConfig{},
+		},
+		{
+			name:        "insecure transport",
+			dcfg:        &DiscoveryConfig{InsecureTransport: true, ServerName: "discovery.example.com"},
+			expectNoTLS: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := newClientCfg(tc.dcfg, []string{"https://10.0.0.1:2379"}, zap.NewNop())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tc.expectNoTLS {
+				if cfg.TLS != nil {
+					t.Errorf("Unexpected TLS config: %+v", cfg.TLS)
+				}
+				return
+			}
+			if cfg.TLS.ServerName != tc.expectedServerName {
+				t.Errorf("Unexpected server name, expected: %q, got: %q", tc.expectedServerName, cfg.TLS.ServerName)
+			}
+			if cfg.TLS.InsecureSkipVerify {
+				t.Error("Unexpected InsecureSkipVerify")
+			}
+		})
+	}
+}
+
+func TestNewClientCfgWithTLSPolicy(t *testing.T) {
+	cases := []struct {
+		name                 string
+		dcfg                 *DiscoveryConfig
+		expectedMinVersion   uint16
+		expectedCipherSuites []uint16
+		expectError          bool
+	}{
+		{
+			name: "defaults",
+			dcfg: &DiscoveryConfig{},
+		},
+		{
+			name: "min version and cipher suites",
+			dcfg: &DiscoveryConfig{
+				MinTLSVersion: "TLS1.2",
+				CipherSuites:  []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			},
+			expectedMinVersion:   tls.VersionTLS12,
+			expectedCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		},
+		{
+			name:        "unknown version",
+			dcfg:        &DiscoveryConfig{MinTLSVersion: "SSL3.0"},
+			expectError: true,
+		},
+		{
+			name:        "unknown cipher suite",
+			dcfg:        &DiscoveryConfig{CipherSuites: []string{"TLS_FAKE_CIPHER"}},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := newClientCfg(tc.dcfg, []string{"https://127.0.0.1:2379"}, zap.NewNop())
+			if tc.expectError {
+				if err == nil {
+					t.Fatal("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cfg.TLS.MinVersion != tc.expectedMinVersion {
+				t.Errorf("Unexpected min version, expected: %x, got: %x", tc.expectedMinVersion, cfg.TLS.MinVersion)
+			}
+			if !reflect.DeepEqual(cfg.TLS.CipherSuites, tc.expectedCipherSuites) {
+				t.Errorf("Unexpected cipher suites, expected: %v, got: %v", tc.expectedCipherSuites, cfg.TLS.CipherSuites)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+
+	"go.uber.org/zap"
+)
+
+// CredentialsProvider provides the user name and password to authenticate
+// with the discovery service. It is called once when connecting, and again
+// each time the authentication fails, e.g. because the password has been
+// rotated during a long bootstrap.
+type CredentialsProvider interface {
+	GetCredentials(ctx context.Context) (user, pass string, err error)
+}
+
+// isAuthError returns true if err means that the client has to
+// authenticate again.
+func isAuthError(err error) bool {
+	switch rpctypes.Error(err) {
+	case rpctypes.ErrAuthFailed, rpctypes.ErrInvalidAuthToken, rpctypes.ErrAuthOldRevision, rpctypes.ErrUserEmpty:
+		return true
+	}
+	return false
+}
+
+// authTokenCredential implements credentials.PerRPCCredentials to send the
+// auth token obtained with the credentials of the CredentialsProvider. The
+// token may be replaced while requests are in flight, hence the mutex.
+type authTokenCredential struct {
+	mu    sync.RWMutex
+	token string
+}
+
+func (c *authTokenCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.token == "" {
+		return nil, nil
+	}
+	return map[string]string{rpctypes.TokenFieldNameGRPC: c.token}, nil
+}
+
+func (c *authTokenCredential) RequireTransportSecurity() bool {
+	return false
+}
+
+func (c *authTokenCredential) getToken() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.token
+}
+
+func (c *authTokenCredential) setToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = token
+}
+
+// authenticate gets an auth token with the given credentials, which is sent
+// with the following requests. No token is sent if the authentication is not
+// enabled on the discovery service.
+func (d *discovery) authenticate(ctx context.Context, user, pass string) error {
+	resp, err := d.c.Authenticate(ctx, user, pass)
+	if err != nil {
+		if err == rpctypes.ErrAuthNotEnabled {
+			d.authToken.setToken("")
+			return nil
+		}
+		return err
+	}
+	d.authToken.setToken(resp.Token)
+	return nil
+}
+
+// refreshCredentials gets the credentials from the configured
+// CredentialsProvider again if err is an authentication error, and
+// authenticates with them, so that the next request, which is retried by the
+// caller, uses the new auth token.
+func (d *discovery) refreshCredentials(err error) {
+	if d.cfg.Credentials == nil || d.authToken == nil || !isAuthError(err) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+	defer cancel()
+	user, pass, gerr := d.cfg.Credentials.GetCredentials(ctx)
+	if gerr != nil {
+		d.lg.Warn(
+			"failed to refresh credentials of discovery service",
+			zap.NamedError("auth-error", err),
+			zap.Error(gerr),
+		)
+		return
+	}
+	if aerr := d.authenticate(ctx, user, pass); aerr != nil {
+		d.lg.Warn(
+			"failed to authenticate with refreshed credentials of discovery service",
+			zap.String("user", user),
+			zap.NamedError("auth-error", err),
+			zap.Error(aerr),
+		)
+		return
+	}
+	d.lg.Info(
+		"refreshed credentials of discovery service",
+		zap.String("user", user),
+		zap.NamedError("auth-error", err),
+	)
+}
@@ -18,41 +18,97 @@ package v3discovery
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
-
+	"fmt"
 	"math"
+	"math/rand"
 	"net/url"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
-	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/pkg/v3/types"
 	"go.etcd.io/etcd/client/v3"
 
 	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 )
 
 const (
 	discoveryPrefix = "/_etcd/registry"
+
+	defaultAuthTokenHeader = "authorization"
 )
 
 var (
-	ErrInvalidURL     = errors.New("discovery: invalid peer URL")
-	ErrBadSizeKey     = errors.New("discovery: size key is bad")
-	ErrSizeNotFound   = errors.New("discovery: size key not found")
-	ErrFullCluster    = errors.New("discovery: cluster is full")
-	ErrTooManyRetries = errors.New("discovery: too many retries")
+	ErrInvalidURL           = errors.New("discovery: invalid peer URL")
+	ErrBadSizeKey           = errors.New("discovery: size key is bad")
+	ErrSizeNotFound         = errors.New("discovery: size key not found")
+	ErrFullCluster          = errors.New("discovery: cluster is full")
+	ErrTooManyRetries       = errors.New("discovery: too many retries")
+	ErrRequestTimeout       = errors.New("discovery: request timed out")
+	ErrInsufficientMembers  = errors.New("discovery: insufficient members to form the cluster")
+	ErrWaitMemberCanceled   = errors.New("discovery: context done before member registered")
+	ErrWatchClosed          = errors.New("discovery: watch channel closed unexpectedly")
+	ErrInvalidDiscoveryURL  = errors.New("discovery: invalid discovery URL")
+	ErrInvalidClusterToken  = errors.New("discovery: invalid cluster token")
+	ErrDiscoveryUnavailable = errors.New("discovery: discovery service unavailable")
+	ErrDuplicateName        = errors.New("discovery: duplicate member name")
+	ErrSchemeMismatch       = errors.New("discovery: unexpected peer URL scheme")
+	ErrSchemeDowngrade      = errors.New("discovery: peer URL scheme downgraded from https to http")
+	ErrDiscoveryTimeout     = errors.New("discovery: total timeout exceeded")
+	ErrIncompleteCluster    = errors.New("discovery: peer wait timeout elapsed before the cluster was complete")
 )
 
+// errRedeliveredPeer is returned by clusterInfo.add for a registration
+// which has already been added, as opposed to a conflicting registration.
+var errRedeliveredPeer = errors.New("peer delivered again from discovery service")
+
+// errWatchStalled is returned by watchPeers when the watch doesn't answer a
+// progress request within WatchIdleInterval.
+var errWatchStalled = errors.New("discovery: watch stalled")
+
+// errPeerWaitTimeout is returned by watchPeers when no new peer is found
+// within PeerWaitTimeout.
+var errPeerWaitTimeout = errors.New("discovery: peer wait timeout elapsed")
+
 var (
 	// Number of retries discovery will attempt before giving up and error out.
 	nRetries              = uint(math.MaxUint32)
 	maxExponentialRetries = uint(8)
+
+	// backendReadyPollInterval is the interval between two status checks
+	// when waiting for the discovery service to be ready.
+	backendReadyPollInterval = 500 * time.Millisecond
+	// defaultBackendReadyTimeout bounds the wait for the discovery service
+	// to be ready if DialTimeout is not set.
+	defaultBackendReadyTimeout = 2 * time.Second
+)
+
+// MemberKeyEncoding is how the registry key of a member is derived.
+type MemberKeyEncoding string
+
+const (
+	// MemberKeyByID derives the registry key from the member ID.
+	MemberKeyByID MemberKeyEncoding = "id"
+	// MemberKeyByName derives the registry key from the member name.
+	MemberKeyByName MemberKeyEncoding = "name"
+)
+
+// ReadConsistency is the consistency level of the reads polling the
+// discovery service.
+type ReadConsistency string
+
+const (
+	ReadConsistencyLinearizable ReadConsistency = "linearizable"
+	ReadConsistencySerializable ReadConsistency = "serializable"
 )
 
 type DiscoveryConfig struct {
@@ -69,8 +125,211 @@ type DiscoveryConfig struct {
 	KeyFile            string `json:"discovery-key"`
 	TrustedCAFile      string `json:"discovery-cacert"`
 
+	// CertPEM, KeyPEM and TrustedCAPEM are the PEM encoded client
+	// certificate, key and trusted CA certificates, as an alternative to
+	// CertFile, KeyFile and TrustedCAFile, which are ignored if any of them
+	// is set.
+	CertPEM      []byte `json:"-"`
+	KeyPEM       []byte `json:"-"`
+	TrustedCAPEM []byte `json:"-"`
+
+	// ServerName, if set, is the host name the certificate of the discovery
+	// service is verified against, and is sent in the TLS SNI, e.g. when
+	// the discovery service is reached through an IP address or a load
+	// balancer whose name differs from the one in the certificate.
+	ServerName string `json:"discovery-server-name"`
+
+	// MinTLSVersion is the minimum TLS version of the connections to the
+	// discovery service, one of "TLS1.0", "TLS1.1", "TLS1.2" or "TLS1.3".
+	// CipherSuites are the allowed cipher suites, e.g.
+	// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". The Go defaults are used
+	// if they are empty.
+	MinTLSVersion string   `json:"discovery-tls-min-version"`
+	CipherSuites  []string `json:"discovery-cipher-suites"`
+
 	User     string `json:"discovery-user"`
 	Password string `json:"discovery-password"`
+	// PasswordFile, if set, is the path of a file containing the password,
+	// and PasswordEnv the name of an environment variable containing it, so
+	// that the password doesn't appear in the process arguments or the
+	// configuration file. They are read when the client is created, and the
+	// surrounding whitespace is trimmed. Password takes precedence over
+	// PasswordFile, which takes precedence over PasswordEnv.
+	PasswordFile string `json:"discovery-password-file"`
+	PasswordEnv  string `json:"discovery-password-env"`
+	// Credentials, if set, provides the user name and password instead of
+	// User and Password, and is asked for them again whenever the
+	// authentication fails.
+	Credentials CredentialsProvider `json:"-"`
+
+	// AuthToken, if set, is sent as a bearer token in the AuthTokenHeader
+	// metadata of every request, which is useful when the discovery service
+	// is behind an auth proxy. It can't be used together with User/Password.
+	AuthToken string `json:"discovery-auth-token"`
+	// AuthTokenHeader is the metadata key to carry AuthToken, defaults to
+	// "authorization".
+	AuthTokenHeader string `json:"discovery-auth-token-header"`
+
+	// SigningKey, if set, is a secret shared by all members out-of-band,
+	// which is used to sign the registration of each member, and to verify
+	// the registrations of the others. See signMemberValue for details.
+	SigningKey string `json:"discovery-signing-key"`
+
+	// ExpectedSize is the cluster size to fall back to if the size key is
+	// deleted from the discovery service in the middle of the bootstrap.
+	ExpectedSize int `json:"discovery-expected-size"`
+	// SizeKeyWaitTimeout is how long to wait for the size key to reappear
+	// if it is deleted in the middle of the bootstrap and ExpectedSize is
+	// not set. 0 means do not wait.
+	SizeKeyWaitTimeout time.Duration `json:"discovery-size-key-wait-timeout"`
+
+	// ReadConsistency is the consistency of the reads polling the discovery
+	// service, e.g. before registering the local member or while waiting
+	// for a member, either "linearizable" (the default) or "serializable".
+	// Serializable reads may be stale, but reduce the load of the backend
+	// during long bootstraps. The read determining the cluster members is
+	// always linearizable.
+	ReadConsistency ReadConsistency `json:"discovery-read-consistency"`
+
+	// MaxCallSendMsgSize and MaxCallRecvMsgSize are the client-side request
+	// send and response receive limits in bytes. 0 means the clientv3
+	// defaults, i.e. 2 MiB to send and math.MaxInt32 to receive. The member
+	// list is read in a single response, and a watch response may carry
+	// many registrations, each of them being roughly the size of the
+	// member's "--initial-advertise-peer-urls" plus its name, so the
+	// receive limit must be at least the cluster size times the largest
+	// registration if it is lowered.
+	MaxCallSendMsgSize int `json:"discovery-max-call-send-msg-size"`
+	MaxCallRecvMsgSize int `json:"discovery-max-call-recv-msg-size"`
+
+	// RejectSchemeDowngrade, if true, fails the registration of the local
+	// member if it was previously registered with https peer URLs, and
+	// is going to be registered with http peer URLs. Otherwise such a
+	// downgrade is only logged.
+	RejectSchemeDowngrade bool `json:"discovery-reject-scheme-downgrade"`
+
+	// WaitBackendReady, if true, waits for the discovery service to have a
+	// leader and a non-zero raft index, for at most DialTimeout, or 2s if it
+	// is not set, before the first read, so that the retries of the first
+	// reads aren't spent on a backend which is still starting.
+	WaitBackendReady bool `json:"discovery-wait-backend-ready"`
+
+	// StrictSizeEnforcement, if true, registers the local member in a
+	// transaction which only succeeds if fewer members than the cluster
+	// size have registered, so that a member which doesn't make the cut
+	// fails with ErrFullCluster right away instead of after waiting for
+	// the peers.
+	StrictSizeEnforcement bool `json:"discovery-strict-size-enforcement"`
+
+	// SkipPreflight, if true, skips the read of the cluster size which
+	// checks that the discovery service is reachable, healthy and accepts
+	// the credentials before joining. Without it, the failures of the
+	// preflight are only handled by the retries of the join.
+	SkipPreflight bool `json:"discovery-skip-preflight"`
+
+	// WatchIdleInterval, if set, is how long the watch for the peers may
+	// stay silent before a progress notification is requested. The watch
+	// is considered stalled, and is reopened, if it is still silent after
+	// another interval.
+	WatchIdleInterval time.Duration `json:"discovery-watch-idle-interval"`
+
+	// RecordRegistrationTime, if true, registers the local member in the
+	// structured format, with the registration time in its metadata, so
+	// that the registration can be pruned by PruneStaleMembers once it is
+	// stale. The registration is then written again on each join.
+	RecordRegistrationTime bool `json:"discovery-record-registration-time"`
+
+	// RegisterAsLearner, if true, registers the local member as a learner,
+	// in the structured format with the "learner" metadata. Learners don't
+	// count toward the cluster size, so the cluster is complete once the
+	// size is reached by the voting members, and the learners registered
+	// before are part of it. They aren't part of the "--initial-cluster"
+	// string though, and have to be added with MemberAdd once the voting
+	// members have bootstrapped the cluster.
+	RegisterAsLearner bool `json:"discovery-register-as-learner"`
+
+	// StrictPeerURLScheme, if true, fails the discovery if the peer URLs of
+	// a selected member don't use https, or http if InsecureTransport is
+	// set, i.e. the same transport security as the discovery service, with
+	// an error wrapping ErrSchemeMismatch. It is off by default, as peers
+	// may use a different transport security.
+	StrictPeerURLScheme bool `json:"discovery-strict-peer-url-scheme"`
+
+	// BaseBackoffInterval is the backoff before the first retry, which
+	// doubles on each retry. 0 means one second.
+	BaseBackoffInterval time.Duration `json:"discovery-base-backoff-interval"`
+	// MaxBackoffInterval caps the exponential backoff between two retries.
+	// 0 means the default cap of 2^maxExponentialRetries times the
+	// BaseBackoffInterval (256s by default).
+	MaxBackoffInterval time.Duration `json:"discovery-max-backoff-interval"`
+	// DisableBackoffJitter disables the jitter of the backoff between two
+	// retries. By default, each backoff is a random duration between 0 and
+	// the exponential backoff ("full jitter"), so that the members of a
+	// cluster booting at once don't retry in synchronized waves.
+	DisableBackoffJitter bool `json:"discovery-disable-backoff-jitter"`
+
+	// TotalTimeout bounds the total time spent by GetCluster and
+	// JoinCluster, including all the retries and the wait for the peers,
+	// after which ErrDiscoveryTimeout is returned. 0 means no limit.
+	TotalTimeout time.Duration `json:"discovery-total-timeout"`
+	// PeerWaitTimeout, if set, bounds the wait for the peers once the local
+	// member is registered. The timeout is reset each time a new peer is
+	// found, so a slow but progressing formation isn't cut off. When it
+	// elapses, an *IncompleteClusterError carrying the members found so
+	// far is returned. 0 means waiting until the cluster is complete.
+	PeerWaitTimeout time.Duration `json:"discovery-peer-wait-timeout"`
+
+	// RegistrationTTL, if set, attaches the registration of the local
+	// member to a lease of that TTL, which is kept alive until the
+	// discovery is closed, so that the registration of a member crashing
+	// before the cluster is formed expires instead of occupying a slot
+	// forever. 0 means the registration never expires.
+	RegistrationTTL time.Duration `json:"discovery-registration-ttl"`
+
+	// DialOptions are additional options of the gRPC connections to the
+	// discovery service, e.g. grpc.WithContextDialer to reach it through a
+	// proxy.
+	DialOptions []grpc.DialOption `json:"-"`
+
+	// UserAgent is the gRPC user agent of the connections to the discovery
+	// service, so that the discovery traffic can be told apart from other
+	// clients. It defaults to "etcd-v3discovery/<version>".
+	UserAgent string `json:"discovery-user-agent"`
+
+	// MetricsRegisterer is the registerer of the discovery metrics, which
+	// defaults to the prometheus default registerer. The metrics already
+	// registered with it, e.g. by a previous discovery, are reused.
+	MetricsRegisterer prometheus.Registerer `json:"-"`
+
+	// MemberKeyEncoding is how the registry key of the local member is
+	// derived, either from its ID ("id", the default) or from its name
+	// ("name"). All members of a cluster should use the same encoding.
+	MemberKeyEncoding MemberKeyEncoding `json:"discovery-member-key-encoding"`
+
+	// Events is an optional channel to which the discovery publishes its
+	// progress. Events are dropped if the channel is full.
+	Events chan<- DiscoveryEvent `json:"-"`
+
+	// OnPeerFound, if set, is called synchronously each time a peer is
+	// found, with the number of peers found so far, the cluster size and
+	// the registration of the peer in the format "memberName=peerURLs".
+	OnPeerFound func(found, total int, peerURLsMap string) `json:"-"`
+
+	// KeyPrefix is the prefix of the registry keys in the discovery
+	// service, which defaults to "/_etcd/registry". All members of a
+	// cluster must use the same prefix.
+	KeyPrefix string `json:"discovery-key-prefix"`
+
+	// SRVServiceName is the suffix of the SRV service resolved for the
+	// discovery urls using the "srv+http" or "srv+https" scheme, e.g.
+	// "srv+https://example.com/<ClusterToken>" resolves
+	// "_etcd-client-ssl-<SRVServiceName>._tcp.example.com".
+	SRVServiceName string `json:"discovery-srv-name"`
+
+	// Clock is the clock used to back off and to wait for the backend,
+	// which defaults to the real clock. It is meant to be replaced by a
+	// fake clock in tests.
+	Clock clockwork.Clock `json:"-"`
 }
 
 type memberInfo struct {
@@ -83,58 +342,92 @@ type memberInfo struct {
 	// createRev is the member's CreateRevision in the etcd cluster backing
 	// the discovery service.
 	createRev int64
+	// clientURLs are the comma separated client URLs of the member, if it
+	// registered them in the metadata of the structured format.
+	clientURLs string
+	// modRev is the member's latest ModRevision seen; it is larger than
+	// createRev if the member registered again.
+	modRev int64
+	// registeredAt is the registration time of the member in unix seconds,
+	// if it registered it in the metadata of the structured format.
+	registeredAt int64
+	// learner is true if the member registered as a learner.
+	learner bool
 }
 
 type clusterInfo struct {
 	clusterToken string
-	members      []memberInfo
+	// keyPrefix is the configured KeyPrefix of the registry keys.
+	keyPrefix string
+	// peerScheme, if set, is the scheme the peer URLs of the selected
+	// members must use, see StrictPeerURLScheme.
+	peerScheme string
+	members    []memberInfo
+	// signingKey, if set, is used to verify the signature of each member.
+	signingKey []byte
+	// keyByName is true if the registry keys are derived from the member
+	// names rather than the member IDs.
+	keyByName bool
 }
 
-// key prefix for each cluster: "/_etcd/registry/<ClusterToken>".
-func geClusterKeyPrefix(cluster string) string {
-	return path.Join(discoveryPrefix, cluster)
+// key prefix for each cluster: "<KeyPrefix>/<ClusterToken>", where the
+// KeyPrefix defaults to "/_etcd/registry" if it is empty.
+func geClusterKeyPrefix(prefix, cluster string) string {
+	if prefix == "" {
+		prefix = discoveryPrefix
+	}
+	return path.Join(prefix, cluster)
 }
 
-// key format for cluster size: "/_etcd/registry/<ClusterToken>/_config/size".
-func geClusterSizeKey(cluster string) string {
-	return path.Join(geClusterKeyPrefix(cluster), "_config/size")
+// key format for cluster size: "<KeyPrefix>/<ClusterToken>/_config/size".
+func geClusterSizeKey(prefix, cluster string) string {
+	return path.Join(geClusterKeyPrefix(prefix, cluster), "_config/size")
 }
 
-// key prefix for each member: "/_etcd/registry/<ClusterToken>/members".
-func getMemberKeyPrefix(clusterToken string) string {
-	return path.Join(geClusterKeyPrefix(clusterToken), "members")
+// key prefix for each member: "<KeyPrefix>/<ClusterToken>/members".
+func getMemberKeyPrefix(prefix, clusterToken string) string {
+	return path.Join(geClusterKeyPrefix(prefix, clusterToken), "members")
 }
 
-// key format for each member: "/_etcd/registry/<ClusterToken>/members/<memberId>".
-func getMemberKey(cluster, memberId string) string {
-	return path.Join(getMemberKeyPrefix(cluster), memberId)
+// key format for each member: "<KeyPrefix>/<ClusterToken>/members/<memberId>".
+func getMemberKey(prefix, cluster, memberId string) string {
+	return path.Join(getMemberKeyPrefix(prefix, cluster), memberId)
 }
 
 // GetCluster will connect to the discovery service at the given url and
 // retrieve a string describing the cluster
-func GetCluster(lg *zap.Logger, dUrl string, cfg *DiscoveryConfig) (cs string, rerr error) {
-	d, err := newDiscovery(lg, dUrl, cfg, 0)
+func GetCluster(lg *zap.Logger, dUrl string, cfg *DiscoveryConfig) (string, error) {
+	return GetClusterWithContext(context.Background(), lg, dUrl, cfg)
+}
+
+// GetClusterWithContext is the same as GetCluster, but it gives up as soon
+// as the given context is done, in which case the returned error wraps the
+// error of the context.
+func GetClusterWithContext(ctx context.Context, lg *zap.Logger, dUrl string, cfg *DiscoveryConfig) (string, error) {
+	r, err := GetClusterResult(ctx, lg, dUrl, cfg)
 	if err != nil {
 		return "", err
 	}
+	return r.String(), nil
+}
+
+// GetClusterResult is the same as GetClusterWithContext, but it returns the
+// cluster as a ClusterResult.
+func GetClusterResult(ctx context.Context, lg *zap.Logger, dUrl string, cfg *DiscoveryConfig) (r *ClusterResult, rerr error) {
+	d, err := newDiscovery(ctx, lg, dUrl, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
 
 	defer d.close()
 	defer func() {
-		if rerr != nil {
-			d.lg.Error(
-				"discovery failed to get cluster",
-				zap.String("cluster", cs),
-				zap.Error(rerr),
-			)
-		} else {
-			d.lg.Info(
-				"discovery got cluster successfully",
-				zap.String("cluster", cs),
-			)
+		if rerr == nil {
+			d.recordFormation(r)
 		}
+		d.logOutcome(r, rerr, "discovery got cluster successfully", "discovery failed to get cluster")
 	}()
 
-	return d.getCluster()
+	return d.getClusterResult()
 }
 
 // JoinCluster will connect to the discovery service at the given url, and
@@ -144,29 +437,216 @@ func GetCluster(lg *zap.Logger, dUrl string, cfg *DiscoveryConfig) (cs string, r
 //
 // The final returned string has the same format as "--initial-cluster", such as
 // "infra1=http://127.0.0.1:12380,infra2=http://127.0.0.1:22380,infra3=http://127.0.0.1:32380".
-func JoinCluster(lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID, config string) (cs string, rerr error) {
-	d, err := newDiscovery(lg, durl, cfg, id)
+//
+// If the cluster is already full without the local member, the returned
+// error is a *FullClusterError, which wraps ErrFullCluster. If PeerWaitTimeout
+// elapses before the cluster is complete, it is an *IncompleteClusterError.
+func JoinCluster(lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID, config string) (string, error) {
+	return JoinClusterWithContext(context.Background(), lg, durl, cfg, id, config)
+}
+
+// JoinClusterWithContext is the same as JoinCluster, but it gives up as soon
+// as the given context is done, in which case the returned error wraps the
+// error of the context.
+func JoinClusterWithContext(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID, config string) (string, error) {
+	r, err := JoinClusterResult(ctx, lg, durl, cfg, id, config)
 	if err != nil {
 		return "", err
 	}
+	return r.String(), nil
+}
+
+// JoinClusterResult is the same as JoinClusterWithContext, but it returns
+// the cluster as a ClusterResult.
+func JoinClusterResult(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID, config string) (r *ClusterResult, rerr error) {
+	d, err := newDiscovery(ctx, lg, durl, cfg, id)
+	if err != nil {
+		return nil, err
+	}
 
 	defer d.close()
 	defer func() {
-		if rerr != nil {
-			d.lg.Error(
-				"discovery failed to join cluster",
-				zap.String("cluster", cs),
-				zap.Error(rerr),
-			)
-		} else {
-			d.lg.Info(
-				"discovery joined cluster successfully",
-				zap.String("cluster", cs),
-			)
+		if rerr == nil {
+			d.recordFormation(r)
 		}
+		d.logOutcome(r, rerr, "discovery joined cluster successfully", "discovery failed to join cluster")
 	}()
 
-	return d.joinCluster(config)
+	if !cfg.SkipPreflight {
+		if err := d.preflight(); err != nil {
+			return nil, err
+		}
+	}
+	return d.joinClusterResult(config)
+}
+
+// ClusterResult is the result of the discovery.
+type ClusterResult struct {
+	ClusterToken string
+	// ClusterSize is the configured cluster size.
+	ClusterSize int
+	// Members are the members selected for the cluster, in the order they
+	// registered, including the learners which registered before the
+	// cluster was complete.
+	Members []RegisteredMember
+	// Elapsed is the time from the connection to the discovery service to
+	// the formation of the cluster, and Retries the total number of retries
+	// meanwhile. They are only set by GetClusterResult and JoinClusterResult.
+	Elapsed time.Duration
+	Retries int
+}
+
+// FullClusterError is returned when joining a cluster which is already full
+// without the local member. It wraps ErrFullCluster, and carries the
+// members which occupy the cluster.
+type FullClusterError struct {
+	Result *ClusterResult
+}
+
+func (e *FullClusterError) Error() string {
+	members := make([]string, len(e.Result.Members))
+	for i, m := range e.Result.Members {
+		if m.ID == 0 {
+			members[i] = fmt.Sprintf("%s (%s)", m.Name, strings.Join(m.PeerURLs, ","))
+		} else {
+			members[i] = fmt.Sprintf("%s (%s, %s)", m.Name, m.ID, strings.Join(m.PeerURLs, ","))
+		}
+	}
+	return fmt.Sprintf("%v: cluster already has members %s", ErrFullCluster, strings.Join(members, ", "))
+}
+
+func (e *FullClusterError) Unwrap() error { return ErrFullCluster }
+
+// IncompleteClusterError is returned when PeerWaitTimeout elapses before
+// the cluster is complete. It wraps ErrIncompleteCluster, and carries the
+// members registered so far, so that the caller can decide whether to
+// proceed with them.
+type IncompleteClusterError struct {
+	Result *ClusterResult
+}
+
+func (e *IncompleteClusterError) Error() string {
+	return fmt.Sprintf("%v: found %d of %d members", ErrIncompleteCluster, len(e.Result.Members), e.Result.ClusterSize)
+}
+
+func (e *IncompleteClusterError) Unwrap() error { return ErrIncompleteCluster }
+
+// RequestTimeoutError is returned when a request to the discovery service
+// didn't complete within RequestTimeOut, as opposed to being rejected by
+// the discovery service. It wraps ErrRequestTimeout.
+type RequestTimeoutError struct {
+	// Op is the operation which timed out, e.g. "get cluster size".
+	Op      string
+	Timeout time.Duration
+}
+
+func (e *RequestTimeoutError) Error() string {
+	return fmt.Sprintf("%v: %s didn't complete within %v", ErrRequestTimeout, e.Op, e.Timeout)
+}
+
+func (e *RequestTimeoutError) Unwrap() error { return ErrRequestTimeout }
+
+// requestError returns a RequestTimeoutError for the given operation if err
+// is the expiry of RequestTimeOut, and err otherwise. The context of the
+// discovery being done isn't a request timeout.
+func (d *discovery) requestError(op string, err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && d.context().Err() == nil {
+		return &RequestTimeoutError{Op: op, Timeout: d.cfg.RequestTimeOut}
+	}
+	return err
+}
+
+// fullClusterError returns a FullClusterError with the members of cls if
+// err is ErrFullCluster, and err otherwise.
+func fullClusterError(cls *clusterInfo, clusterSize int, err error) error {
+	if err != ErrFullCluster || cls == nil {
+		return err
+	}
+	r, rerr := cls.getClusterResult(clusterSize)
+	if rerr != nil {
+		return err
+	}
+	return &FullClusterError{Result: r}
+}
+
+// String returns the cluster in the same format as "--initial-cluster",
+// which doesn't include the learners.
+func (r *ClusterResult) String() string {
+	values := make([]string, 0, len(r.Members))
+	for _, m := range r.Members {
+		if !m.IsLearner {
+			values = append(values, legacyMemberValue(m.Name, m.PeerURLs))
+		}
+	}
+	return strings.Join(values, ",")
+}
+
+// WaitForMember will connect to the discovery service at the given url, and
+// block until the member represented by the given id has registered itself,
+// or the given context is done. ErrWaitMemberCanceled is returned if the
+// context is done before the member registers.
+func WaitForMember(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID) error {
+	d, err := newDiscovery(ctx, lg, durl, cfg, 0)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+
+	return d.waitForMember(ctx, id)
+}
+
+// WaitForMemberByName is the same as WaitForMember, but it waits for the
+// member registered with the given name, whatever its registry key is.
+func WaitForMemberByName(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig, name string) error {
+	d, err := newDiscovery(ctx, lg, durl, cfg, 0)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+
+	return d.waitForMemberByName(ctx, name)
+}
+
+// LeaveCluster will connect to the discovery service at the given url, and
+// delete the registration of the member represented by the given id, e.g. to
+// clean up after an aborted bootstrap. It is not an error if the member is
+// not registered. Only the registrations keyed by member ID, i.e. with the
+// default MemberKeyEncoding, can be deleted.
+func LeaveCluster(lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID) error {
+	d, err := newDiscovery(context.Background(), lg, durl, cfg, id)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+
+	return d.leaveCluster()
+}
+
+// ClusterMembers are the members registered so far in the discovery
+// service.
+type ClusterMembers struct {
+	// ClusterSize is the configured cluster size, or 0 if it isn't
+	// configured yet.
+	ClusterSize int
+	// Revision is the revision of the discovery service the members were
+	// read at.
+	Revision int64
+	// Members are all the registered members, in the order they
+	// registered, including the ones beyond the cluster size.
+	Members []RegisteredMember
+}
+
+// GetClusterMembers will connect to the discovery service at the given url,
+// and read the members registered so far, e.g. to follow the formation of
+// the cluster. It is read-only, and can be called repeatedly.
+func GetClusterMembers(lg *zap.Logger, durl string, cfg *DiscoveryConfig) (*ClusterMembers, error) {
+	d, err := newDiscovery(context.Background(), lg, durl, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+
+	return d.getClusterMembersResult()
 }
 
 type discovery struct {
@@ -175,137 +655,510 @@ type discovery struct {
 	memberId     types.ID
 	c            *clientv3.Client
 	retries      uint
-	durl         string
+	// endpoints are the endpoints of the discovery service.
+	endpoints []string
+	// clusterSize is the cluster size read from the discovery service
+	// most recently; 0 if it has never been read.
+	clusterSize int
+	// selfKey is the registry key of the local member, set according to
+	// the configured MemberKeyEncoding before the registration; the key
+	// derived from memberId is used if it is empty.
+	selfKey string
+	// observer is true if the discovery never registers the local member,
+	// in which case it has no position among the members.
+	observer bool
 
 	cfg *DiscoveryConfig
+	// authToken, if set, sends the auth token obtained with the
+	// credentials of Credentials with every request.
+	authToken *authTokenCredential
+	// metrics, if set, records the metrics of the discovery.
+	metrics *discoveryMetrics
 
 	clock clockwork.Clock
+	// start is the time the discovery was created. totalRetries counts all
+	// the retries since then, and peakRetries is the highest number of
+	// consecutive retries.
+	start        time.Time
+	totalRetries uint
+	peakRetries  uint
+	// rand is the source of the backoff jitter; there is no jitter if it
+	// is nil.
+	rand *rand.Rand
+
+	// ctx aborts the requests, the retries and the watches of the
+	// discovery once it is done; nil means context.Background().
+	ctx context.Context
+	// timedOut is closed once TotalTimeout elapses, if it is set, which
+	// cancels ctx, and stop releases it.
+	timedOut chan struct{}
+	stop     context.CancelFunc
+	// peerWaitDeadline is when PeerWaitTimeout elapses while waiting for
+	// the peers; it is zero if there is no such limit.
+	peerWaitDeadline time.Time
+
+	// lease is the lease of the registration of the local member if
+	// RegistrationTTL is set, and stopKeepAlive stops keeping it alive.
+	lease         clientv3.LeaseID
+	stopKeepAlive context.CancelFunc
 }
 
-func newDiscovery(lg *zap.Logger, durl string, dcfg *DiscoveryConfig, id types.ID) (*discovery, error) {
+// withDialTimeout returns a child context of ctx, which is done after
+// DialTimeout if it is set.
+func withDialTimeout(ctx context.Context, dcfg *DiscoveryConfig) (context.Context, context.CancelFunc) {
+	if dcfg.DialTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, dcfg.DialTimeout)
+}
+
+func newDiscovery(ctx context.Context, lg *zap.Logger, durl string, dcfg *DiscoveryConfig, id types.ID) (*discovery, error) {
 	if lg == nil {
 		lg = zap.NewNop()
 	}
-	u, err := url.Parse(durl)
+	endpoints, token, err := parseDiscoveryURLs(durl, dcfg.InsecureTransport)
+	if err != nil {
+		return nil, err
+	}
+	rctx, cancel := withDialTimeout(ctx, dcfg)
+	endpoints, err = resolveSRVEndpoints(rctx, endpoints, dcfg.SRVServiceName)
+	cancel()
 	if err != nil {
 		return nil, err
 	}
-	token := u.Path
-	u.Path = ""
 
 	lg = lg.With(zap.String("discovery-url", durl))
-	cfg, err := newClientCfg(dcfg, u.String(), lg)
+	cfg, err := newClientCfg(dcfg, endpoints, lg)
 	if err != nil {
 		return nil, err
 	}
+	var user, pass string
+	var authToken *authTokenCredential
+	if dcfg.Credentials != nil {
+		gctx, cancel := withDialTimeout(ctx, dcfg)
+		user, pass, err = dcfg.Credentials.GetCredentials(gctx)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("discovery: failed to get credentials: %w", err)
+		}
+		// The token is replaced whenever the credentials are refreshed,
+		// instead of the credentials of the client.
+		authToken = &authTokenCredential{}
+		cfg.DialOptions = append(cfg.DialOptions, grpc.WithPerRPCCredentials(authToken))
+	}
 
 	c, err := clientv3.New(*cfg)
 	if err != nil {
 		return nil, err
 	}
-	return &discovery{
+	d := &discovery{
 		lg:           lg,
 		clusterToken: token,
 		memberId:     id,
 		c:            c,
-		durl:         u.String(),
+		endpoints:    endpoints,
 		cfg:          dcfg,
-		clock:        clockwork.NewRealClock(),
-	}, nil
+		clock:        dcfg.Clock,
+		authToken:    authToken,
+	}
+	if authToken != nil {
+		actx, cancel := withDialTimeout(ctx, dcfg)
+		err = d.authenticate(actx, user, pass)
+		cancel()
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("discovery: failed to authenticate: %w", err)
+		}
+	}
+	if d.clock == nil {
+		d.clock = clockwork.NewRealClock()
+	}
+	d.start = d.clock.Now()
+	d.setContext(ctx)
+	if d.metrics, err = newDiscoveryMetrics(dcfg.MetricsRegisterer); err != nil {
+		lg.Warn("failed to register discovery metrics", zap.Error(err))
+	}
+	if !dcfg.DisableBackoffJitter {
+		d.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if dcfg.WaitBackendReady {
+		d.waitBackendReady()
+	}
+	d.emit(DiscoveryEvent{Type: EventConnected})
+	return d, nil
 }
 
-// The following function follows the same logic as etcdctl, refer to
-// https://github.com/etcd-io/etcd/blob/f9a8c49c695b098d66a07948666664ea10d01a82/etcdctl/ctlv3/command/global.go#L191-L250
-func newClientCfg(dcfg *DiscoveryConfig, dUrl string, lg *zap.Logger) (*clientv3.Config, error) {
-	var cfgtls *transport.TLSInfo
+// waitBackendReady polls the status of the discovery service until it has
+// a leader and a non-zero raft index, i.e. until it is ready to serve, for
+// at most DialTimeout, or defaultBackendReadyTimeout if it is not set. It
+// gives up with a warning, as the reads which follow are retried anyway; it
+// only avoids spending their retries on a backend which is still starting.
+func (d *discovery) waitBackendReady() {
+	timeout := d.cfg.DialTimeout
+	if timeout <= 0 {
+		timeout = defaultBackendReadyTimeout
+	}
+	start := d.clock.Now()
+	for {
+		// The discovery service is ready as soon as any endpoint is.
+		var err error
+		for _, ep := range d.endpoints {
+			ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+			var resp *clientv3.StatusResponse
+			resp, err = d.c.Status(ctx, ep)
+			cancel()
+			if err == nil && resp.Leader != 0 && resp.RaftIndex != 0 {
+				return
+			}
+		}
+		if d.context().Err() != nil {
+			// The first read fails right away with the same error.
+			return
+		}
 
-	if dcfg.CertFile != "" || dcfg.KeyFile != "" || dcfg.TrustedCAFile != "" {
-		cfgtls = &transport.TLSInfo{
-			CertFile:      dcfg.CertFile,
-			KeyFile:       dcfg.KeyFile,
-			TrustedCAFile: dcfg.TrustedCAFile,
-			Logger:        lg,
+		if d.clock.Since(start) >= timeout {
+			d.lg.Warn(
+				"discovery service is not ready, proceeding anyway",
+				zap.Duration("timeout", timeout),
+				zap.Error(err),
+			)
+			return
 		}
+		d.lg.Info(
+			"waiting for discovery service to be ready",
+			zap.Duration("retry-in", backendReadyPollInterval),
+			zap.Error(err),
+		)
+		d.sleep(backendReadyPollInterval)
+	}
+}
+
+// preflight reads the cluster size once, with a linearizable read bounded
+// by RequestTimeOut, so that a discovery service which is unreachable,
+// unhealthy or rejects the credentials fails the join right away with
+// ErrDiscoveryUnavailable, instead of after all the retries. A missing
+// size key is left to the join to report.
+func (d *discovery) preflight() error {
+	sizeKey := geClusterSizeKey(d.keyPrefix(), d.clusterToken)
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+	_, err := d.c.Get(ctx, sizeKey)
+	cancel()
+	if err == nil {
+		return nil
+	}
+	if cerr := d.canceled(); cerr != nil {
+		return cerr
+	}
+	if d.cfg.Credentials != nil && isAuthError(err) {
+		// The join is retried with the refreshed credentials.
+		d.refreshCredentials(err)
+		return nil
+	}
+	d.lg.Warn(
+		"discovery service failed the preflight check",
+		zap.Strings("endpoints", d.endpoints),
+		zap.String("clusterSizeKey", sizeKey),
+		zap.Error(err),
+	)
+	return fmt.Errorf("%w: %v", ErrDiscoveryUnavailable, err)
+}
+
+// context returns the context of the discovery.
+func (d *discovery) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
 	}
+	return d.ctx
+}
 
-	cfg := &clientv3.Config{
-		Endpoints:            []string{dUrl},
-		DialTimeout:          dcfg.DialTimeout,
-		DialKeepAliveTime:    dcfg.KeepAliveTime,
-		DialKeepAliveTimeout: dcfg.KeepAliveTimeout,
-		Username:             dcfg.User,
-		Password:             dcfg.Password,
+// setContext sets the context of the discovery, which is bounded by the
+// configured TotalTimeout, as measured by d.clock.
+func (d *discovery) setContext(ctx context.Context) {
+	if d.cfg.TotalTimeout > 0 {
+		ctx, d.stop = context.WithCancel(ctx)
+		d.timedOut = make(chan struct{})
+		timeout, cancel, timedOut := d.clock.After(d.cfg.TotalTimeout), d.stop, d.timedOut
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-timeout:
+				close(timedOut)
+				cancel()
+			}
+		}()
 	}
+	d.ctx = ctx
+}
 
-	if cfgtls != nil {
-		if clientTLS, err := cfgtls.ClientConfig(); err == nil {
-			cfg.TLS = clientTLS
-		} else {
-			return nil, err
+// canceled returns the error to return once the context of the discovery
+// is done, or nil if it isn't done. ErrDiscoveryTimeout is returned if it
+// is done because of the TotalTimeout, as opposed to the given context.
+func (d *discovery) canceled() error {
+	err := d.context().Err()
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-d.timedOut:
+		return fmt.Errorf("%w (%v)", ErrDiscoveryTimeout, d.cfg.TotalTimeout)
+	default:
+	}
+	return fmt.Errorf("discovery: aborted: %w", err)
+}
+
+// sleep sleeps for the given duration, or until the context of the
+// discovery is done.
+func (d *discovery) sleep(dur time.Duration) {
+	select {
+	case <-d.context().Done():
+	case <-d.clock.After(dur):
+	}
+}
+
+// parseDiscoveryURLs is the same as parseDiscoveryURL, but durl may be a
+// comma separated list of urls, e.g. the urls of each member of the etcd
+// cluster backing the discovery service, for failover. All the urls must
+// carry the same cluster token.
+func parseDiscoveryURLs(durl string, insecure bool) ([]string, string, error) {
+	var endpoints []string
+	token := ""
+	for i, s := range strings.Split(durl, ",") {
+		u, t, err := parseDiscoveryURL(strings.TrimSpace(s), insecure)
+		if err != nil {
+			return nil, "", err
+		}
+		if i > 0 && t != token {
+			return nil, "", fmt.Errorf("%w: inconsistent cluster tokens %q and %q", ErrInvalidDiscoveryURL, token, t)
+		}
+		endpoints, token = append(endpoints, u.String()), t
+	}
+	return endpoints, token, nil
+}
+
+// parseDiscoveryURL splits the discovery url into the endpoint of the
+// discovery service and the cluster token. If the url has no scheme, it
+// defaults to "http" when insecure is true, or "https" otherwise. A "unix"
+// or "unixs" url, e.g. "unix:///var/run/etcd.sock/<ClusterToken>", points
+// to a unix socket, whose path is everything before the cluster token.
+func parseDiscoveryURL(durl string, insecure bool) (*url.URL, string, error) {
+	if !strings.Contains(durl, "://") {
+		scheme := "https"
+		if insecure {
+			scheme = "http"
 		}
+		durl = scheme + "://" + durl
+	}
+
+	u, err := url.Parse(durl)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme == "unix" || u.Scheme == "unixs" {
+		return parseUnixDiscoveryURL(u, durl)
+	}
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("%w: %q has no host, expected a url like \"https://example.com:2379/<ClusterToken>\"", ErrInvalidDiscoveryURL, durl)
 	}
 
-	// If key/cert is not given but user wants secure connection, we
-	// should still setup an empty tls configuration for gRPC to setup
-	// secure connection.
-	if cfg.TLS == nil && !dcfg.InsecureTransport {
-		cfg.TLS = &tls.Config{}
+	token := strings.TrimRight(u.Path, "/")
+	if err := validateClusterToken(token); err != nil {
+		return nil, "", fmt.Errorf("%w in %q, expected a url like \"https://example.com:2379/<ClusterToken>\"", err, durl)
 	}
+	u.Path = ""
+	u.RawPath = ""
+	return u, token, nil
+}
 
-	// If the user wants to skip TLS verification then we should set
-	// the InsecureSkipVerify flag in tls configuration.
-	if cfg.TLS != nil && dcfg.InsecureSkipVerify {
-		cfg.TLS.InsecureSkipVerify = true
+// parseUnixDiscoveryURL splits the parsed unix discovery url u into the
+// endpoint of the socket and the cluster token, which is the last element
+// of the path.
+func parseUnixDiscoveryURL(u *url.URL, durl string) (*url.URL, string, error) {
+	p := strings.TrimRight(u.Path, "/")
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		i = len(p)
+	}
+	token := p[i:]
+	if err := validateClusterToken(token); err != nil {
+		return nil, "", fmt.Errorf("%w in %q, expected a url like \"unix:///var/run/etcd.sock/<ClusterToken>\"", err, durl)
 	}
+	if i == 0 && u.Host == "" {
+		return nil, "", fmt.Errorf("%w: %q has no socket path, expected a url like \"unix:///var/run/etcd.sock/<ClusterToken>\"", ErrInvalidDiscoveryURL, durl)
+	}
+	u.Path = p[:i]
+	u.RawPath = ""
+	return u, token, nil
+}
 
-	return cfg, nil
+// validateClusterToken checks that the cluster token, i.e. the path of the
+// discovery url, is a single non-empty path element, so that the keys of
+// the cluster can't overlap the keys of another cluster.
+func validateClusterToken(token string) error {
+	t := strings.TrimPrefix(token, "/")
+	switch {
+	case t == "":
+		return fmt.Errorf("%w: empty token", ErrInvalidClusterToken)
+	case t == "." || t == "..":
+		return fmt.Errorf("%w: %q", ErrInvalidClusterToken, t)
+	case strings.ContainsRune(t, '/'):
+		return fmt.Errorf("%w: %q contains '/'", ErrInvalidClusterToken, t)
+	}
+	for _, r := range t {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return fmt.Errorf("%w: %q contains a space or non printable character", ErrInvalidClusterToken, t)
+		}
+	}
+	return nil
 }
 
 func (d *discovery) getCluster() (string, error) {
+	r, err := d.getClusterResult()
+	if err != nil {
+		return "", err
+	}
+	return r.String(), nil
+}
+
+func (d *discovery) getClusterResult() (*ClusterResult, error) {
 	cls, clusterSize, rev, err := d.checkCluster()
 	if err != nil {
 		if err == ErrFullCluster {
-			return cls.getInitClusterStr(clusterSize)
+			return d.clusterResult(cls, clusterSize)
 		}
-		return "", err
+		return nil, err
 	}
 
-	for cls.Len() < clusterSize {
-		d.waitPeers(cls, clusterSize, rev)
+	for cls.voters() < clusterSize {
+		if err := d.waitPeers(cls, clusterSize, rev); err != nil {
+			return nil, err
+		}
 	}
 
-	return cls.getInitClusterStr(clusterSize)
+	return d.clusterResult(cls, clusterSize)
 }
 
 func (d *discovery) joinCluster(config string) (string, error) {
-	_, _, _, err := d.checkCluster()
+	r, err := d.joinClusterResult(config)
 	if err != nil {
 		return "", err
 	}
+	return r.String(), nil
+}
+
+func (d *discovery) joinClusterResult(config string) (*ClusterResult, error) {
+	if err := d.setSelfKey(config); err != nil {
+		return nil, err
+	}
+
+	cls, clusterSize, _, err := d.checkCluster(d.pollingReadOpts()...)
+	if err != nil {
+		return nil, fullClusterError(cls, clusterSize, err)
+	}
+
+	if err := d.checkSchemeChange(cls, config); err != nil {
+		return nil, err
+	}
 
 	if err := d.registerSelf(config); err != nil {
-		return "", err
+		if err == ErrFullCluster {
+			if cls, _, rerr := d.getClusterMembers(); rerr == nil {
+				return nil, fullClusterError(cls, d.clusterSize, err)
+			}
+		}
+		return nil, err
 	}
 
+	// The read determining the cluster members is always linearizable.
 	cls, clusterSize, rev, err := d.checkCluster()
 	if err != nil {
-		return "", err
+		return nil, fullClusterError(cls, clusterSize, err)
+	}
+
+	for cls.voters() < clusterSize {
+		if err := d.waitPeers(cls, clusterSize, rev); err != nil {
+			return nil, err
+		}
+	}
+
+	d.lg.Info(
+		"discovery selected cluster members",
+		zap.Int("cluster-size", clusterSize),
+		zap.Bool("seed", cls.isSeed(d.getSelfKey(), clusterSize)),
+	)
+
+	return d.clusterResult(cls, clusterSize)
+}
+
+// recordFormation sets how long the formation of the cluster r took, and how
+// many retries it needed.
+func (d *discovery) recordFormation(r *ClusterResult) {
+	r.Elapsed = d.clock.Since(d.start)
+	r.Retries = int(d.totalRetries)
+}
+
+// clusterResult is the same as clusterInfo.getClusterResult, and it
+// notifies the completion of the cluster formation on success.
+func (d *discovery) clusterResult(cls *clusterInfo, clusterSize int) (*ClusterResult, error) {
+	r, err := cls.getClusterResult(clusterSize)
+	if err == nil {
+		d.emit(DiscoveryEvent{Type: EventClusterComplete, ClusterSize: clusterSize, PeersFound: clusterSize})
+	}
+	return r, err
+}
+
+func (d *discovery) waitForMember(ctx context.Context, id types.ID) error {
+	memberKey := getMemberKey(d.keyPrefix(), d.clusterToken, id.String())
+	return d.waitForMemberFunc(ctx, zap.String("memberKey", memberKey), func(cls *clusterInfo) bool {
+		return cls.exist(memberKey)
+	})
+}
+
+func (d *discovery) waitForMemberByName(ctx context.Context, name string) error {
+	return d.waitForMemberFunc(ctx, zap.String("memberName", name), func(cls *clusterInfo) bool {
+		return cls.existName(name)
+	})
+}
+
+// waitForMemberFunc blocks until found returns true for the registered
+// members, which are logged with the given field.
+func (d *discovery) waitForMemberFunc(ctx context.Context, member zap.Field, found func(cls *clusterInfo) bool) error {
+	cls, rev, err := d.getClusterMembers(d.pollingReadOpts()...)
+	if err != nil {
+		return err
 	}
 
-	for cls.Len() < clusterSize {
-		d.waitPeers(cls, clusterSize, rev)
+	if !found(cls) {
+		d.lg.Info("waiting for member from discovery service", member)
+		err := d.watchPeers(ctx, cls, rev, func() bool {
+			return found(cls)
+		})
+		if !found(cls) {
+			if ctx.Err() != nil {
+				return ErrWaitMemberCanceled
+			}
+			// e.g. the revision has been compacted.
+			if err != nil {
+				return err
+			}
+			return ErrWatchClosed
+		}
 	}
 
-	return cls.getInitClusterStr(clusterSize)
+	d.lg.Info("found member from discovery service", member)
+	return nil
 }
 
-func (d *discovery) getClusterSize() (int, error) {
-	configKey := geClusterSizeKey(d.clusterToken)
-	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.RequestTimeOut)
+// getClusterSize reads the cluster size with the given read options, which
+// are pollingReadOpts for the polling reads, or none for a linearizable read.
+func (d *discovery) getClusterSize(opts ...clientv3.OpOption) (int, error) {
+	configKey := geClusterSizeKey(d.keyPrefix(), d.clusterToken)
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
 	defer cancel()
 
-	resp, err := d.c.Get(ctx, configKey)
+	resp, err := d.c.Get(ctx, configKey, opts...)
 	if err != nil {
+		d.refreshCredentials(err)
+		err = d.requestError("get cluster size", err)
 		d.lg.Warn(
 			"failed to get cluster size from discovery service",
 			zap.String("clusterSizeKey", configKey),
@@ -318,7 +1171,17 @@ func (d *discovery) getClusterSize() (int, error) {
 		return 0, ErrSizeNotFound
 	}
 
-	clusterSize, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 0)
+	clusterSize, err := parseClusterSize(resp.Kvs[0].Value)
+	if err != nil {
+		return 0, err
+	}
+
+	d.emit(DiscoveryEvent{Type: EventSizeRead, ClusterSize: clusterSize})
+	return clusterSize, nil
+}
+
+func parseClusterSize(value []byte) (int, error) {
+	clusterSize, err := strconv.ParseInt(string(value), 10, 0)
 	if err != nil || clusterSize <= 0 {
 		return 0, ErrBadSizeKey
 	}
@@ -326,178 +1189,830 @@ func (d *discovery) getClusterSize() (int, error) {
 	return int(clusterSize), nil
 }
 
-func (d *discovery) getClusterMembers() (*clusterInfo, int64, error) {
-	membersKeyPrefix := getMemberKeyPrefix(d.clusterToken)
-	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.RequestTimeOut)
-	defer cancel()
+// recoverClusterSize is called when the cluster size key disappears after
+// it has already been read successfully, which usually means it was deleted
+// by mistake during the bootstrap. It falls back to the configured expected
+// size if there is one, otherwise it waits for the size key to reappear for
+// at most SizeKeyWaitTimeout.
+func (d *discovery) recoverClusterSize() (int, error) {
+	configKey := geClusterSizeKey(d.keyPrefix(), d.clusterToken)
+	d.lg.Warn(
+		"cluster size key was deleted from discovery service during bootstrap",
+		zap.String("clusterSizeKey", configKey),
+		zap.Int("previous-clusterSize", d.clusterSize),
+	)
 
-	resp, err := d.c.Get(ctx, membersKeyPrefix, clientv3.WithPrefix())
-	if err != nil {
+	if d.cfg.ExpectedSize > 0 {
 		d.lg.Warn(
-			"failed to get cluster members from discovery service",
-			zap.String("membersKeyPrefix", membersKeyPrefix),
-			zap.Error(err),
+			"falling back to the configured expected cluster size",
+			zap.Int("expected-clusterSize", d.cfg.ExpectedSize),
 		)
-		return nil, 0, err
+		return d.cfg.ExpectedSize, nil
 	}
 
-	cls := &clusterInfo{clusterToken: d.clusterToken}
-	for _, kv := range resp.Kvs {
-		mKey := strings.TrimSpace(string(kv.Key))
-		mValue := strings.TrimSpace(string(kv.Value))
+	if d.cfg.SizeKeyWaitTimeout <= 0 {
+		return 0, ErrSizeNotFound
+	}
 
-		if err := cls.add(mKey, mValue, kv.CreateRevision); err != nil {
-			d.lg.Warn(
-				err.Error(),
-				zap.String("memberKey", mKey),
-				zap.String("memberInfo", mValue),
-			)
-		} else {
-			d.lg.Info(
-				"found peer from discovery service",
-				zap.String("memberKey", mKey),
-				zap.String("memberInfo", mValue),
-			)
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.SizeKeyWaitTimeout)
+	defer cancel()
+
+	w := d.c.Watch(ctx, configKey)
+
+	// The size key may have been put back before the watch was created.
+	if clusterSize, err := d.getClusterSize(d.pollingReadOpts()...); err != ErrSizeNotFound {
+		return clusterSize, err
+	}
+
+	d.lg.Warn(
+		"waiting for cluster size key to reappear in discovery service",
+		zap.String("clusterSizeKey", configKey),
+		zap.Duration("timeout", d.cfg.SizeKeyWaitTimeout),
+	)
+	for wresp := range w {
+		for _, ev := range wresp.Events {
+			if ev.Type == clientv3.EventTypePut {
+				return parseClusterSize(ev.Kv.Value)
+			}
 		}
 	}
 
-	return cls, resp.Header.Revision, nil
+	if err := d.canceled(); err != nil {
+		return 0, err
+	}
+	return 0, ErrSizeNotFound
 }
 
-func (d *discovery) checkClusterRetry() (*clusterInfo, int, int64, error) {
+func (d *discovery) getClusterMembers(opts ...clientv3.OpOption) (*clusterInfo, int64, error) {
+	cls := &clusterInfo{
+		clusterToken: d.clusterToken,
+		keyPrefix:    d.keyPrefix(),
+		signingKey:   d.signingKey(),
+		keyByName:    d.cfg.MemberKeyEncoding == MemberKeyByName,
+	}
+	if d.cfg.StrictPeerURLScheme {
+		cls.peerScheme = "https"
+		if d.cfg.InsecureTransport {
+			cls.peerScheme = "http"
+		}
+	}
+	rev, err := d.readClusterMembers(cls, opts...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cls, rev, nil
+}
+
+// readClusterMembers reads the members from the discovery service, adds
+// them into cls, and returns the revision of the read.
+func (d *discovery) readClusterMembers(cls *clusterInfo, opts ...clientv3.OpOption) (int64, error) {
+	membersKeyPrefix := getMemberKeyPrefix(d.keyPrefix(), d.clusterToken)
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+	defer cancel()
+
+	resp, err := d.c.Get(ctx, membersKeyPrefix, append([]clientv3.OpOption{clientv3.WithPrefix()}, opts...)...)
+	if err != nil {
+		d.refreshCredentials(err)
+		err = d.requestError("get cluster members", err)
+		d.lg.Warn(
+			"failed to get cluster members from discovery service",
+			zap.String("membersKeyPrefix", membersKeyPrefix),
+			zap.Error(err),
+		)
+		return 0, err
+	}
+
+	for _, kv := range resp.Kvs {
+		d.addPeer(cls, kv)
+	}
+
+	return resp.Header.Revision, nil
+}
+
+// keyPrefix returns the configured KeyPrefix of the registry keys.
+func (d *discovery) keyPrefix() string {
+	if d.cfg == nil {
+		return ""
+	}
+	return d.cfg.KeyPrefix
+}
+
+// getSelfKey returns the registry key of the local member.
+func (d *discovery) getSelfKey() string {
+	if d.selfKey != "" {
+		return d.selfKey
+	}
+	return getMemberKey(d.keyPrefix(), d.clusterToken, d.memberId.String())
+}
+
+// setSelfKey sets the registry key of the local member, which is going to
+// register with the given config, according to the configured
+// MemberKeyEncoding.
+func (d *discovery) setSelfKey(config string) error {
+	switch d.cfg.MemberKeyEncoding {
+	case "", MemberKeyByID:
+		d.selfKey = getMemberKey(d.keyPrefix(), d.clusterToken, d.memberId.String())
+	case MemberKeyByName:
+		name, _, _, err := ParseMemberValue(config)
+		if err != nil {
+			return err
+		}
+		if strings.ContainsAny(name, "/") || name == "." || name == ".." {
+			return fmt.Errorf("discovery: member name %q can't be used as registry key", name)
+		}
+		d.selfKey = getMemberKey(d.keyPrefix(), d.clusterToken, name)
+	default:
+		return fmt.Errorf("discovery: unknown member key encoding %q", d.cfg.MemberKeyEncoding)
+	}
+	return nil
+}
+
+// pollingReadOpts returns the options of the reads polling the discovery
+// service, according to the configured ReadConsistency.
+func (d *discovery) pollingReadOpts() []clientv3.OpOption {
+	if d.cfg.ReadConsistency == ReadConsistencySerializable {
+		return []clientv3.OpOption{clientv3.WithSerializable()}
+	}
+	return nil
+}
+
+func (d *discovery) checkClusterRetry(opts ...clientv3.OpOption) (*clusterInfo, int, int64, error) {
+	if err := d.canceled(); err != nil {
+		return nil, 0, 0, err
+	}
 	if d.retries < nRetries {
 		d.logAndBackoffForRetry("cluster status check")
-		return d.checkCluster()
+		if err := d.canceled(); err != nil {
+			return nil, 0, 0, err
+		}
+		return d.doCheckCluster(opts...)
 	}
 	return nil, 0, 0, ErrTooManyRetries
 }
 
-func (d *discovery) checkCluster() (*clusterInfo, int, int64, error) {
-	clusterSize, err := d.getClusterSize()
+// observePhase records the duration of the given phase started at start,
+// as measured by d.clock.
+func (d *discovery) observePhase(phase string, start time.Time) {
+	d.metrics.observePhase(phase, d.clock.Since(start))
+}
+
+// checkCluster, registerSelf and waitPeers are the phases of the discovery,
+// each of which gets its own retry budget, no matter how many retries the
+// previous phases have taken.
+func (d *discovery) checkCluster(opts ...clientv3.OpOption) (*clusterInfo, int, int64, error) {
+	defer d.observePhase(phaseCheckCluster, d.clock.Now())
+	d.retries = 0
+	return d.doCheckCluster(opts...)
+}
+
+func (d *discovery) doCheckCluster(opts ...clientv3.OpOption) (*clusterInfo, int, int64, error) {
+	clusterSize, err := d.getClusterSize(opts...)
+	if err == ErrSizeNotFound && d.clusterSize > 0 {
+		clusterSize, err = d.recoverClusterSize()
+	}
 	if err != nil {
 		if err == ErrSizeNotFound || err == ErrBadSizeKey {
 			return nil, 0, 0, err
 		}
 
-		return d.checkClusterRetry()
+		return d.checkClusterRetry(opts...)
 	}
 
-	cls, rev, err := d.getClusterMembers()
+	d.clusterSize = clusterSize
+
+	cls, rev, err := d.getClusterMembers(opts...)
 	if err != nil {
-		return d.checkClusterRetry()
+		return d.checkClusterRetry(opts...)
 	}
 	d.retries = 0
 
-	// find self position
-	memberSelfId := getMemberKey(d.clusterToken, d.memberId.String())
-	idx := 0
+	if d.observer {
+		return cls, clusterSize, rev, nil
+	}
+
+	if selfRank(cls, d.getSelfKey()) >= clusterSize {
+		return cls, clusterSize, rev, ErrFullCluster
+	}
+	return cls, clusterSize, rev, nil
+}
+
+// selfRank returns the 0-based rank of the member registered with the given
+// key among the sorted members of cls, i.e. the number of voting members
+// registered before it, or the rank it would get if it registered now, i.e.
+// the number of voting members, if it isn't registered. The member, voting
+// or learner, is part of the cluster if its rank is less than the cluster
+// size.
+func selfRank(cls *clusterInfo, memberKey string) int {
+	rank := 0
 	for _, m := range cls.members {
-		if m.peerRegKey == memberSelfId {
-			break
+		if m.peerRegKey == memberKey {
+			return rank
 		}
-		if idx >= clusterSize-1 {
-			return cls, clusterSize, rev, ErrFullCluster
+		if !m.learner {
+			rank++
 		}
-		idx++
 	}
-	return cls, clusterSize, rev, nil
+	return rank
+}
+
+// checkSchemeChange compares the schemes of the peer URLs in contents with
+// the ones previously registered by the local member in cls, if any, in
+// order to catch accidental security downgrades on re-registration.
+func (d *discovery) checkSchemeChange(cls *clusterInfo, contents string) error {
+	memberKey := d.getSelfKey()
+	for _, m := range cls.members {
+		if m.peerRegKey != memberKey {
+			continue
+		}
+		_, prevURLs, _, err := ParseMemberValue(m.peerURLsMap)
+		if err != nil {
+			return nil
+		}
+		_, newURLs, _, err := ParseMemberValue(contents)
+		if err != nil {
+			return nil
+		}
+
+		switch {
+		case usesScheme(prevURLs, "https") && usesScheme(newURLs, "http"):
+			if d.cfg.RejectSchemeDowngrade {
+				return fmt.Errorf("%w: previously registered %q, registering %q", ErrSchemeDowngrade, m.peerURLsMap, contents)
+			}
+			d.lg.Warn(
+				"peer URL scheme downgraded from https to http since the previous registration",
+				zap.String("memberKey", memberKey),
+				zap.String("previous-memberInfo", m.peerURLsMap),
+				zap.String("memberInfo", contents),
+			)
+		case usesScheme(prevURLs, "http") && !usesScheme(newURLs, "http"):
+			d.lg.Info(
+				"peer URL scheme upgraded from http to https since the previous registration",
+				zap.String("memberKey", memberKey),
+				zap.String("previous-memberInfo", m.peerURLsMap),
+				zap.String("memberInfo", contents),
+			)
+		}
+		return nil
+	}
+	return nil
+}
+
+// usesScheme returns true if any of the given URLs uses the given scheme.
+func usesScheme(urls []string, scheme string) bool {
+	for _, u := range urls {
+		if strings.HasPrefix(u, scheme+"://") {
+			return true
+		}
+	}
+	return false
+}
+
+// onlyScheme returns true if all the given urls use the given scheme.
+func onlyScheme(urls []string, scheme string) bool {
+	for _, u := range urls {
+		if !strings.HasPrefix(u, scheme+"://") {
+			return false
+		}
+	}
+	return len(urls) > 0
+}
+
+// claimSlot puts the registration of the local member only if fewer than
+// clusterSize members are registered, or if the local member is already
+// one of them. The put is guarded by the revision of the members read, and
+// the members are read again if another member registered meanwhile.
+func (d *discovery) claimSlot(ctx context.Context, memberKey, value string, opts ...clientv3.OpOption) error {
+	membersKeyPrefix := getMemberKeyPrefix(d.keyPrefix(), d.clusterToken)
+	for {
+		cls, rev, err := d.getClusterMembers()
+		if err != nil {
+			return err
+		}
+		if !cls.exist(memberKey) && cls.voters() >= d.clusterSize {
+			return ErrFullCluster
+		}
+
+		resp, err := d.c.Txn(ctx).If(
+			clientv3.Compare(clientv3.ModRevision(membersKeyPrefix), "<", rev+1).WithPrefix(),
+		).Then(
+			clientv3.OpPut(memberKey, value, opts...),
+		).Commit()
+		if err != nil {
+			return err
+		}
+		if resp.Succeeded {
+			return nil
+		}
+		d.lg.Info(
+			"members changed while registering member itself, checking the cluster size again",
+			zap.String("memberKey", memberKey),
+		)
+	}
 }
 
 func (d *discovery) registerSelfRetry(contents string) error {
+	if err := d.canceled(); err != nil {
+		return err
+	}
 	if d.retries < nRetries {
 		d.logAndBackoffForRetry("register member itself")
-		return d.registerSelf(contents)
+		if err := d.canceled(); err != nil {
+			return err
+		}
+		return d.doRegisterSelf(contents)
 	}
 	return ErrTooManyRetries
 }
 
 func (d *discovery) registerSelf(contents string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.RequestTimeOut)
-	memberKey := getMemberKey(d.clusterToken, d.memberId.String())
-	_, err := d.c.Put(ctx, memberKey, contents)
+	defer d.observePhase(phaseRegisterSelf, d.clock.Now())
+	d.retries = 0
+	return d.doRegisterSelf(contents)
+}
+
+func (d *discovery) doRegisterSelf(contents string) error {
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+	memberKey := d.getSelfKey()
+	value := contents
+	var err error
+	if d.cfg.RegisterAsLearner {
+		if value, err = withMeta(value, metaLearner, "true"); err != nil {
+			cancel()
+			return err
+		}
+	}
+	if d.cfg.RecordRegistrationTime {
+		if value, err = withRegistrationTime(value, d.clock.Now()); err != nil {
+			cancel()
+			return err
+		}
+	}
+	if key := d.signingKey(); key != nil {
+		value = signMemberValue(key, memberKey, value)
+	}
+	var opts []clientv3.OpOption
+	registered := false
+	lease, err := d.grantLease(ctx)
+	if err == nil && !d.cfg.RecordRegistrationTime {
+		// The registration time is recorded again on each join.
+		registered = d.isRegistered(ctx, memberKey, value, lease)
+	}
+	if err == nil && !registered {
+		if lease != clientv3.NoLease {
+			opts = append(opts, clientv3.WithLease(lease))
+		}
+		if d.cfg.StrictSizeEnforcement {
+			err = d.claimSlot(ctx, memberKey, value, opts...)
+		} else {
+			_, err = d.c.Put(ctx, memberKey, value, opts...)
+		}
+	}
 	cancel()
 
+	if err == ErrFullCluster {
+		d.lg.Warn(
+			"cluster is full, not registering member itself",
+			logEvent(logEventClusterFull),
+			zap.String("phase", phaseRegisterSelf),
+			zap.String("memberKey", memberKey),
+			zap.Int("cluster-size", d.clusterSize),
+		)
+		return err
+	}
 	if err != nil {
+		d.refreshCredentials(err)
 		d.lg.Warn(
 			"failed to register members itself to the discovery service",
 			zap.String("memberKey", memberKey),
-			zap.Error(err),
+			zap.Error(d.requestError("register member itself", err)),
 		)
 		return d.registerSelfRetry(contents)
 	}
 	d.retries = 0
 
+	if registered {
+		d.lg.Info(
+			"member itself already registered",
+			logEvent(logEventRegisteredSelf),
+			zap.String("phase", phaseRegisterSelf),
+			zap.String("memberKey", memberKey),
+			zap.String("memberInfo", contents),
+		)
+	} else {
+		d.lg.Info(
+			"register member itself successfully",
+			logEvent(logEventRegisteredSelf),
+			zap.String("phase", phaseRegisterSelf),
+			zap.String("memberKey", memberKey),
+			zap.String("memberInfo", contents),
+		)
+	}
+	d.emit(DiscoveryEvent{Type: EventRegisteredSelf, Peer: contents})
+
+	return nil
+}
+
+// isRegistered returns true if the local member is already registered with
+// the given value and lease, e.g. because the join is run again after a
+// partial failure, in which case the registration is kept as is. It returns
+// false if the registration can't be read, so that the member registers
+// anyway.
+func (d *discovery) isRegistered(ctx context.Context, memberKey, value string, lease clientv3.LeaseID) bool {
+	resp, err := d.c.Get(ctx, memberKey)
+	if err != nil {
+		d.lg.Debug(
+			"failed to get the registration of member itself",
+			zap.String("memberKey", memberKey),
+			zap.Error(err),
+		)
+		return false
+	}
+	if len(resp.Kvs) == 0 {
+		return false
+	}
+
+	kv := resp.Kvs[0]
+	if string(kv.Value) != value {
+		d.lg.Warn(
+			"member itself already registered with a different value, updating it",
+			zap.String("memberKey", memberKey),
+			zap.String("previous-value", string(kv.Value)),
+			zap.String("value", value),
+		)
+		return false
+	}
+	// The registration has to be attached to the lease kept alive by this
+	// discovery, otherwise it expires with the previous one.
+	return clientv3.LeaseID(kv.Lease) == lease
+}
+
+func (d *discovery) getClusterMembersResult() (*ClusterMembers, error) {
+	clusterSize, err := d.getClusterSize(d.pollingReadOpts()...)
+	if err != nil && err != ErrSizeNotFound {
+		return nil, err
+	}
+	cls, rev, err := d.getClusterMembers(d.pollingReadOpts()...)
+	if err != nil {
+		return nil, err
+	}
+	return &ClusterMembers{
+		ClusterSize: clusterSize,
+		Revision:    rev,
+		Members:     cls.getRegisteredMembers(),
+	}, nil
+}
+
+func (d *discovery) leaveCluster() error {
+	ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+	defer cancel()
+
+	memberKey := getMemberKey(d.keyPrefix(), d.clusterToken, d.memberId.String())
+	resp, err := d.c.Delete(ctx, memberKey)
+	if err != nil {
+		d.lg.Warn(
+			"failed to deregister member from the discovery service",
+			zap.String("memberKey", memberKey),
+			zap.Error(err),
+		)
+		return err
+	}
+
+	if resp.Deleted == 0 {
+		d.lg.Info(
+			"member was not registered in the discovery service",
+			zap.String("memberKey", memberKey),
+		)
+		return nil
+	}
 	d.lg.Info(
-		"register member itself successfully",
+		"deregistered member from the discovery service",
 		zap.String("memberKey", memberKey),
-		zap.String("memberInfo", contents),
 	)
-
 	return nil
 }
 
-func (d *discovery) waitPeers(cls *clusterInfo, clusterSize int, rev int64) {
-	// watch from the next revision
-	membersKeyPrefix := getMemberKeyPrefix(d.clusterToken)
-	w := d.c.Watch(context.Background(), membersKeyPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+// grantLease returns the lease of the registration of the local member,
+// which is granted and kept alive on first use, or clientv3.NoLease if
+// RegistrationTTL is not set.
+func (d *discovery) grantLease(ctx context.Context) (clientv3.LeaseID, error) {
+	if d.cfg.RegistrationTTL <= 0 || d.lease != clientv3.NoLease {
+		return d.lease, nil
+	}
 
+	// The TTL of a lease is in seconds, rounded up.
+	ttl := int64((d.cfg.RegistrationTTL + time.Second - 1) / time.Second)
+	resp, err := d.c.Grant(ctx, ttl)
+	if err != nil {
+		return clientv3.NoLease, err
+	}
+
+	kctx, cancel := context.WithCancel(context.Background())
+	ch, err := d.c.KeepAlive(kctx, resp.ID)
+	if err != nil {
+		cancel()
+		return clientv3.NoLease, err
+	}
+	d.lease, d.stopKeepAlive = resp.ID, cancel
+
+	go func() {
+		for range ch {
+		}
+		if kctx.Err() == nil {
+			d.lg.Warn(
+				"stopped keeping alive the registration lease",
+				zap.String("lease", fmt.Sprintf("%016x", resp.ID)),
+			)
+		}
+	}()
+	d.lg.Info(
+		"granted registration lease",
+		zap.String("lease", fmt.Sprintf("%016x", resp.ID)),
+		zap.Int64("ttl", ttl),
+	)
+	return resp.ID, nil
+}
+
+// waitPeers waits for the peers until there are clusterSize members in cls.
+// The watch is reopened if it fails, so an error is only returned if the
+// context of the discovery is done, or the retries are exhausted.
+func (d *discovery) waitPeers(cls *clusterInfo, clusterSize int, rev int64) error {
+	defer d.observePhase(phaseWaitPeers, d.clock.Now())
+	d.retries = 0
 	d.lg.Info(
 		"waiting for peers from discovery service",
-		zap.Int("clusterSize", clusterSize),
+		zap.String("phase", phaseWaitPeers),
+		zap.Int("cluster-size", clusterSize),
 		zap.Int("found-peers", cls.Len()),
 	)
 
+	if d.cfg.PeerWaitTimeout > 0 {
+		d.resetPeerWait()
+		defer func() { d.peerWaitDeadline = time.Time{} }()
+	}
+
 	// waiting for peers until all needed peers are returned
-	for wresp := range w {
-		for _, ev := range wresp.Events {
-			mKey := strings.TrimSpace(string(ev.Kv.Key))
-			mValue := strings.TrimSpace(string(ev.Kv.Value))
+	for {
+		found := cls.Len()
+		err := d.watchPeers(d.context(), cls, rev, func() bool {
+			return cls.voters() >= clusterSize
+		})
+		if cls.voters() >= clusterSize {
+			break
+		}
+		if err := d.canceled(); err != nil {
+			return err
+		}
+		if err == errPeerWaitTimeout {
+			d.lg.Warn(
+				"timed out waiting for peers from discovery service",
+				zap.String("phase", phaseWaitPeers),
+				zap.Int("cluster-size", clusterSize),
+				zap.Int("found-peers", cls.Len()),
+				zap.Duration("peer-wait-timeout", d.cfg.PeerWaitTimeout),
+			)
+			return &IncompleteClusterError{Result: &ClusterResult{
+				ClusterToken: cls.clusterToken,
+				ClusterSize:  clusterSize,
+				Members:      cls.getRegisteredMembers(),
+			}}
+		}
+		if cls.Len() > found {
+			d.retries = 0
+		}
 
-			if err := cls.add(mKey, mValue, ev.Kv.CreateRevision); err != nil {
-				d.lg.Warn(
-					err.Error(),
-					zap.String("memberKey", mKey),
-					zap.String("memberInfo", mValue),
-				)
-			} else {
+		if err == rpctypes.ErrCompacted {
+			d.lg.Warn(
+				"watch revision compacted, reading peers from discovery service again",
+				zap.Int64("revision", rev+1),
+			)
+		} else {
+			// The watch channel is closed, e.g. because the connection is
+			// reset, so the watch is reopened after a backoff in order not
+			// to spin while the discovery service is unavailable.
+			d.lg.Warn(
+				"watch closed before all peers were found",
+				zap.Int("found-peers", cls.Len()),
+				zap.Error(err),
+			)
+			if err := d.watchPeersRetry(); err != nil {
+				return err
+			}
+		}
+
+		// The members registered while the watch was down, or in the
+		// compacted revisions, are read before watching again from the
+		// current revision.
+		newRev, err := d.readClusterMembers(cls)
+		for err != nil {
+			if err := d.watchPeersRetry(); err != nil {
+				return err
+			}
+			newRev, err = d.readClusterMembers(cls)
+		}
+		rev = newRev
+	}
+
+	d.lg.Info(
+		"found all needed peers from discovery service",
+		logEvent(logEventPeersComplete),
+		zap.String("phase", phaseWaitPeers),
+		zap.Int("cluster-size", clusterSize),
+		zap.Int("found-peers", cls.Len()),
+	)
+	return nil
+}
+
+// resetPeerWait restarts PeerWaitTimeout from now.
+func (d *discovery) resetPeerWait() {
+	d.peerWaitDeadline = d.clock.Now().Add(d.cfg.PeerWaitTimeout)
+}
+
+// watchPeersRetry backs off before watching the peers again, and returns
+// an error if the discovery should give up instead.
+func (d *discovery) watchPeersRetry() error {
+	if d.retries >= nRetries {
+		return ErrTooManyRetries
+	}
+	d.logAndBackoffForRetry("watch peers")
+	return d.canceled()
+}
+
+// watchPeers watches the member prefix from the next revision of rev, and
+// adds each member found into cls until done returns true or the watch
+// channel is closed. The error of the watch, e.g. rpctypes.ErrCompacted,
+// is returned if it fails, and errPeerWaitTimeout if no new peer is found
+// before peerWaitDeadline.
+func (d *discovery) watchPeers(ctx context.Context, cls *clusterInfo, rev int64, done func() bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// watch from the next revision
+	membersKeyPrefix := getMemberKeyPrefix(d.keyPrefix(), d.clusterToken)
+	w := d.c.Watch(ctx, membersKeyPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1), clientv3.WithProgressNotify())
+
+	progressRequested := false
+	for {
+		var idle, peerWait <-chan time.Time
+		if d.cfg.WatchIdleInterval > 0 {
+			idle = d.clock.After(d.cfg.WatchIdleInterval)
+		}
+		if !d.peerWaitDeadline.IsZero() {
+			peerWait = d.clock.After(d.peerWaitDeadline.Sub(d.clock.Now()))
+		}
+
+		select {
+		case wresp, ok := <-w:
+			if !ok {
+				return nil
+			}
+			progressRequested = false
+			if wresp.IsProgressNotify() {
 				d.lg.Info(
-					"found peer from discovery service",
-					zap.String("memberKey", mKey),
-					zap.String("memberInfo", mValue),
+					"discovery watch is alive, still waiting for peers",
+					zap.Int("found-peers", cls.Len()),
+					zap.Int64("revision", wresp.Header.Revision),
 				)
+				continue
+			}
+			for _, ev := range wresp.Events {
+				d.addPeer(cls, ev.Kv)
+			}
+
+			if done() {
+				return nil
+			}
+			if err := wresp.Err(); err != nil {
+				return err
 			}
+
+		case <-idle:
+			if progressRequested {
+				d.lg.Warn(
+					"discovery watch didn't answer the progress request",
+					zap.Duration("idle-interval", d.cfg.WatchIdleInterval),
+				)
+				return errWatchStalled
+			}
+			if err := d.c.RequestProgress(ctx); err != nil {
+				return err
+			}
+			progressRequested = true
+
+		case <-peerWait:
+			return errPeerWaitTimeout
 		}
+	}
+}
 
-		if cls.Len() >= clusterSize {
-			break
+// addPeer adds the member represented by the given key-value into cls.
+func (d *discovery) addPeer(cls *clusterInfo, kv *mvccpb.KeyValue) {
+	mKey := strings.TrimSpace(string(kv.Key))
+	mValue := strings.TrimSpace(string(kv.Value))
+
+	switch err := cls.add(mKey, mValue, kv.CreateRevision); err {
+	case nil:
+		cls.updateModRev(mKey, kv.ModRevision)
+	case errRedeliveredPeer:
+		// It may be a re-registration of the member as well.
+		cls.updateModRev(mKey, kv.ModRevision)
+		d.lg.Debug(
+			"ignored peer already found from discovery service",
+			zap.String("memberKey", mKey),
+			zap.Int64("createRevision", kv.CreateRevision),
+			zap.Int64("modRevision", kv.ModRevision),
+		)
+		return
+	default:
+		if errors.Is(err, ErrDuplicateName) {
+			// The member replaced the one registered later with the
+			// same name, if it registered first.
+			cls.updateModRev(mKey, kv.ModRevision)
 		}
+		d.lg.Warn(
+			err.Error(),
+			zap.String("memberKey", mKey),
+			zap.String("memberInfo", mValue),
+		)
+		return
 	}
 
 	d.lg.Info(
-		"found all needed peers from discovery service",
-		zap.Int("clusterSize", clusterSize),
+		"found peer from discovery service",
+		logEvent(logEventPeerFound),
+		zap.String("memberKey", mKey),
+		zap.String("memberInfo", mValue),
 		zap.Int("found-peers", cls.Len()),
+		zap.Int("cluster-size", d.clusterSize),
 	)
+	d.metrics.setPeersFound(cls.Len())
+	if !d.peerWaitDeadline.IsZero() {
+		d.resetPeerWait()
+	}
+	if d.cfg.OnPeerFound != nil {
+		d.cfg.OnPeerFound(cls.Len(), d.clusterSize, mValue)
+	}
+	d.emit(DiscoveryEvent{Type: EventPeerJoined, Peer: mValue, PeersFound: cls.Len()})
 }
 
 func (d *discovery) logAndBackoffForRetry(step string) {
 	d.retries++
-	// logAndBackoffForRetry stops exponential backoff when the retries are
-	// more than maxExpoentialRetries and is set to a constant backoff afterward.
-	retries := d.retries
-	if retries > maxExponentialRetries {
-		retries = maxExponentialRetries
+	d.totalRetries++
+	if d.retries > d.peakRetries {
+		d.peakRetries = d.retries
 	}
-	retryTimeInSecond := time.Duration(0x1<<retries) * time.Second
+	retryTimeInSecond := d.jitter(d.backoff())
 	d.lg.Warn(
 		"retry connecting to discovery service",
+		logEvent(logEventRetry),
+		zap.String("phase", retryPhases[step]),
 		zap.String("reason", step),
+		zap.Uint("retries", d.retries),
 		zap.Duration("backoff", retryTimeInSecond),
 	)
-	d.clock.Sleep(retryTimeInSecond)
+	d.metrics.retried(retryPhases[step])
+	d.emit(DiscoveryEvent{Type: EventRetrying, Reason: step, Backoff: retryTimeInSecond})
+	d.sleep(retryTimeInSecond)
+}
+
+// backoff returns the backoff before the next retry, which grows
+// exponentially from BaseBackoffInterval with the retries until it reaches
+// the configured MaxBackoffInterval, or 2^maxExponentialRetries times
+// BaseBackoffInterval by default, and is constant afterward.
+func (d *discovery) backoff() time.Duration {
+	backoff := d.cfg.BaseBackoffInterval
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	max := d.cfg.MaxBackoffInterval
+	if max <= 0 {
+		max = backoff << maxExponentialRetries
+	}
+	// The backoff is doubled one retry at a time, up to the cap.
+	for i := uint(0); i < d.retries && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// jitter returns a random duration in [0, backoff], or backoff itself if
+// the jitter is disabled.
+func (d *discovery) jitter(backoff time.Duration) time.Duration {
+	if d.rand == nil || backoff <= 0 {
+		return backoff
+	}
+	return time.Duration(d.rand.Int63n(int64(backoff) + 1))
 }
 
 func (d *discovery) close() error {
+	if d.stop != nil {
+		d.stop()
+	}
+	if d.stopKeepAlive != nil {
+		d.stopKeepAlive()
+	}
 	if d.c != nil {
 		return d.c.Close()
 	}
@@ -505,15 +2020,38 @@ func (d *discovery) close() error {
 }
 
 func (cls *clusterInfo) Len() int { return len(cls.members) }
+
+// voters returns the number of voting members, i.e. the members counting
+// toward the cluster size.
+func (cls *clusterInfo) voters() int {
+	n := 0
+	for _, m := range cls.members {
+		if !m.learner {
+			n++
+		}
+	}
+	return n
+}
+
+// Less orders the members by createRev, and by registry key if they have
+// the same createRev, so that all the members compute the same order.
 func (cls *clusterInfo) Less(i, j int) bool {
-	return cls.members[i].createRev < cls.members[j].createRev
+	if cls.members[i].createRev != cls.members[j].createRev {
+		return cls.members[i].createRev < cls.members[j].createRev
+	}
+	return cls.members[i].peerRegKey < cls.members[j].peerRegKey
 }
 func (cls *clusterInfo) Swap(i, j int) {
 	cls.members[i], cls.members[j] = cls.members[j], cls.members[i]
 }
 
+// add adds the member registered under memberKey at the revision rev.
+// memberValue is parsed with ParseMemberValue, so besides the values without
+// '=', a value with more than one name, an empty name or an invalid peer URL
+// is rejected too; the callers log and skip such a registration, instead of
+// failing the bootstrap later when the initial cluster is parsed.
 func (cls *clusterInfo) add(memberKey, memberValue string, rev int64) error {
-	membersKeyPrefix := getMemberKeyPrefix(cls.clusterToken)
+	membersKeyPrefix := getMemberKeyPrefix(cls.keyPrefix, cls.clusterToken)
 
 	if !strings.HasPrefix(memberKey, membersKeyPrefix) {
 		// It should never happen because previously we used exactly the
@@ -521,20 +2059,57 @@ func (cls *clusterInfo) add(memberKey, memberValue string, rev int64) error {
 		return errors.New("invalid peer registry key")
 	}
 
-	if strings.IndexRune(memberValue, '=') == -1 {
-		// It must be in the format "member1=http://127.0.0.1:2380".
-		return errors.New("invalid peer info returned from discovery service")
+	if cls.signingKey != nil {
+		v, err := verifyMemberValue(cls.signingKey, memberKey, memberValue)
+		if err != nil {
+			return err
+		}
+		memberValue = v
+	}
+
+	name, peerURLs, meta, err := ParseMemberValue(memberValue)
+	if err != nil {
+		return err
 	}
+	memberValue = legacyMemberValue(name, peerURLs)
 
-	if cls.exist(memberKey) {
+	for _, m := range cls.members {
+		if m.peerRegKey != memberKey {
+			continue
+		}
+		if m.createRev == rev {
+			// The same registration was delivered again, e.g. after the
+			// watch was re-established.
+			return errRedeliveredPeer
+		}
 		return errors.New("found duplicate peer from discovery service")
 	}
 
-	cls.members = append(cls.members, memberInfo{
+	m := memberInfo{
 		peerRegKey:  memberKey,
 		peerURLsMap: memberValue,
 		createRev:   rev,
-	})
+		clientURLs:  meta[metaClientURLs],
+		learner:     meta[metaLearner] == "true",
+	}
+	if t, err := time.Parse(time.RFC3339, meta[metaRegisteredAt]); err == nil {
+		m.registeredAt = t.Unix()
+	}
+	for i, o := range cls.members {
+		if oName, _, _, _ := ParseMemberValue(o.peerURLsMap); oName != name {
+			continue
+		}
+		// Keep the member which registered first, regardless of the order
+		// the registrations are read in, with the same tie-break as Less.
+		if o.createRev < rev || (o.createRev == rev && o.peerRegKey < memberKey) {
+			return fmt.Errorf("%w: %q registered by %s, rejected %s", ErrDuplicateName, name, o.peerRegKey, memberKey)
+		}
+		cls.members[i] = m
+		sort.Sort(cls)
+		return fmt.Errorf("%w: %q registered by %s, rejected %s", ErrDuplicateName, name, memberKey, o.peerRegKey)
+	}
+
+	cls.members = append(cls.members, m)
 
 	// When multiple members register at the same time, then number of
 	// registered members may be larger than the configured cluster size.
@@ -545,6 +2120,41 @@ func (cls *clusterInfo) add(memberKey, memberValue string, rev int64) error {
 	return nil
 }
 
+// remove removes the member with the given registry key, if it exists.
+func (cls *clusterInfo) remove(mKey string) {
+	for i, m := range cls.members {
+		if mKey == m.peerRegKey {
+			cls.members = append(cls.members[:i], cls.members[i+1:]...)
+			return
+		}
+	}
+}
+
+// isSeed returns true if the member with the given registry key is the
+// seed of the cluster, i.e. the voting member with the lowest CreateRevision
+// among the first ${clusterSize} voting members.
+func (cls *clusterInfo) isSeed(mKey string, clusterSize int) bool {
+	if clusterSize <= 0 || cls.voters() < clusterSize {
+		return false
+	}
+	for _, m := range cls.members {
+		if !m.learner {
+			return m.peerRegKey == mKey
+		}
+	}
+	return false
+}
+
+// updateModRev records the given ModRevision of the member with the given
+// registry key, if it is newer than the one recorded.
+func (cls *clusterInfo) updateModRev(mKey string, modRev int64) {
+	for i := range cls.members {
+		if cls.members[i].peerRegKey == mKey && modRev > cls.members[i].modRev {
+			cls.members[i].modRev = modRev
+		}
+	}
+}
+
 func (cls *clusterInfo) exist(mKey string) bool {
 	// Usually there are just a couple of members, so performance shouldn't be a problem.
 	for _, m := range cls.members {
@@ -555,22 +2165,223 @@ func (cls *clusterInfo) exist(mKey string) bool {
 	return false
 }
 
-func (cls *clusterInfo) getInitClusterStr(clusterSize int) (string, error) {
-	peerURLs := cls.getPeerURLs()
+// existName returns true if a member registered with the given name.
+func (cls *clusterInfo) existName(name string) bool {
+	for _, m := range cls.members {
+		// The values have been validated when the members were added.
+		if n, _, _, _ := ParseMemberValue(m.peerURLsMap); n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// selected returns the first ${clusterSize} voting members, which are the
+// members of the cluster to bootstrap.
+func (cls *clusterInfo) selected(clusterSize int) ([]memberInfo, error) {
+	all, err := cls.selectedWithLearners(clusterSize)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]memberInfo, 0, clusterSize)
+	for _, m := range all {
+		if !m.learner {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+// selectedWithLearners returns the members up to the ${clusterSize}th voting
+// member, i.e. the selected voting members and the learners which registered
+// before the cluster was complete.
+func (cls *clusterInfo) selectedWithLearners(clusterSize int) ([]memberInfo, error) {
+	n := 0
+	for i, m := range cls.members {
+		if n == clusterSize {
+			return cls.members[:i], nil
+		}
+		if !m.learner {
+			n++
+		}
+	}
 
-	if len(peerURLs) > clusterSize {
-		peerURLs = peerURLs[:clusterSize]
+	// The selected members must exactly match the configured cluster size,
+	// otherwise the resulting cluster may never be able to achieve quorum.
+	if n < clusterSize {
+		return nil, ErrInsufficientMembers
+	}
+	return cls.members, nil
+}
+
+func (cls *clusterInfo) getInitClusterStr(clusterSize int) (string, error) {
+	members, err := cls.selected(clusterSize)
+	if err != nil {
+		return "", err
 	}
 
+	var peerURLs []string
+	for _, m := range members {
+		peerURLs = append(peerURLs, m.peerURLsMap)
+	}
 	us := strings.Join(peerURLs, ",")
-	_, err := types.NewURLsMap(us)
+	_, err = types.NewURLsMap(us)
 	if err != nil {
 		return us, ErrInvalidURL
 	}
+	if err := cls.checkPeerScheme(members); err != nil {
+		return us, err
+	}
 
 	return us, nil
 }
 
+// checkPeerScheme checks that the peer URLs of the given members use the
+// expected peerScheme, if any.
+func (cls *clusterInfo) checkPeerScheme(members []memberInfo) error {
+	if cls.peerScheme == "" {
+		return nil
+	}
+	for _, m := range members {
+		name, peerURLs, _, err := ParseMemberValue(m.peerURLsMap)
+		if err != nil {
+			return err
+		}
+		for _, u := range peerURLs {
+			pu, err := url.Parse(u)
+			if err != nil {
+				return err
+			}
+			if pu.Scheme != cls.peerScheme {
+				return fmt.Errorf("%w: member %q (%s) has peer URL %q, expected the %s scheme", ErrSchemeMismatch, name, m.peerRegKey, u, cls.peerScheme)
+			}
+		}
+	}
+	return nil
+}
+
+// ValidateInitialCluster checks that the given string, in the same format
+// as "--initial-cluster", is what discovery could have built, i.e.
+//   - each entry is in the format "name=peerURL", and all peer URLs are valid;
+//   - the entries of each member are adjacent, so no two members share a name;
+//   - all peer URLs use the same scheme, which must be "https" unless
+//     insecure is true.
+func ValidateInitialCluster(s string, insecure bool) error {
+	if _, err := types.NewURLsMap(s); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+
+	seen := make(map[string]bool)
+	prevName, scheme := "", ""
+	for _, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("%w: %q is not in the format \"name=peerURL\"", ErrInvalidURL, entry)
+		}
+		name := kv[0]
+		if name != prevName && seen[name] {
+			return fmt.Errorf("%w: %q", ErrDuplicateName, name)
+		}
+		seen[name], prevName = true, name
+
+		u, err := url.Parse(kv[1])
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidURL, err)
+		}
+		if scheme == "" {
+			scheme = u.Scheme
+			if !insecure && scheme != "https" {
+				return fmt.Errorf("%w: member %q uses scheme %q, expected \"https\"", ErrSchemeMismatch, name, scheme)
+			}
+		} else if u.Scheme != scheme {
+			return fmt.Errorf("%w: member %q uses scheme %q, expected %q", ErrSchemeMismatch, name, u.Scheme, scheme)
+		}
+	}
+	return nil
+}
+
+// getClusterResult returns the members selected for the cluster, including
+// the learners, which are validated the same way as by getInitClusterStr.
+func (cls *clusterInfo) getClusterResult(clusterSize int) (*ClusterResult, error) {
+	if _, err := cls.getInitClusterStr(clusterSize); err != nil {
+		return nil, err
+	}
+	members, err := cls.selectedWithLearners(clusterSize)
+	if err != nil {
+		return nil, err
+	}
+	return &ClusterResult{
+		ClusterToken: cls.clusterToken,
+		ClusterSize:  clusterSize,
+		Members:      cls.getRegisteredMembers()[:len(members)],
+	}, nil
+}
+
+func (cls *clusterInfo) getRegisteredMembers() []RegisteredMember {
+	members := make([]RegisteredMember, 0, len(cls.members))
+	for _, m := range cls.members {
+		// The values have been validated when the members were added.
+		name, peerURLs, _, _ := ParseMemberValue(m.peerURLsMap)
+		var id types.ID
+		if !cls.keyByName {
+			id, _ = types.IDFromString(path.Base(m.peerRegKey))
+		}
+		var registeredAt time.Time
+		if m.registeredAt != 0 {
+			registeredAt = time.Unix(m.registeredAt, 0)
+		}
+		members = append(members, RegisteredMember{
+			Key:            m.peerRegKey,
+			ID:             id,
+			Name:           name,
+			PeerURLs:       peerURLs,
+			CreateRevision: m.createRev,
+			ModRevision:    m.modRev,
+			RegisteredAt:   registeredAt,
+			IsLearner:      m.learner,
+		})
+	}
+	return members
+}
+
+// getMemberAddPlan returns the selected members in ascending CreateRevision
+// order.
+func (cls *clusterInfo) getMemberAddPlan(clusterSize int) ([]MemberAddStep, error) {
+	members, err := cls.selected(clusterSize)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := make([]MemberAddStep, 0, len(members))
+	for _, member := range members {
+		name, peerURLs, _, err := ParseMemberValue(member.peerURLsMap)
+		if err != nil {
+			return nil, err
+		}
+		plan = append(plan, MemberAddStep{Name: name, PeerURLs: peerURLs})
+	}
+	return plan, nil
+}
+
+// getPeerURLsByMember returns the peer URLs of each selected member, keyed
+// by member name.
+func (cls *clusterInfo) getPeerURLsByMember(clusterSize int) (map[string][]string, error) {
+	members, err := cls.selected(clusterSize)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string][]string, len(members))
+	for _, member := range members {
+		name, peerURLs, _, err := ParseMemberValue(member.peerURLsMap)
+		if err != nil {
+			return nil, err
+		}
+		m[name] = append(m[name], peerURLs...)
+	}
+	return m, nil
+}
+
 func (cls *clusterInfo) getPeerURLs() []string {
 	var peerURLs []string
 	for _, peer := range cls.members {
@@ -4,15 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"go.etcd.io/etcd/client/pkg/v3/types"
 	"go.etcd.io/etcd/client/v3"
 
 	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
 )
 
 // fakeKVForClusterSize is used to test getClusterSize.
@@ -91,6 +102,87 @@ func TestGetClusterSize(t *testing.T) {
 	}
 }
 
+// fakeKVForRequestError is used to test the errors returned by the requests
+// to the discovery service.
+type fakeKVForRequestError struct {
+	*fakeBaseKV
+	err error
+}
+
+// We only need to overwrite method `Get`.
+func (fkv *fakeKVForRequestError) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return nil, fkv.err
+}
+
+func TestRequestError(t *testing.T) {
+	expiredCtx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	cases := []struct {
+		name            string
+		ctx             context.Context
+		err             error
+		expectedTimeout bool
+	}{
+		{
+			name:            "request timed out",
+			err:             context.DeadlineExceeded,
+			expectedTimeout: true,
+		},
+		{
+			name:            "request timed out on the server side",
+			err:             rpctypes.ErrGRPCTimeout,
+			expectedTimeout: false,
+		},
+		{
+			name:            "discovery timed out",
+			ctx:             expiredCtx,
+			err:             context.DeadlineExceeded,
+			expectedTimeout: false,
+		},
+		{
+			name:            "request rejected",
+			err:             rpctypes.ErrGRPCPermissionDenied,
+			expectedTimeout: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg:  zap.NewNop(),
+				ctx: tc.ctx,
+				c: &clientv3.Client{
+					KV: &fakeKVForRequestError{
+						fakeBaseKV: &fakeBaseKV{},
+						err:        tc.err,
+					},
+				},
+				cfg:          &DiscoveryConfig{RequestTimeOut: time.Second},
+				clusterToken: "fakeToken",
+			}
+
+			_, sizeErr := d.getClusterSize()
+			_, _, membersErr := d.getClusterMembers()
+			for op, err := range map[string]error{"get cluster size": sizeErr, "get cluster members": membersErr} {
+				if !tc.expectedTimeout {
+					if err != tc.err {
+						t.Errorf("Unexpected error for %q, expected: %v, got: %v", op, tc.err, err)
+					}
+					continue
+				}
+				var rtErr *RequestTimeoutError
+				if !errors.As(err, &rtErr) || !errors.Is(err, ErrRequestTimeout) {
+					t.Fatalf("Unexpected error for %q, expected a RequestTimeoutError, got: %v", op, err)
+				}
+				if rtErr.Op != op || rtErr.Timeout != time.Second {
+					t.Errorf("Unexpected request timeout error, expected op %q and timeout %v, got: %+v", op, time.Second, rtErr)
+				}
+			}
+		})
+	}
+}
+
 // fakeKVForClusterMembers is used to test getClusterMembers.
 type fakeKVForClusterMembers struct {
 	*fakeBaseKV
@@ -116,6 +208,7 @@ func memberInfoToKeyValues(members []memberInfo) []*mvccpb.KeyValue {
 			Key:            []byte(mi.peerRegKey),
 			Value:          []byte(mi.peerURLsMap),
 			CreateRevision: mi.createRev,
+			ModRevision:    mi.modRev,
 		})
 	}
 
@@ -255,6 +348,14 @@ func (fkv *fakeKVForCheckCluster) Get(ctx context.Context, key string, opts ...c
 			},
 			Kvs: kvs,
 		}, nil
+	} else if strings.HasPrefix(key, clusterMembersKey+"/") {
+		// the registration of a single member.
+		for _, kv := range memberInfoToKeyValues(fkv.members) {
+			if string(kv.Key) == key {
+				return &clientv3.GetResponse{Kvs: []*mvccpb.KeyValue{kv}}, nil
+			}
+		}
+		return &clientv3.GetResponse{}, nil
 	} else {
 		fkv.t.Errorf("unexpected key: %s", key)
 		return nil, fmt.Errorf("unexpected key: %s", key)
@@ -406,6 +507,196 @@ func TestCheckCluster(t *testing.T) {
 	}
 }
 
+func TestCheckClusterSelfRank(t *testing.T) {
+	var members []memberInfo
+	for i, id := range []types.ID{101, 102, 103, 104} {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + id.String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.%d:2380", id, id),
+			createRev:   int64(10 + i),
+		})
+	}
+
+	cases := []struct {
+		name          string
+		members       []memberInfo
+		memberId      types.ID
+		expectedError error
+	}{
+		{
+			name:     "self is the first member",
+			members:  members,
+			memberId: 101,
+		},
+		{
+			name:     "self is exactly the clusterSize-th member",
+			members:  members,
+			memberId: 103,
+		},
+		{
+			name:          "self is after the clusterSize-th member",
+			members:       members,
+			memberId:      104,
+			expectedError: ErrFullCluster,
+		},
+		{
+			name:     "self registered last after earlier members left",
+			members:  []memberInfo{members[0], members[3]},
+			memberId: 104,
+		},
+		{
+			name:     "self not registered with a free slot",
+			members:  members[:2],
+			memberId: 105,
+		},
+		{
+			name:          "self not registered in a full cluster",
+			members:       members[:3],
+			memberId:      105,
+			expectedError: ErrFullCluster,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForCheckCluster{
+						fakeBaseKV:     &fakeBaseKV{},
+						t:              t,
+						token:          "fakeToken",
+						clusterSizeStr: "3",
+						members:        tc.members,
+					},
+				},
+				cfg:          &DiscoveryConfig{},
+				clusterToken: "fakeToken",
+				memberId:     tc.memberId,
+				clock:        clockwork.NewRealClock(),
+			}
+
+			if _, _, _, err := d.checkCluster(); err != tc.expectedError {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+// fakeKVForReauth fails the reads with an authentication error until the
+// client sends the token of the expected user.
+type fakeKVForReauth struct {
+	*fakeKVForCheckCluster
+	authToken *authTokenCredential
+	user      string
+}
+
+func (fkv *fakeKVForReauth) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if fkv.authToken.getToken() != fakeAuthToken(fkv.user) {
+		return nil, rpctypes.ErrAuthFailed
+	}
+	return fkv.fakeKVForCheckCluster.Get(ctx, key, opts...)
+}
+
+// fakeAuthForReauth returns the token of the given user.
+type fakeAuthForReauth struct {
+	clientv3.Auth
+}
+
+func (fa *fakeAuthForReauth) Authenticate(ctx context.Context, name string, password string) (*clientv3.AuthenticateResponse, error) {
+	return &clientv3.AuthenticateResponse{Token: fakeAuthToken(name)}, nil
+}
+
+func fakeAuthToken(user string) string {
+	return "token-" + user
+}
+
+// fakeCredentialsProvider returns the given credentials, and counts the
+// calls.
+type fakeCredentialsProvider struct {
+	user, pass string
+	calls      int
+}
+
+func (p *fakeCredentialsProvider) GetCredentials(ctx context.Context) (string, string, error) {
+	p.calls++
+	return p.user, p.pass, nil
+}
+
+func TestCheckClusterRefreshCredentials(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	defer advanceClock(fc)()
+
+	authToken := &authTokenCredential{token: fakeAuthToken("root")}
+	c := &clientv3.Client{
+		KV: &fakeKVForReauth{
+			fakeKVForCheckCluster: &fakeKVForCheckCluster{
+				fakeBaseKV:     &fakeBaseKV{},
+				t:              t,
+				token:          "fakeToken",
+				clusterSizeStr: "3",
+			},
+			authToken: authToken,
+			user:      "rotated",
+		},
+		Auth: &fakeAuthForReauth{},
+	}
+	provider := &fakeCredentialsProvider{user: "rotated", pass: "new"}
+
+	d := &discovery{
+		lg:           zap.NewNop(),
+		c:            c,
+		cfg:          &DiscoveryConfig{Credentials: provider},
+		authToken:    authToken,
+		clusterToken: "fakeToken",
+		clock:        fc,
+	}
+
+	if _, _, _, err := d.checkCluster(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if provider.calls != 1 {
+		t.Errorf("Unexpected calls to the credentials provider, expected: 1, got: %d", provider.calls)
+	}
+	if token := authToken.getToken(); token != fakeAuthToken("rotated") {
+		t.Errorf("Unexpected auth token, expected: %s, got: %s", fakeAuthToken("rotated"), token)
+	}
+}
+
+func TestAuthTokenCredential(t *testing.T) {
+	c := &authTokenCredential{}
+	md, err := c.GetRequestMetadata(context.Background())
+	if err != nil || len(md) != 0 {
+		t.Errorf("Unexpected metadata without a token: %v, %v", md, err)
+	}
+
+	c.setToken("token")
+	md, err = c.GetRequestMetadata(context.Background())
+	if err != nil || md[rpctypes.TokenFieldNameGRPC] != "token" {
+		t.Errorf("Unexpected metadata with a token: %v, %v", md, err)
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	cases := []struct {
+		err    error
+		expect bool
+	}{
+		{rpctypes.ErrGRPCAuthFailed, true},
+		{rpctypes.ErrGRPCInvalidAuthToken, true},
+		{rpctypes.ErrAuthOldRevision, true},
+		{rpctypes.ErrUserEmpty, true},
+		{rpctypes.ErrGRPCPermissionDenied, false},
+		{errors.New("get cluster size failed"), false},
+	}
+
+	for _, tc := range cases {
+		if got := isAuthError(tc.err); got != tc.expect {
+			t.Errorf("Unexpected result for %v, expected: %t, got: %t", tc.err, tc.expect, got)
+		}
+	}
+}
+
 // fakeKVForRegisterSelf is used to test registerSelf.
 type fakeKVForRegisterSelf struct {
 	*fakeBaseKV
@@ -506,240 +797,3498 @@ func TestRegisterSelf(t *testing.T) {
 	}
 }
 
-// fakeWatcherForWaitPeers is used to test waitPeers.
-type fakeWatcherForWaitPeers struct {
-	*fakeBaseWatcher
-	t       *testing.T
-	token   string
-	members []memberInfo
+// fakeKVForRegisterSelfWithTTL is used to test registerSelf with a
+// registration TTL.
+type fakeKVForRegisterSelfWithTTL struct {
+	*fakeBaseKV
+	puts    int
+	putOpts int
 }
 
-// We only need to overwrite method `Watch`.
-func (fw *fakeWatcherForWaitPeers) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
-	expectedWatchKey := fmt.Sprintf("/_etcd/registry/%s/members", fw.token)
-	if key != expectedWatchKey {
-		fw.t.Errorf("unexpected watch key, expected: %s, got: %s", expectedWatchKey, key)
-	}
+func (fkv *fakeKVForRegisterSelfWithTTL) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	fkv.puts++
+	fkv.putOpts = len(opts)
+	return nil, nil
+}
 
-	ch := make(chan clientv3.WatchResponse, 1)
+// fakeLeaseForRegisterSelf only implements `Grant` and `KeepAlive`.
+type fakeLeaseForRegisterSelf struct {
+	clientv3.Lease
+	grantedTTLs  []int64
+	keepAliveCtx context.Context
+	keepAliveID  clientv3.LeaseID
+}
+
+func (fl *fakeLeaseForRegisterSelf) Grant(ctx context.Context, ttl int64) (*clientv3.LeaseGrantResponse, error) {
+	fl.grantedTTLs = append(fl.grantedTTLs, ttl)
+	return &clientv3.LeaseGrantResponse{ID: 42, TTL: ttl}, nil
+}
+
+func (fl *fakeLeaseForRegisterSelf) KeepAlive(ctx context.Context, id clientv3.LeaseID) (<-chan *clientv3.LeaseKeepAliveResponse, error) {
+	fl.keepAliveCtx, fl.keepAliveID = ctx, id
+	ch := make(chan *clientv3.LeaseKeepAliveResponse)
 	go func() {
-		for _, mi := range fw.members {
-			ch <- clientv3.WatchResponse{
-				Events: []*clientv3.Event{
-					{
-						Kv: &mvccpb.KeyValue{
-							Key:            []byte(mi.peerRegKey),
-							Value:          []byte(mi.peerURLsMap),
-							CreateRevision: mi.createRev,
-						},
-					},
-				},
-			}
-		}
+		<-ctx.Done()
 		close(ch)
 	}()
-	return ch
+	return ch, nil
 }
 
-func TestWaitPeers(t *testing.T) {
-	actualMemberInfo := []memberInfo{
-		{
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
-			peerURLsMap: "infra1=http://192.168.0.100:2380",
-			createRev:   8,
-		},
-		{
-			// invalid peer registry key
-			peerRegKey:  "/invalidPrefix/fakeToken/members/" + types.ID(102).String(),
-			peerURLsMap: "infra2=http://192.168.0.102:2380",
-			createRev:   6,
-		},
+// fakeKVForClaimSlot is used to test registerSelf with
+// StrictSizeEnforcement.
+type fakeKVForClaimSlot struct {
+	*fakeKVForCheckCluster
+	// racer, if set, registers right before the first transaction, which
+	// fails then.
+	racer *memberInfo
+	txns  int
+	puts  []string
+}
+
+func (fkv *fakeKVForClaimSlot) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxnForClaimSlot{fkv: fkv}
+}
+
+type fakeTxnForClaimSlot struct {
+	fkv *fakeKVForClaimSlot
+	ops []clientv3.Op
+}
+
+func (txn *fakeTxnForClaimSlot) If(cs ...clientv3.Cmp) clientv3.Txn   { return txn }
+func (txn *fakeTxnForClaimSlot) Else(ops ...clientv3.Op) clientv3.Txn { return txn }
+func (txn *fakeTxnForClaimSlot) Then(ops ...clientv3.Op) clientv3.Txn {
+	txn.ops = ops
+	return txn
+}
+
+func (txn *fakeTxnForClaimSlot) Commit() (*clientv3.TxnResponse, error) {
+	fkv := txn.fkv
+	fkv.txns++
+	if fkv.racer != nil {
+		fkv.members = append(fkv.members, *fkv.racer)
+		fkv.racer = nil
+		return &clientv3.TxnResponse{Succeeded: false}, nil
+	}
+	for _, op := range txn.ops {
+		fkv.puts = append(fkv.puts, string(op.KeyBytes()))
+	}
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func TestRegisterSelfWithStrictSizeEnforcement(t *testing.T) {
+	newMember := func(id int) memberInfo {
+		return memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(id).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.%d:2380", id, id),
+			createRev:   int64(id),
+		}
+	}
+	selfKey := "/_etcd/registry/fakeToken/members/" + types.ID(104).String()
+	racer := newMember(103)
+	self := newMember(104)
+	self.peerURLsMap = "infra104=http://10.0.0.104:2380"
+
+	cases := []struct {
+		name          string
+		members       []memberInfo
+		racer         *memberInfo
+		expectedError error
+		expectedTxns  int
+	}{
 		{
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
-			peerURLsMap: "infra2=http://192.168.0.102:2380",
-			createRev:   6,
+			name:         "cluster not full",
+			members:      []memberInfo{newMember(101)},
+			expectedTxns: 1,
 		},
 		{
-			// invalid peer info format
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
-			peerURLsMap: "http://192.168.0.102:2380",
-			createRev:   6,
+			name:          "cluster full",
+			members:       []memberInfo{newMember(101), newMember(102), newMember(103)},
+			expectedError: ErrFullCluster,
 		},
 		{
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
-			peerURLsMap: "infra3=http://192.168.0.103:2380",
-			createRev:   7,
+			name:          "cluster filled concurrently",
+			members:       []memberInfo{newMember(101), newMember(102)},
+			racer:         &racer,
+			expectedError: ErrFullCluster,
+			expectedTxns:  1,
 		},
 		{
-			// duplicate peer
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
-			peerURLsMap: "infra1=http://192.168.0.100:2380",
-			createRev:   2,
+			name:         "member already registered with another value",
+			members:      []memberInfo{newMember(101), newMember(102), self},
+			expectedTxns: 1,
 		},
 	}
 
-	// sort by CreateRevision
-	expectedMemberInfo := []memberInfo{
-		{
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
-			peerURLsMap: "infra2=http://192.168.0.102:2380",
-			createRev:   6,
-		},
-		{
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
-			peerURLsMap: "infra3=http://192.168.0.103:2380",
-			createRev:   7,
-		},
-		{
-			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
-			peerURLsMap: "infra1=http://192.168.0.100:2380",
-			createRev:   8,
-		},
-	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fkv := &fakeKVForClaimSlot{
+				fakeKVForCheckCluster: &fakeKVForCheckCluster{
+					fakeBaseKV: &fakeBaseKV{},
+					t:          t,
+					token:      "fakeToken",
+					members:    tc.members,
+				},
+				racer: tc.racer,
+			}
+			d := &discovery{
+				lg:           zap.NewNop(),
+				c:            &clientv3.Client{KV: fkv},
+				cfg:          &DiscoveryConfig{StrictSizeEnforcement: true, RequestTimeOut: time.Second},
+				clusterToken: "fakeToken",
+				clusterSize:  3,
+				memberId:     104,
+				clock:        clockwork.NewFakeClock(),
+			}
 
-	lg, err := zap.NewProduction()
-	if err != nil {
-		t.Errorf("Failed to create a logger, error: %v", err)
+			err := d.registerSelf("infra104=http://192.168.0.104:2380")
+			if err != tc.expectedError {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if fkv.txns != tc.expectedTxns {
+				t.Errorf("Unexpected transactions, expected: %d, got: %d", tc.expectedTxns, fkv.txns)
+			}
+			if err == nil && !reflect.DeepEqual(fkv.puts, []string{selfKey}) {
+				t.Errorf("Unexpected puts, expected: %v, got: %v", []string{selfKey}, fkv.puts)
+			}
+		})
 	}
+}
 
+func TestRegisterSelfWithTTL(t *testing.T) {
+	fkv := &fakeKVForRegisterSelfWithTTL{fakeBaseKV: &fakeBaseKV{}}
+	fl := &fakeLeaseForRegisterSelf{}
 	d := &discovery{
-		lg: lg,
+		lg: zap.NewNop(),
 		c: &clientv3.Client{
-			KV: &fakeBaseKV{},
-			Watcher: &fakeWatcherForWaitPeers{
-				fakeBaseWatcher: &fakeBaseWatcher{},
-				t:               t,
-				token:           "fakeToken",
-				members:         actualMemberInfo,
-			},
+			KV:    fkv,
+			Lease: fl,
 		},
-		cfg:          &DiscoveryConfig{},
+		cfg:          &DiscoveryConfig{RegistrationTTL: 1500 * time.Millisecond},
 		clusterToken: "fakeToken",
+		memberId:     101,
+		clock:        clockwork.NewFakeClock(),
 	}
 
-	cls := clusterInfo{
-		clusterToken: "fakeToken",
+	// registering again reuses the lease.
+	for i := 0; i < 2; i++ {
+		if err := d.registerSelf("infra1=http://192.168.0.101:2380"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
 
-	d.waitPeers(&cls, 3, 0)
-
-	if cls.Len() != len(expectedMemberInfo) {
-		t.Errorf("unexpected member number returned by watch, expected: %d, got: %d", len(expectedMemberInfo), cls.Len())
+	if !reflect.DeepEqual(fl.grantedTTLs, []int64{2}) {
+		t.Errorf("Unexpected granted TTLs, expected: [2], got: %v", fl.grantedTTLs)
+	}
+	if fl.keepAliveID != 42 || d.lease != 42 {
+		t.Errorf("Unexpected lease, kept alive: %d, registered: %d", fl.keepAliveID, d.lease)
+	}
+	if fkv.puts != 2 || fkv.putOpts != 1 {
+		t.Errorf("Unexpected puts: %d, with %d options", fkv.puts, fkv.putOpts)
 	}
 
-	for i, m := range cls.members {
-		if m != expectedMemberInfo[i] {
-			t.Errorf("unexpected member[%d] returned by watch, expected: %v, got: %v", i, expectedMemberInfo[i], m)
-		}
+	d.stopKeepAlive()
+	if fl.keepAliveCtx.Err() == nil {
+		t.Error("Expected the keepalive to be stopped")
 	}
 }
 
-func TestGetInitClusterStr(t *testing.T) {
+func TestRegisterSelfWithoutTTL(t *testing.T) {
+	fkv := &fakeKVForRegisterSelfWithTTL{fakeBaseKV: &fakeBaseKV{}}
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: fkv,
+			// no lease is expected to be granted.
+			Lease: &fakeLeaseForRegisterSelf{},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		memberId:     101,
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	if err := d.registerSelf("infra1=http://192.168.0.101:2380"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fkv.putOpts != 0 || d.lease != clientv3.NoLease || d.stopKeepAlive != nil {
+		t.Errorf("Unexpected lease %d, put with %d options", d.lease, fkv.putOpts)
+	}
+}
+
+// fakeKVForLeaveCluster is used to test leaveCluster.
+type fakeKVForLeaveCluster struct {
+	*fakeBaseKV
+	keys map[string]bool
+}
+
+// We only need to overwrite method `Delete`.
+func (fkv *fakeKVForLeaveCluster) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	if !fkv.keys[key] {
+		return &clientv3.DeleteResponse{}, nil
+	}
+	delete(fkv.keys, key)
+	return &clientv3.DeleteResponse{Deleted: 1}, nil
+}
+
+func TestLeaveCluster(t *testing.T) {
+	memberKey := "/_etcd/registry/fakeToken/members/" + types.ID(101).String()
+	otherKey := "/_etcd/registry/fakeToken/members/" + types.ID(102).String()
+	fkv := &fakeKVForLeaveCluster{
+		fakeBaseKV: &fakeBaseKV{},
+		keys:       map[string]bool{memberKey: true, otherKey: true},
+	}
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: fkv,
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		memberId:     101,
+	}
+
+	// leaving again is a no-op.
+	for i := 0; i < 2; i++ {
+		if err := d.leaveCluster(); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(fkv.keys, map[string]bool{otherKey: true}) {
+		t.Errorf("Unexpected remaining keys: %v", fkv.keys)
+	}
+}
+
+// fakeKVForSizeKeyDeletion is used to test the recovery from the deletion of
+// the size key in the middle of the bootstrap.
+type fakeKVForSizeKeyDeletion struct {
+	*fakeBaseKV
+	t             *testing.T
+	token         string
+	members       []memberInfo
+	sizeKeyExists bool
+}
+
+// We only need to overwrite method `Get`. The size key is deleted right
+// after it's read for the first time.
+func (fkv *fakeKVForSizeKeyDeletion) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	clusterSizeKey := fmt.Sprintf("/_etcd/registry/%s/_config/size", fkv.token)
+	clusterMembersKey := fmt.Sprintf("/_etcd/registry/%s/members", fkv.token)
+
+	switch key {
+	case clusterSizeKey:
+		if !fkv.sizeKeyExists {
+			return &clientv3.GetResponse{}, nil
+		}
+		fkv.sizeKeyExists = false
+		return &clientv3.GetResponse{
+			Kvs: []*mvccpb.KeyValue{
+				{
+					Value: []byte("3"),
+				},
+			},
+		}, nil
+	case clusterMembersKey:
+		return &clientv3.GetResponse{
+			Header: &etcdserverpb.ResponseHeader{
+				Revision: 10,
+			},
+			Kvs: memberInfoToKeyValues(fkv.members),
+		}, nil
+	case clusterMembersKey + "/" + types.ID(101).String():
+		// the local member isn't registered yet.
+		return &clientv3.GetResponse{}, nil
+	default:
+		fkv.t.Errorf("unexpected key: %s", key)
+		return nil, fmt.Errorf("unexpected key: %s", key)
+	}
+}
+
+// fakeWatcherForSizeKey is used to put back the size key in the middle of
+// the bootstrap.
+type fakeWatcherForSizeKey struct {
+	*fakeBaseWatcher
+	sizeValue string
+}
+
+// We only need to overwrite method `Watch`.
+func (fw *fakeWatcherForSizeKey) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse, 1)
+	if fw.sizeValue != "" {
+		ch <- clientv3.WatchResponse{
+			Events: []*clientv3.Event{
+				{
+					Type: clientv3.EventTypePut,
+					Kv: &mvccpb.KeyValue{
+						Key:   []byte(key),
+						Value: []byte(fw.sizeValue),
+					},
+				},
+			},
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func TestJoinClusterWithSizeKeyDeleted(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   6,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   7,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   8,
+		},
+	}
+
+	cases := []struct {
+		name          string
+		cfg           *DiscoveryConfig
+		sizeValue     string
+		expectedError error
+	}{
+		{
+			name:          "no recovery configured",
+			cfg:           &DiscoveryConfig{},
+			expectedError: ErrSizeNotFound,
+		},
+		{
+			name:          "fall back to expected size",
+			cfg:           &DiscoveryConfig{ExpectedSize: 3},
+			expectedError: nil,
+		},
+		{
+			name:          "size key reappears",
+			cfg:           &DiscoveryConfig{SizeKeyWaitTimeout: time.Second},
+			sizeValue:     "3",
+			expectedError: nil,
+		},
+		{
+			name:          "size key never reappears",
+			cfg:           &DiscoveryConfig{SizeKeyWaitTimeout: 100 * time.Millisecond},
+			expectedError: ErrSizeNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForSizeKeyDeletion{
+						fakeBaseKV:    &fakeBaseKV{},
+						t:             t,
+						token:         "fakeToken",
+						members:       members,
+						sizeKeyExists: true,
+					},
+					Watcher: &fakeWatcherForSizeKey{
+						fakeBaseWatcher: &fakeBaseWatcher{},
+						sizeValue:       tc.sizeValue,
+					},
+				},
+				cfg:          tc.cfg,
+				clusterToken: "fakeToken",
+				memberId:     101,
+				clock:        clockwork.NewRealClock(),
+			}
+
+			cs, err := d.joinCluster("infra1=http://192.168.0.100:2380")
+			if err != tc.expectedError {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+
+			expectedCluster := "infra1=http://192.168.0.100:2380,infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380"
+			if err == nil && cs != expectedCluster {
+				t.Errorf("Unexpected cluster, expected: %s, got: %s", expectedCluster, cs)
+			}
+		})
+	}
+}
+
+// fakeKVForJoinCluster is used to test joinCluster with a flaky discovery
+// service.
+type fakeKVForJoinCluster struct {
+	*fakeKVForCheckCluster
+	putRetries int
+	registered bool
+}
+
+// The members registered with the same key as the local member register
+// after it, so its own registration isn't found before it registers.
+func (fkv *fakeKVForJoinCluster) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if !fkv.registered && strings.HasPrefix(key, fmt.Sprintf("/_etcd/registry/%s/members/", fkv.token)) {
+		return &clientv3.GetResponse{}, nil
+	}
+	return fkv.fakeKVForCheckCluster.Get(ctx, key, opts...)
+}
+
+func (fkv *fakeKVForJoinCluster) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	if fkv.putRetries > 0 {
+		fkv.putRetries--
+		// discovery client should retry on error.
+		return nil, errors.New("register self failed")
+	}
+	fkv.registered = true
+	return nil, nil
+}
+
+// advanceClock keeps advancing the fake clock whenever someone sleeps on it,
+// until the returned function is called.
+func advanceClock(fc clockwork.FakeClock) func() {
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			fc.BlockUntil(1)
+			fc.Advance(time.Hour)
+		}
+	}()
+	return func() {
+		close(stop)
+		// unblock the goroutine if it's waiting for a sleeper.
+		go fc.Sleep(time.Nanosecond)
+	}
+}
+
+func TestJoinClusterRegisterRetryBudget(t *testing.T) {
+	origRetries := nRetries
+	nRetries = 3
+	defer func() { nRetries = origRetries }()
+
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   8,
+		},
+	}
+
+	// The cluster status check takes all the retries it's allowed, and so
+	// does the registration afterwards.
+	fkv := &fakeKVForJoinCluster{
+		fakeKVForCheckCluster: &fakeKVForCheckCluster{
+			fakeBaseKV:     &fakeBaseKV{},
+			t:              t,
+			token:          "fakeToken",
+			clusterSizeStr: "1",
+			members:        members,
+			getSizeRetries: 3,
+		},
+		putRetries: 3,
+	}
+
+	fc := clockwork.NewFakeClock()
+	stop := advanceClock(fc)
+	defer stop()
+
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: fkv,
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		memberId:     101,
+		clock:        fc,
+	}
+
+	cs, err := d.joinCluster("infra1=http://192.168.0.100:2380")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !fkv.registered {
+		t.Errorf("Member wasn't registered")
+	}
+	if cs != "infra1=http://192.168.0.100:2380" {
+		t.Errorf("Unexpected cluster: %s", cs)
+	}
+}
+
+// fakeKVForReadConsistency records whether each read is serializable.
+type fakeKVForReadConsistency struct {
+	*fakeKVForJoinCluster
+	serializable []bool
+}
+
+// We only need to overwrite method `Get`.
+func (fkv *fakeKVForReadConsistency) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	fkv.serializable = append(fkv.serializable, clientv3.OpGet(key, opts...).IsSerializable())
+	return fkv.fakeKVForJoinCluster.Get(ctx, key, opts...)
+}
+
+func TestJoinClusterReadConsistency(t *testing.T) {
+	cases := []struct {
+		name                 string
+		readConsistency      ReadConsistency
+		expectedSerializable []bool
+	}{
+		{
+			name:                 "default",
+			expectedSerializable: []bool{false, false, false, false, false},
+		},
+		{
+			name:            "serializable",
+			readConsistency: ReadConsistencySerializable,
+			// only the reads before the registration are serializable,
+			// not the read of the registration itself.
+			expectedSerializable: []bool{true, true, false, false, false},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fkv := &fakeKVForReadConsistency{
+				fakeKVForJoinCluster: &fakeKVForJoinCluster{
+					fakeKVForCheckCluster: &fakeKVForCheckCluster{
+						fakeBaseKV:     &fakeBaseKV{},
+						t:              t,
+						token:          "fakeToken",
+						clusterSizeStr: "1",
+						members: []memberInfo{
+							{
+								peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+								peerURLsMap: "infra1=http://192.168.0.100:2380",
+								createRev:   8,
+							},
+						},
+					},
+				},
+			}
+
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: fkv,
+				},
+				cfg:          &DiscoveryConfig{ReadConsistency: tc.readConsistency},
+				clusterToken: "fakeToken",
+				memberId:     101,
+				clock:        clockwork.NewRealClock(),
+			}
+
+			if _, err := d.joinCluster("infra1=http://192.168.0.100:2380"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(fkv.serializable, tc.expectedSerializable) {
+				t.Errorf("Unexpected serializable reads, expected: %v, got: %v", tc.expectedSerializable, fkv.serializable)
+			}
+		})
+	}
+}
+
+func TestCheckSchemeChange(t *testing.T) {
+	selfKey := "/_etcd/registry/fakeToken/members/" + types.ID(101).String()
+	cases := []struct {
+		name                  string
+		previous              string
+		contents              string
+		rejectSchemeDowngrade bool
+		expectedError         error
+		expectedLog           string
+	}{
+		{
+			name:     "first registration",
+			contents: "infra1=http://192.168.0.101:2380",
+		},
+		{
+			name:     "same scheme",
+			previous: "infra1=https://192.168.0.101:2380",
+			contents: "infra1=https://192.168.0.101:2380",
+		},
+		{
+			name:        "upgrade",
+			previous:    "infra1=http://192.168.0.101:2380",
+			contents:    "infra1=https://192.168.0.101:2380",
+			expectedLog: "peer URL scheme upgraded from http to https since the previous registration",
+		},
+		{
+			name:        "downgrade",
+			previous:    "infra1=https://192.168.0.101:2380",
+			contents:    "infra1=http://192.168.0.101:2380",
+			expectedLog: "peer URL scheme downgraded from https to http since the previous registration",
+		},
+		{
+			name:                  "downgrade rejected",
+			previous:              "infra1=https://192.168.0.101:2380",
+			contents:              "infra1=https://192.168.0.101:2380,infra1=http://10.0.0.101:2380",
+			rejectSchemeDowngrade: true,
+			expectedError:         ErrSchemeDowngrade,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cls := &clusterInfo{clusterToken: "fakeToken"}
+			if tc.previous != "" {
+				cls.members = []memberInfo{{peerRegKey: selfKey, peerURLsMap: tc.previous, createRev: 8}}
+			}
+			core, logs := observer.New(zap.InfoLevel)
+			d := &discovery{
+				lg:           zap.New(core),
+				clusterToken: "fakeToken",
+				memberId:     101,
+				cfg:          &DiscoveryConfig{RejectSchemeDowngrade: tc.rejectSchemeDowngrade},
+			}
+
+			err := d.checkSchemeChange(cls, tc.contents)
+			if !errors.Is(err, tc.expectedError) {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if tc.expectedLog != "" && logs.FilterMessage(tc.expectedLog).Len() != 1 {
+				t.Errorf("Expected log %q, got: %v", tc.expectedLog, logs.All())
+			}
+			if tc.expectedLog == "" && logs.Len() != 0 {
+				t.Errorf("Unexpected logs: %v", logs.All())
+			}
+		})
+	}
+}
+
+// fakeKVForIdempotentJoin is a minimal store keeping the revisions of the
+// keys, used to test joining the cluster more than once.
+type fakeKVForIdempotentJoin struct {
+	*fakeBaseKV
+	rev  int64
+	kvs  map[string]*mvccpb.KeyValue
+	puts int
+}
+
+func (fkv *fakeKVForIdempotentJoin) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	op := clientv3.OpGet(key, opts...)
+	resp := &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: fkv.rev}}
+	for k, kv := range fkv.kvs {
+		if k == key || (len(op.RangeBytes()) > 0 && strings.HasPrefix(k, key)) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	return resp, nil
+}
+
+func (fkv *fakeKVForIdempotentJoin) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	fkv.puts++
+	fkv.rev++
+	kv, ok := fkv.kvs[key]
+	if !ok {
+		kv = &mvccpb.KeyValue{Key: []byte(key), CreateRevision: fkv.rev}
+		fkv.kvs[key] = kv
+	}
+	kv.Value, kv.ModRevision = []byte(val), fkv.rev
+	return &clientv3.PutResponse{}, nil
+}
+
+func TestJoinClusterTwice(t *testing.T) {
+	selfKey := "/_etcd/registry/fakeToken/members/" + types.ID(101).String()
+	fkv := &fakeKVForIdempotentJoin{
+		fakeBaseKV: &fakeBaseKV{},
+		rev:        1,
+		kvs: map[string]*mvccpb.KeyValue{
+			"/_etcd/registry/fakeToken/_config/size": {Value: []byte("1"), CreateRevision: 1, ModRevision: 1},
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		d := &discovery{
+			lg:           zap.NewNop(),
+			c:            &clientv3.Client{KV: fkv},
+			cfg:          &DiscoveryConfig{},
+			clusterToken: "fakeToken",
+			memberId:     101,
+			clock:        clockwork.NewFakeClock(),
+		}
+		cs, err := d.joinCluster("infra1=http://192.168.0.101:2380")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cs != "infra1=http://192.168.0.101:2380" {
+			t.Errorf("Unexpected cluster: %s", cs)
+		}
+	}
+
+	if fkv.puts != 1 {
+		t.Errorf("Unexpected registrations, expected: 1, got: %d", fkv.puts)
+	}
+	if kv := fkv.kvs[selfKey]; kv == nil || kv.CreateRevision != 2 || kv.ModRevision != 2 {
+		t.Errorf("Unexpected registration: %v", kv)
+	}
+}
+
+func TestJoinClusterFull(t *testing.T) {
+	newMember := func(id int) memberInfo {
+		return memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(id).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.%d:2380", id, id),
+			createRev:   int64(id),
+		}
+	}
+	racer := newMember(103)
+
+	cases := []struct {
+		name    string
+		members []memberInfo
+		racer   *memberInfo
+	}{
+		{
+			name:    "cluster full before registering",
+			members: []memberInfo{newMember(101), newMember(102), newMember(103)},
+		},
+		{
+			name:    "cluster filled while registering",
+			members: []memberInfo{newMember(101), newMember(102)},
+			racer:   &racer,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForClaimSlot{
+						fakeKVForCheckCluster: &fakeKVForCheckCluster{
+							fakeBaseKV:     &fakeBaseKV{},
+							t:              t,
+							token:          "fakeToken",
+							clusterSizeStr: "3",
+							members:        tc.members,
+						},
+						racer: tc.racer,
+					},
+				},
+				cfg:          &DiscoveryConfig{StrictSizeEnforcement: true, RequestTimeOut: time.Second},
+				clusterToken: "fakeToken",
+				memberId:     104,
+				clock:        clockwork.NewFakeClock(),
+			}
+
+			_, err := d.joinCluster("infra104=http://192.168.0.104:2380")
+			if !errors.Is(err, ErrFullCluster) {
+				t.Fatalf("Expected ErrFullCluster, got: %v", err)
+			}
+			var ferr *FullClusterError
+			if !errors.As(err, &ferr) {
+				t.Fatalf("Expected a FullClusterError, got: %T", err)
+			}
+			if len(ferr.Result.Members) != 3 {
+				t.Fatalf("Unexpected members: %+v", ferr.Result.Members)
+			}
+			for i, m := range ferr.Result.Members {
+				if name := fmt.Sprintf("infra%d", 101+i); m.Name != name || !strings.Contains(err.Error(), name) {
+					t.Errorf("Expected member %s, got: %+v, error: %v", name, m, err)
+				}
+			}
+		})
+	}
+}
+
+func TestJoinClusterSelfDetection(t *testing.T) {
+	cases := []struct {
+		name              string
+		memberKeyEncoding MemberKeyEncoding
+		registeredKey     string
+	}{
+		{
+			name:          "ID-based key",
+			registeredKey: "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+		},
+		{
+			name:              "name-based key",
+			memberKeyEncoding: MemberKeyByName,
+			registeredKey:     "/_etcd/registry/fakeToken/members/infra1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The cluster is already full with the local member, which
+			// must be detected as self, otherwise ErrFullCluster is returned.
+			reg := &fakeKVForRegisterSelf{
+				fakeBaseKV:       &fakeBaseKV{},
+				t:                t,
+				expectedRegKey:   tc.registeredKey,
+				expectedRegValue: "infra1=http://192.168.0.101:2380",
+			}
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForSelfDetection{
+						reg: reg,
+						fakeKVForCheckCluster: &fakeKVForCheckCluster{
+							fakeBaseKV:     &fakeBaseKV{},
+							t:              t,
+							token:          "fakeToken",
+							clusterSizeStr: "1",
+							members: []memberInfo{
+								{
+									peerRegKey:  tc.registeredKey,
+									peerURLsMap: "infra1=http://192.168.0.101:2380",
+									createRev:   8,
+								},
+							},
+						},
+					},
+				},
+				cfg:          &DiscoveryConfig{MemberKeyEncoding: tc.memberKeyEncoding},
+				clusterToken: "fakeToken",
+				memberId:     101,
+				clock:        clockwork.NewRealClock(),
+			}
+
+			cs, err := d.joinCluster("infra1=http://192.168.0.101:2380")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if cs != "infra1=http://192.168.0.101:2380" {
+				t.Errorf("Unexpected cluster: %s", cs)
+			}
+		})
+	}
+}
+
+// fakeKVForSelfDetection checks the registration of fakeKVForRegisterSelf,
+// and serves the reads of fakeKVForCheckCluster.
+type fakeKVForSelfDetection struct {
+	*fakeKVForCheckCluster
+	reg *fakeKVForRegisterSelf
+}
+
+// We only need to overwrite method `Put`.
+func (fkv *fakeKVForSelfDetection) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	return fkv.reg.Put(ctx, key, val, opts...)
+}
+
+// fakeMaintenanceForBackendReady is used to test waitBackendReady.
+type fakeMaintenanceForBackendReady struct {
+	clientv3.Maintenance
+	// notReady is the number of status requests answered before the
+	// backend is ready.
+	notReady int
+	calls    int
+}
+
+// We only need to overwrite method `Status`.
+func (fm *fakeMaintenanceForBackendReady) Status(ctx context.Context, endpoint string) (*clientv3.StatusResponse, error) {
+	fm.calls++
+	if fm.calls <= fm.notReady {
+		if fm.calls%2 == 0 {
+			// neither a leader nor any applied entry yet.
+			return &clientv3.StatusResponse{}, nil
+		}
+		return nil, errors.New("backend not serving")
+	}
+	return &clientv3.StatusResponse{Leader: 1, RaftIndex: 10}, nil
+}
+
+func TestWaitBackendReady(t *testing.T) {
+	cases := []struct {
+		name          string
+		notReady      int
+		dialTimeout   time.Duration
+		expectedCalls int
+	}{
+		{
+			name:          "ready immediately",
+			dialTimeout:   10 * time.Hour,
+			expectedCalls: 1,
+		},
+		{
+			name:          "ready after a delay",
+			notReady:      3,
+			dialTimeout:   10 * time.Hour,
+			expectedCalls: 4,
+		},
+		{
+			name:          "never ready",
+			notReady:      100,
+			dialTimeout:   2 * time.Hour,
+			expectedCalls: 3,
+		},
+		{
+			// bounded by defaultBackendReadyTimeout, rather than giving up
+			// right away.
+			name:          "never ready without dial timeout",
+			notReady:      100,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fm := &fakeMaintenanceForBackendReady{notReady: tc.notReady}
+			fc := clockwork.NewFakeClock()
+			stop := advanceClock(fc)
+			defer stop()
+
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					Maintenance: fm,
+				},
+				cfg:       &DiscoveryConfig{DialTimeout: tc.dialTimeout},
+				endpoints: []string{"http://127.0.0.1:2379"},
+				clock:     fc,
+			}
+
+			d.waitBackendReady()
+			if fm.calls != tc.expectedCalls {
+				t.Errorf("Unexpected status requests, expected: %d, got: %d", tc.expectedCalls, fm.calls)
+			}
+		})
+	}
+}
+
+// fakeWatcherForWaitPeers is used to test waitPeers.
+type fakeWatcherForWaitPeers struct {
+	*fakeBaseWatcher
+	t       *testing.T
+	token   string
+	members []memberInfo
+}
+
+// We only need to overwrite method `Watch`.
+func (fw *fakeWatcherForWaitPeers) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	expectedWatchKey := fmt.Sprintf("/_etcd/registry/%s/members", fw.token)
+	if key != expectedWatchKey {
+		fw.t.Errorf("unexpected watch key, expected: %s, got: %s", expectedWatchKey, key)
+	}
+
+	ch := make(chan clientv3.WatchResponse, 1)
+	go func() {
+		for _, mi := range fw.members {
+			ch <- clientv3.WatchResponse{
+				Events: []*clientv3.Event{
+					{
+						Kv: &mvccpb.KeyValue{
+							Key:            []byte(mi.peerRegKey),
+							Value:          []byte(mi.peerURLsMap),
+							CreateRevision: mi.createRev,
+						},
+					},
+				},
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func TestWaitPeers(t *testing.T) {
+	actualMemberInfo := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   8,
+		},
+		{
+			// invalid peer registry key
+			peerRegKey:  "/invalidPrefix/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   6,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   6,
+		},
+		{
+			// invalid peer info format
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "http://192.168.0.102:2380",
+			createRev:   6,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   7,
+		},
+		{
+			// duplicate peer
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   2,
+		},
+	}
+
+	// sort by CreateRevision
+	expectedMemberInfo := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   6,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   7,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   8,
+		},
+	}
+
+	lg, err := zap.NewProduction()
+	if err != nil {
+		t.Errorf("Failed to create a logger, error: %v", err)
+	}
+
+	d := &discovery{
+		lg: lg,
+		c: &clientv3.Client{
+			KV: &fakeBaseKV{},
+			Watcher: &fakeWatcherForWaitPeers{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+				t:               t,
+				token:           "fakeToken",
+				members:         actualMemberInfo,
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	cls := clusterInfo{
+		clusterToken: "fakeToken",
+	}
+
+	d.waitPeers(&cls, 3, 0)
+
+	if cls.Len() != len(expectedMemberInfo) {
+		t.Errorf("unexpected member number returned by watch, expected: %d, got: %d", len(expectedMemberInfo), cls.Len())
+	}
+
+	for i, m := range cls.members {
+		if m != expectedMemberInfo[i] {
+			t.Errorf("unexpected member[%d] returned by watch, expected: %v, got: %v", i, expectedMemberInfo[i], m)
+		}
+	}
+}
+
+func TestOnPeerFound(t *testing.T) {
+	var members []memberInfo
+	for i := 0; i < 3; i++ {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101+i).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.10%d:2380", i+1, i+1),
+			createRev:   int64(8 + i),
+		})
+	}
+
+	type call struct {
+		found, total int
+		peerURLsMap  string
+	}
+	var calls []call
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForCheckCluster{
+				fakeBaseKV:     &fakeBaseKV{},
+				t:              t,
+				token:          "fakeToken",
+				clusterSizeStr: "3",
+				members:        members[:1],
+			},
+			Watcher: &fakeWatcherForWaitPeers{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+				t:               t,
+				token:           "fakeToken",
+				members:         members[1:],
+			},
+		},
+		cfg: &DiscoveryConfig{
+			OnPeerFound: func(found, total int, peerURLsMap string) {
+				calls = append(calls, call{found, total, peerURLsMap})
+			},
+		},
+		clusterToken: "fakeToken",
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	if _, err := d.getCluster(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []call{
+		{1, 3, members[0].peerURLsMap},
+		{2, 3, members[1].peerURLsMap},
+		{3, 3, members[2].peerURLsMap},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Unexpected calls, expected: %v, got: %v", expected, calls)
+	}
+}
+
+// fakeKVForCompaction is used to test waitPeers when the watch revision
+// is compacted.
+type fakeKVForCompaction struct {
+	*fakeBaseKV
+	members []memberInfo
+	rev     int64
+}
+
+// We only need to overwrite method `Get`.
+func (fkv *fakeKVForCompaction) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	return &clientv3.GetResponse{
+		Header: &etcdserverpb.ResponseHeader{
+			Revision: fkv.rev,
+		},
+		Kvs: memberInfoToKeyValues(fkv.members),
+	}, nil
+}
+
+// fakeWatcherForCompaction fails the first watch because the revision has
+// been compacted, after the given member registered.
+type fakeWatcherForCompaction struct {
+	*fakeBaseWatcher
+	fkv       *fakeKVForCompaction
+	compacted memberInfo
+	watched   memberInfo
+	watchRevs []int64
+}
+
+// We only need to overwrite method `Watch`.
+func (fw *fakeWatcherForCompaction) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	fw.watchRevs = append(fw.watchRevs, clientv3.OpGet(key, opts...).Rev())
+
+	ch := make(chan clientv3.WatchResponse, 1)
+	if len(fw.watchRevs) == 1 {
+		fw.fkv.members = append(fw.fkv.members, fw.compacted)
+		fw.fkv.rev = 20
+		ch <- clientv3.WatchResponse{CompactRevision: 15, Canceled: true}
+		close(ch)
+		return ch
+	}
+
+	ch <- clientv3.WatchResponse{
+		Events: []*clientv3.Event{
+			{
+				Kv: &mvccpb.KeyValue{
+					Key:            []byte(fw.watched.peerRegKey),
+					Value:          []byte(fw.watched.peerURLsMap),
+					CreateRevision: fw.watched.createRev,
+				},
+			},
+		},
+	}
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func TestWaitPeersCompacted(t *testing.T) {
+	var members []memberInfo
+	for i := 0; i < 3; i++ {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101+i).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.10%d:2380", i+1, i+1),
+			createRev:   []int64{8, 12, 21}[i],
+		})
+	}
+
+	fkv := &fakeKVForCompaction{
+		fakeBaseKV: &fakeBaseKV{},
+		members:    members[:1],
+		rev:        10,
+	}
+	fw := &fakeWatcherForCompaction{
+		fakeBaseWatcher: &fakeBaseWatcher{},
+		fkv:             fkv,
+		compacted:       members[1],
+		watched:         members[2],
+	}
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV:      fkv,
+			Watcher: fw,
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	cls, rev, err := d.getClusterMembers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := d.waitPeers(cls, 3, rev); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(fw.watchRevs, []int64{11, 21}) {
+		t.Errorf("Unexpected watch revisions, expected: [11 21], got: %v", fw.watchRevs)
+	}
+	cs, err := cls.getInitClusterStr(3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380"
+	if cs != expected {
+		t.Errorf("Unexpected cluster, expected: %s, got: %s", expected, cs)
+	}
+}
+
+// fakeWatcherForClosedWatch closes the first watch before delivering any
+// event, just like a watch whose connection is reset.
+type fakeWatcherForClosedWatch struct {
+	*fakeBaseWatcher
+	members []memberInfo
+	watches int
+}
+
+// We only need to overwrite method `Watch`.
+func (fw *fakeWatcherForClosedWatch) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	fw.watches++
+	ch := make(chan clientv3.WatchResponse, len(fw.members))
+	if fw.watches == 1 {
+		close(ch)
+		return ch
+	}
+
+	for _, mi := range fw.members {
+		ch <- clientv3.WatchResponse{
+			Events: []*clientv3.Event{
+				{
+					Kv: &mvccpb.KeyValue{
+						Key:            []byte(mi.peerRegKey),
+						Value:          []byte(mi.peerURLsMap),
+						CreateRevision: mi.createRev,
+					},
+				},
+			},
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func TestWaitPeersWatchClosed(t *testing.T) {
+	var members []memberInfo
+	for i := 0; i < 3; i++ {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101+i).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.10%d:2380", i+1, i+1),
+			createRev:   int64(8 + i),
+		})
+	}
+
+	fkv := &fakeKVForCompaction{
+		fakeBaseKV: &fakeBaseKV{},
+		members:    members[:1],
+		rev:        10,
+	}
+	fw := &fakeWatcherForClosedWatch{
+		fakeBaseWatcher: &fakeBaseWatcher{},
+		members:         members[1:],
+	}
+	fc := clockwork.NewFakeClock()
+	metrics, err := newDiscoveryMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV:      fkv,
+			Watcher: fw,
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		clock:        fc,
+		metrics:      metrics,
+	}
+
+	cls, rev, err := d.getClusterMembers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	stop := advanceClock(fc)
+	defer stop()
+	if err := d.waitPeers(cls, 3, rev); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cls.Len() != 3 {
+		t.Errorf("Unexpected number of peers, expected: 3, got: %d", cls.Len())
+	}
+	if fw.watches != 2 {
+		t.Errorf("Unexpected number of watches, expected: 2, got: %d", fw.watches)
+	}
+	// the watch is reopened after a backoff.
+	if got := testutil.ToFloat64(metrics.retriesTotal.WithLabelValues(phaseWaitPeers)); got != 1 {
+		t.Errorf("Unexpected retries, expected: 1, got: %v", got)
+	}
+}
+
+// fakeWatcherForStalledWatch stalls the first watch, which doesn't answer
+// the progress requests, and then sends a progress notification followed by
+// the members.
+type fakeWatcherForStalledWatch struct {
+	*fakeBaseWatcher
+	members          []memberInfo
+	watches          int
+	progressRequests int
+}
+
+func (fw *fakeWatcherForStalledWatch) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	fw.watches++
+	ch := make(chan clientv3.WatchResponse, len(fw.members)+1)
+	if fw.watches > 1 {
+		ch <- clientv3.WatchResponse{Header: etcdserverpb.ResponseHeader{Revision: 10}}
+		for _, mi := range fw.members {
+			ch <- clientv3.WatchResponse{
+				Events: []*clientv3.Event{
+					{
+						Kv: &mvccpb.KeyValue{
+							Key:            []byte(mi.peerRegKey),
+							Value:          []byte(mi.peerURLsMap),
+							CreateRevision: mi.createRev,
+						},
+					},
+				},
+			}
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch
+}
+
+func (fw *fakeWatcherForStalledWatch) RequestProgress(ctx context.Context) error {
+	fw.progressRequests++
+	return nil
+}
+
+func TestWaitPeersWatchStalled(t *testing.T) {
+	var members []memberInfo
+	for i := 0; i < 3; i++ {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101+i).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.10%d:2380", i+1, i+1),
+			createRev:   int64(8 + i),
+		})
+	}
+
+	fw := &fakeWatcherForStalledWatch{
+		fakeBaseWatcher: &fakeBaseWatcher{},
+		members:         members[1:],
+	}
+	core, logs := observer.New(zap.InfoLevel)
+	fc := clockwork.NewFakeClock()
+	d := &discovery{
+		lg: zap.New(core),
+		c: &clientv3.Client{
+			KV: &fakeKVForCompaction{
+				fakeBaseKV: &fakeBaseKV{},
+				members:    members[:1],
+				rev:        10,
+			},
+			Watcher: fw,
+		},
+		cfg:          &DiscoveryConfig{WatchIdleInterval: time.Minute},
+		clusterToken: "fakeToken",
+		clock:        fc,
+	}
+
+	cls, rev, err := d.getClusterMembers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	go func() {
+		// the first idle interval requests a progress notification, the
+		// second one reopens the watch after a backoff.
+		for _, dur := range []time.Duration{time.Minute, time.Minute, time.Hour} {
+			fc.BlockUntil(1)
+			fc.Advance(dur)
+		}
+	}()
+	if err := d.waitPeers(cls, 3, rev); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if cls.Len() != 3 {
+		t.Errorf("Unexpected number of peers, expected: 3, got: %d", cls.Len())
+	}
+	if fw.watches != 2 || fw.progressRequests != 1 {
+		t.Errorf("Unexpected watches and progress requests, expected: (2, 1), got: (%d, %d)", fw.watches, fw.progressRequests)
+	}
+	if logs.FilterMessage("discovery watch is alive, still waiting for peers").Len() != 1 {
+		t.Errorf("Expected a heartbeat for the progress notification")
+	}
+}
+
+// fakeWatcherForPeerWait delivers the events sent by the test, so that the
+// test knows whether waitPeers is still watching.
+type fakeWatcherForPeerWait struct {
+	*fakeBaseWatcher
+	events chan clientv3.WatchResponse
+}
+
+func (fw *fakeWatcherForPeerWait) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	return fw.events
+}
+
+func TestWaitPeersPeerWaitTimeout(t *testing.T) {
+	var members []memberInfo
+	for i := 0; i < 3; i++ {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101+i).String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.10%d:2380", i+1, i+1),
+			createRev:   int64(8 + i),
+		})
+	}
+
+	fw := &fakeWatcherForPeerWait{
+		fakeBaseWatcher: &fakeBaseWatcher{},
+		events:          make(chan clientv3.WatchResponse),
+	}
+	fc := clockwork.NewFakeClock()
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForClusterMembers{
+				fakeBaseKV: &fakeBaseKV{},
+				members:    members[:1],
+			},
+			Watcher: fw,
+		},
+		cfg:          &DiscoveryConfig{PeerWaitTimeout: time.Minute},
+		clusterToken: "fakeToken",
+		clock:        fc,
+	}
+
+	cls, rev, err := d.getClusterMembers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.waitPeers(cls, 4, rev)
+	}()
+
+	// Each peer is found 50s after the previous one, which restarts the
+	// timeout, so the wait is only cut off a minute after the last one.
+	for i, mi := range members[1:] {
+		fc.BlockUntil(i + 1)
+		fc.Advance(50 * time.Second)
+		resp := clientv3.WatchResponse{
+			Events: []*clientv3.Event{
+				{
+					Kv: &mvccpb.KeyValue{
+						Key:            []byte(mi.peerRegKey),
+						Value:          []byte(mi.peerURLsMap),
+						CreateRevision: mi.createRev,
+					},
+				},
+			},
+		}
+		select {
+		case fw.events <- resp:
+		case err := <-errc:
+			t.Fatalf("Unexpected error before peer %d was found: %v", i+2, err)
+		}
+	}
+	fc.BlockUntil(2)
+	fc.Advance(time.Minute)
+
+	err = <-errc
+	var icErr *IncompleteClusterError
+	if !errors.As(err, &icErr) || !errors.Is(err, ErrIncompleteCluster) {
+		t.Fatalf("Unexpected error, expected an IncompleteClusterError, got: %v", err)
+	}
+	if len(icErr.Result.Members) != 3 || icErr.Result.ClusterSize != 4 {
+		t.Errorf("Unexpected partial cluster, expected 3 of 4 members, got: %d of %d", len(icErr.Result.Members), icErr.Result.ClusterSize)
+	}
+	if !d.peerWaitDeadline.IsZero() {
+		t.Errorf("Peer wait deadline not cleared after waiting for the peers")
+	}
+}
+
+// fakeWatcherForWaitMember is used to test waitForMember.
+type fakeWatcherForWaitMember struct {
+	*fakeBaseWatcher
+	members []memberInfo
+}
+
+// We only need to overwrite method `Watch`. The watch channel is only closed
+// once the context is done, just like a real watcher.
+func (fw *fakeWatcherForWaitMember) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(ch)
+		for _, mi := range fw.members {
+			select {
+			case ch <- clientv3.WatchResponse{
+				Events: []*clientv3.Event{
+					{
+						Kv: &mvccpb.KeyValue{
+							Key:            []byte(mi.peerRegKey),
+							Value:          []byte(mi.peerURLsMap),
+							CreateRevision: mi.createRev,
+						},
+					},
+				},
+			}:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return ch
+}
+
+func TestWaitPeersWithRedeliveredEvents(t *testing.T) {
+	member1 := memberInfo{
+		peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+		peerURLsMap: "infra1=http://192.168.0.101:2380",
+		createRev:   8,
+	}
+	member2 := memberInfo{
+		peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+		peerURLsMap: "infra2=http://192.168.0.102:2380",
+		createRev:   9,
+	}
+	conflict := member1
+	conflict.createRev = 10
+
+	cases := []struct {
+		name          string
+		events        []memberInfo
+		expectedWarns int
+	}{
+		{
+			name:   "same event twice",
+			events: []memberInfo{member1, member1, member2},
+		},
+		{
+			name:          "conflicting registration",
+			events:        []memberInfo{member1, conflict, member2},
+			expectedWarns: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			core, warns := observer.New(zap.WarnLevel)
+			d := &discovery{
+				lg: zap.New(core),
+				c: &clientv3.Client{
+					KV: &fakeBaseKV{},
+					Watcher: &fakeWatcherForWaitPeers{
+						fakeBaseWatcher: &fakeBaseWatcher{},
+						t:               t,
+						token:           "fakeToken",
+						members:         tc.events,
+					},
+				},
+				cfg:          &DiscoveryConfig{},
+				clusterToken: "fakeToken",
+				clock:        clockwork.NewFakeClock(),
+			}
+
+			cls := clusterInfo{clusterToken: "fakeToken"}
+			d.waitPeers(&cls, 2, 0)
+
+			if cls.Len() != 2 {
+				t.Errorf("Unexpected member count, expected: 2, got: %d", cls.Len())
+			}
+			if warns.Len() != tc.expectedWarns {
+				t.Errorf("Unexpected warnings, expected: %d, got: %v", tc.expectedWarns, warns.All())
+			}
+		})
+	}
+}
+
+func TestWaitForMember(t *testing.T) {
+	registeredMembers := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   8,
+		},
+	}
+	watchedMembers := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   11,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   12,
+		},
+	}
+
+	cases := []struct {
+		name          string
+		memberId      types.ID
+		memberName    string
+		expectedError error
+	}{
+		{
+			name:          "member already registered",
+			memberId:      101,
+			expectedError: nil,
+		},
+		{
+			name:          "member registered during watch",
+			memberId:      103,
+			expectedError: nil,
+		},
+		{
+			name:          "member never registered",
+			memberId:      104,
+			expectedError: ErrWaitMemberCanceled,
+		},
+		{
+			name:          "member already registered by name",
+			memberName:    "infra1",
+			expectedError: nil,
+		},
+		{
+			name:          "member registered during watch by name",
+			memberName:    "infra3",
+			expectedError: nil,
+		},
+		{
+			name:          "member never registered by name",
+			memberName:    "infra4",
+			expectedError: ErrWaitMemberCanceled,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForClusterMembers{
+						fakeBaseKV: &fakeBaseKV{},
+						members:    registeredMembers,
+					},
+					Watcher: &fakeWatcherForWaitMember{
+						fakeBaseWatcher: &fakeBaseWatcher{},
+						members:         watchedMembers,
+					},
+				},
+				cfg:          &DiscoveryConfig{},
+				clusterToken: "fakeToken",
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			var err error
+			if tc.memberName != "" {
+				err = d.waitForMemberByName(ctx, tc.memberName)
+			} else {
+				err = d.waitForMember(ctx, tc.memberId)
+			}
+			if err != tc.expectedError {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+// fakeWatcherForFailedWatch fails the watch because the revision has been
+// compacted.
+type fakeWatcherForFailedWatch struct {
+	*fakeBaseWatcher
+}
+
+// We only need to overwrite method `Watch`.
+func (fw *fakeWatcherForFailedWatch) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse, 1)
+	ch <- clientv3.WatchResponse{CompactRevision: 15, Canceled: true}
+	close(ch)
+	return ch
+}
+
+func TestWaitForMemberWatchFailure(t *testing.T) {
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForClusterMembers{
+				fakeBaseKV: &fakeBaseKV{},
+			},
+			Watcher: &fakeWatcherForFailedWatch{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+	}
+
+	if err := d.waitForMember(context.Background(), 101); err != rpctypes.ErrCompacted {
+		t.Errorf("Unexpected error, expected: %v, got: %v", rpctypes.ErrCompacted, err)
+	}
+}
+
+// fakeKVForCanceled is used to test the cancellation of the discovery.
+type fakeKVForCanceled struct {
+	*fakeBaseKV
+}
+
+// Both `Get` and `Put` block until the context is done, just like the
+// requests to an unavailable discovery service.
+func (fkv *fakeKVForCanceled) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (fkv *fakeKVForCanceled) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestPreflight(t *testing.T) {
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	authToken := &authTokenCredential{}
+	newReauthClient := func(user string) *clientv3.Client {
+		authToken.setToken(fakeAuthToken("root"))
+		return &clientv3.Client{
+			KV: &fakeKVForReauth{
+				fakeKVForCheckCluster: &fakeKVForCheckCluster{
+					fakeBaseKV:     &fakeBaseKV{},
+					t:              t,
+					token:          "fakeToken",
+					clusterSizeStr: "3",
+				},
+				authToken: authToken,
+				user:      user,
+			},
+			Auth: &fakeAuthForReauth{},
+		}
+	}
+
+	cases := []struct {
+		name          string
+		c             *clientv3.Client
+		ctx           context.Context
+		credentials   CredentialsProvider
+		expectedError error
+	}{
+		{
+			name: "available",
+			c: &clientv3.Client{
+				KV: &fakeKVForCheckCluster{
+					fakeBaseKV:     &fakeBaseKV{},
+					t:              t,
+					token:          "fakeToken",
+					clusterSizeStr: "3",
+				},
+			},
+		},
+		{
+			name:          "unreachable",
+			c:             &clientv3.Client{KV: &fakeKVForCanceled{fakeBaseKV: &fakeBaseKV{}}},
+			expectedError: ErrDiscoveryUnavailable,
+		},
+		{
+			name:          "wrong credentials",
+			c:             newReauthClient("rotated"),
+			expectedError: ErrDiscoveryUnavailable,
+		},
+		{
+			name:        "wrong credentials with provider",
+			c:           newReauthClient("rotated"),
+			credentials: &fakeCredentialsProvider{user: "rotated"},
+		},
+		{
+			name:          "canceled",
+			c:             &clientv3.Client{KV: &fakeKVForCanceled{fakeBaseKV: &fakeBaseKV{}}},
+			ctx:           canceledCtx,
+			expectedError: context.Canceled,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg: zap.NewNop(),
+				c:  tc.c,
+				cfg: &DiscoveryConfig{
+					RequestTimeOut: 10 * time.Millisecond,
+					Credentials:    tc.credentials,
+				},
+				authToken:    authToken,
+				clusterToken: "fakeToken",
+				ctx:          tc.ctx,
+			}
+
+			err := d.preflight()
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if tc.expectedError == context.Canceled && errors.Is(err, ErrDiscoveryUnavailable) {
+				t.Errorf("Unexpected ErrDiscoveryUnavailable for a canceled discovery")
+			}
+		})
+	}
+}
+
+func TestJoinClusterCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForCanceled{
+				fakeBaseKV: &fakeBaseKV{},
+			},
+		},
+		cfg: &DiscoveryConfig{
+			RequestTimeOut: time.Hour,
+		},
+		clusterToken: "fakeToken",
+		memberId:     101,
+		clock:        clockwork.NewFakeClock(),
+		ctx:          ctx,
+	}
+
+	_, err := d.joinCluster("infra1=http://192.168.0.101:2380")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+	if d.retries != 0 {
+		t.Errorf("Unexpected retries after cancellation: %d", d.retries)
+	}
+}
+
+func TestGetClusterCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForCheckCluster{
+				fakeBaseKV:     &fakeBaseKV{},
+				t:              t,
+				token:          "fakeToken",
+				clusterSizeStr: "3",
+				members: []memberInfo{
+					{
+						peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+						peerURLsMap: "infra1=http://192.168.0.101:2380",
+						createRev:   8,
+					},
+				},
+			},
+			// no peer ever registers.
+			Watcher: &fakeWatcherForWaitMember{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		ctx:          ctx,
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	if _, err := d.getCluster(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+	}
+}
+
+// fakeWatcherForCanceledWatch never sends anything, and records when the
+// watch is torn down.
+type fakeWatcherForCanceledWatch struct {
+	*fakeBaseWatcher
+	closed chan struct{}
+}
+
+func (fw *fakeWatcherForCanceledWatch) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+		close(fw.closed)
+	}()
+	return ch
+}
+
+func TestWaitPeersCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fw := &fakeWatcherForCanceledWatch{
+		fakeBaseWatcher: &fakeBaseWatcher{},
+		closed:          make(chan struct{}),
+	}
+	d := &discovery{
+		lg:           zap.NewNop(),
+		c:            &clientv3.Client{Watcher: fw},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		ctx:          ctx,
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.waitPeers(&clusterInfo{clusterToken: "fakeToken"}, 3, 10)
+	}()
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitPeers didn't return after the cancellation")
+	}
+	select {
+	case <-fw.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The watch wasn't torn down after the cancellation")
+	}
+}
+
+func TestGetClusterTotalTimeout(t *testing.T) {
+	cases := []struct {
+		name          string
+		totalTimeout  time.Duration
+		ctxTimeout    time.Duration
+		expectTimeout bool
+	}{
+		{
+			name:          "total timeout",
+			totalTimeout:  100 * time.Millisecond,
+			ctxTimeout:    time.Hour,
+			expectTimeout: true,
+		},
+		{
+			name:         "context done before the total timeout",
+			totalTimeout: time.Hour,
+			ctxTimeout:   100 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), tc.ctxTimeout)
+			defer cancel()
+
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					// the requests succeed, but the peers never register.
+					KV: &fakeKVForCheckCluster{
+						fakeBaseKV:     &fakeBaseKV{},
+						t:              t,
+						token:          "fakeToken",
+						clusterSizeStr: "3",
+					},
+					Watcher: &fakeWatcherForWaitMember{
+						fakeBaseWatcher: &fakeBaseWatcher{},
+					},
+				},
+				cfg:          &DiscoveryConfig{TotalTimeout: tc.totalTimeout},
+				clusterToken: "fakeToken",
+				clock:        clockwork.NewRealClock(),
+			}
+			d.setContext(ctx)
+			defer d.stop()
+
+			_, err := d.getCluster()
+			if errors.Is(err, ErrDiscoveryTimeout) != tc.expectTimeout {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !tc.expectTimeout && !errors.Is(err, context.DeadlineExceeded) {
+				t.Fatalf("Expected context.DeadlineExceeded, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestTotalTimeoutClock(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	d := &discovery{
+		cfg:   &DiscoveryConfig{TotalTimeout: time.Hour},
+		clock: fc,
+	}
+	d.setContext(context.Background())
+	defer d.stop()
+
+	fc.BlockUntil(1)
+	fc.Advance(time.Hour - time.Second)
+	if err := d.canceled(); err != nil {
+		t.Fatalf("Unexpected error before the total timeout: %v", err)
+	}
+
+	fc.Advance(time.Second)
+	select {
+	case <-d.context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("The context wasn't canceled once the total timeout elapsed")
+	}
+	if err := d.canceled(); !errors.Is(err, ErrDiscoveryTimeout) {
+		t.Errorf("Expected ErrDiscoveryTimeout, got: %v", err)
+	}
+}
+
+func TestDiscoveryEvents(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   8,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   6,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   7,
+		},
+	}
+
+	cases := []struct {
+		name           string
+		bufferSize     int
+		expectedEvents int
+	}{
+		{
+			name:           "all events received",
+			bufferSize:     10,
+			expectedEvents: len(members),
+		},
+		{
+			name:           "events dropped when channel is full",
+			bufferSize:     1,
+			expectedEvents: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			events := make(chan DiscoveryEvent, tc.bufferSize)
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeBaseKV{},
+					Watcher: &fakeWatcherForWaitPeers{
+						fakeBaseWatcher: &fakeBaseWatcher{},
+						t:               t,
+						token:           "fakeToken",
+						members:         members,
+					},
+				},
+				cfg:          &DiscoveryConfig{Events: events},
+				clusterToken: "fakeToken",
+				clock:        clockwork.NewFakeClock(),
+			}
+
+			cls := clusterInfo{
+				clusterToken: "fakeToken",
+			}
+			d.waitPeers(&cls, 3, 0)
+			close(events)
+
+			var got []DiscoveryEvent
+			for ev := range events {
+				got = append(got, ev)
+			}
+			if len(got) != tc.expectedEvents {
+				t.Fatalf("Unexpected event count, expected: %d, got: %d", tc.expectedEvents, len(got))
+			}
+			for i, ev := range got {
+				if ev.Type != EventPeerJoined || ev.PeersFound != i+1 || ev.Peer != members[i].peerURLsMap {
+					t.Errorf("Unexpected event[%d]: %+v", i, ev)
+				}
+			}
+		})
+	}
+}
+
+func TestDiscoveryLogEvents(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   6,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   7,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// the backoff returns right away once the context is done.
+	cancel()
+
+	core, logs := observer.New(zap.InfoLevel)
+	d := &discovery{
+		lg: zap.New(core),
+		c: &clientv3.Client{
+			KV: &fakeBaseKV{},
+			Watcher: &fakeWatcherForWaitPeers{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+				t:               t,
+				token:           "fakeToken",
+				members:         members,
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+		clock:        clockwork.NewFakeClock(),
+		clusterSize:  2,
+	}
+
+	cls := clusterInfo{
+		clusterToken: "fakeToken",
+	}
+	if err := d.waitPeers(&cls, 2, 0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d.ctx = ctx
+	d.logAndBackoffForRetry("register member itself")
+	r, err := cls.getClusterResult(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d.logOutcome(r, nil, "succeeded", "failed")
+	d.logOutcome(nil, &FullClusterError{Result: r}, "succeeded", "failed")
+	d.logOutcome(nil, ErrTooManyRetries, "succeeded", "failed")
+
+	cases := []struct {
+		event    string
+		count    int
+		outcome  string
+		phase    string
+		hasField []string
+	}{
+		{event: logEventPeerFound, count: 2, hasField: []string{"found-peers", "cluster-size"}},
+		{event: logEventPeersComplete, count: 1, phase: "wait_peers", hasField: []string{"cluster-size", "found-peers"}},
+		{event: logEventRetry, count: 1, phase: "register_self", hasField: []string{"retries", "backoff"}},
+		{event: logEventFormationComplete, count: 1, outcome: "success", hasField: []string{"cluster-size"}},
+		{event: logEventClusterFull, count: 1, outcome: "cluster_full", hasField: []string{"cluster-size"}},
+		{event: logEventFormationFailed, count: 1, outcome: "error"},
+	}
+	for _, tc := range cases {
+		entries := logs.FilterField(zap.String(logEventKey, tc.event)).All()
+		if len(entries) != tc.count {
+			t.Errorf("Unexpected %s events, expected: %d, got: %d", tc.event, tc.count, len(entries))
+			continue
+		}
+		for _, e := range entries {
+			fields := e.ContextMap()
+			if tc.outcome != "" && fields["outcome"] != tc.outcome {
+				t.Errorf("Unexpected outcome of %s event, expected: %s, got: %v", tc.event, tc.outcome, fields["outcome"])
+			}
+			if tc.phase != "" && fields["phase"] != tc.phase {
+				t.Errorf("Unexpected phase of %s event, expected: %s, got: %v", tc.event, tc.phase, fields["phase"])
+			}
+			for _, f := range tc.hasField {
+				if _, ok := fields[f]; !ok {
+					t.Errorf("Missing field %q in %s event", f, tc.event)
+				}
+			}
+		}
+	}
+}
+
+func TestRecordFormation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// the backoff returns right away once the context is done.
+	cancel()
+
+	fc := clockwork.NewFakeClock()
+	core, logs := observer.New(zap.InfoLevel)
+	d := &discovery{
+		lg:    zap.New(core),
+		cfg:   &DiscoveryConfig{},
+		clock: fc,
+		start: fc.Now(),
+		ctx:   ctx,
+	}
+
+	// Two consecutive retries, then one more after a success.
+	d.logAndBackoffForRetry("cluster status check")
+	d.logAndBackoffForRetry("cluster status check")
+	d.retries = 0
+	d.logAndBackoffForRetry("register member itself")
+	fc.Advance(90 * time.Second)
+
+	r := &ClusterResult{ClusterToken: "fakeToken"}
+	d.recordFormation(r)
+	if r.Elapsed != 90*time.Second {
+		t.Errorf("Unexpected elapsed time, expected: %v, got: %v", 90*time.Second, r.Elapsed)
+	}
+	if r.Retries != 3 {
+		t.Errorf("Unexpected retries, expected: 3, got: %d", r.Retries)
+	}
+
+	d.logOutcome(r, nil, "succeeded", "failed")
+	entries := logs.FilterMessage("succeeded").All()
+	if len(entries) != 1 {
+		t.Fatalf("Unexpected success logs: %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["elapsed"] != 90*time.Second || fields["retries"] != int64(3) || fields["peak-retries"] != uint64(2) {
+		t.Errorf("Unexpected success log fields: %v", fields)
+	}
+}
+
+func TestGetInitClusterStr(t *testing.T) {
+	cases := []struct {
+		name           string
+		members        []memberInfo
+		clusterSize    int
+		expectedResult string
+		expectedError  error
+	}{
+		{
+			name: "1 member",
+			members: []memberInfo{
+				{
+					peerURLsMap: "infra2=http://192.168.0.102:2380",
+				},
+			},
+			clusterSize:    1,
+			expectedResult: "infra2=http://192.168.0.102:2380",
+			expectedError:  nil,
+		},
+		{
+			name: "2 members",
+			members: []memberInfo{
+				{
+					peerURLsMap: "infra2=http://192.168.0.102:2380",
+				},
+				{
+					peerURLsMap: "infra3=http://192.168.0.103:2380",
+				},
+			},
+			clusterSize:    2,
+			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380",
+			expectedError:  nil,
+		},
+		{
+			name: "3 members",
+			members: []memberInfo{
+				{
+					peerURLsMap: "infra2=http://192.168.0.102:2380",
+				},
+				{
+					peerURLsMap: "infra3=http://192.168.0.103:2380",
+				},
+				{
+					peerURLsMap: "infra1=http://192.168.0.100:2380",
+				},
+			},
+			clusterSize:    3,
+			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380,infra1=http://192.168.0.100:2380",
+			expectedError:  nil,
+		},
+		{
+			name: "should ignore redundant member",
+			members: []memberInfo{
+				{
+					peerURLsMap: "infra2=http://192.168.0.102:2380",
+				},
+				{
+					peerURLsMap: "infra3=http://192.168.0.103:2380",
+				},
+				{
+					peerURLsMap: "infra1=http://192.168.0.100:2380",
+				},
+				{
+					peerURLsMap: "infra4=http://192.168.0.104:2380",
+				},
+			},
+			clusterSize:    3,
+			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380,infra1=http://192.168.0.100:2380",
+			expectedError:  nil,
+		},
+		{
+			name: "invalid_peer_url",
+			members: []memberInfo{
+				{
+					peerURLsMap: "infra2=http://192.168.0.102:2380",
+				},
+				{
+					peerURLsMap: "infra3=http://192.168.0.103", //not host:port
+				},
+			},
+			clusterSize:    2,
+			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380",
+			expectedError:  ErrInvalidURL,
+		},
+		{
+			name:          "no members",
+			members:       nil,
+			clusterSize:   1,
+			expectedError: ErrInsufficientMembers,
+		},
+		{
+			name: "fewer members than cluster size",
+			members: []memberInfo{
+				{
+					peerURLsMap: "infra2=http://192.168.0.102:2380",
+				},
+				{
+					peerURLsMap: "infra3=http://192.168.0.103:2380",
+				},
+			},
+			clusterSize:   3,
+			expectedError: ErrInsufficientMembers,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clsInfo := &clusterInfo{
+				members: tc.members,
+			}
+
+			retStr, err := clsInfo.getInitClusterStr(tc.clusterSize)
+			if err != tc.expectedError {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+
+			if err == nil {
+				if retStr != tc.expectedResult {
+					t.Errorf("Unexpected result, expected: %s, got: %s", tc.expectedResult, retStr)
+				}
+			}
+		})
+	}
+}
+
+func TestClusterInfoAdd(t *testing.T) {
+	memberKey := "/_etcd/registry/fakeToken/members/" + types.ID(101).String()
+
+	cases := []struct {
+		name          string
+		memberKey     string
+		memberValue   string
+		expectedValue string
+		expectedErr   bool
+	}{
+		{
+			name:          "legacy format",
+			memberKey:     memberKey,
+			memberValue:   "infra1=http://192.168.0.101:2380,infra1=http://192.168.0.111:2380",
+			expectedValue: "infra1=http://192.168.0.101:2380,infra1=http://192.168.0.111:2380",
+		},
+		{
+			name:          "structured format",
+			memberKey:     memberKey,
+			memberValue:   `{"name":"infra1","peerURLs":["http://192.168.0.101:2380"]}`,
+			expectedValue: "infra1=http://192.168.0.101:2380",
+		},
+		{
+			name:        "invalid registry key",
+			memberKey:   "/invalidPrefix/fakeToken/members/" + types.ID(101).String(),
+			memberValue: "infra1=http://192.168.0.101:2380",
+			expectedErr: true,
+		},
+		{
+			name:        "no name",
+			memberKey:   memberKey,
+			memberValue: "http://192.168.0.101:2380",
+			expectedErr: true,
+		},
+		{
+			name:        "empty name",
+			memberKey:   memberKey,
+			memberValue: "=http://192.168.0.101:2380",
+			expectedErr: true,
+		},
+		{
+			name:        "more than one name",
+			memberKey:   memberKey,
+			memberValue: "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380",
+			expectedErr: true,
+		},
+		{
+			name:        "invalid peer URL",
+			memberKey:   memberKey,
+			memberValue: "infra1=192.168.0.101:2380",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cls := &clusterInfo{clusterToken: "fakeToken"}
+			err := cls.add(tc.memberKey, tc.memberValue, 7)
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("Unexpected error, expected error: %t, got: %v", tc.expectedErr, err)
+			}
+			if tc.expectedErr {
+				if len(cls.members) != 0 {
+					t.Errorf("Unexpected members added: %v", cls.members)
+				}
+				return
+			}
+			if len(cls.members) != 1 || cls.members[0].peerURLsMap != tc.expectedValue {
+				t.Errorf("Unexpected members, expected: %s, got: %v", tc.expectedValue, cls.members)
+			}
+		})
+	}
+}
+
+func TestClusterInfoOrderWithSameCreateRev(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   7,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.101:2380",
+			createRev:   7,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   7,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(104).String(),
+			peerURLsMap: "infra1=http://192.168.0.104:2380",
+			createRev:   7,
+		},
+	}
+
+	// Each observer reads the members in a different order, and all of
+	// them must select the same members in the same order.
+	expected := "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380"
+	orders := [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}, {1, 3, 0, 2}}
+	for _, order := range orders {
+		cls := &clusterInfo{clusterToken: "fakeToken"}
+		for _, i := range order {
+			m := members[i]
+			cls.add(m.peerRegKey, m.peerURLsMap, m.createRev)
+		}
+		cs, err := cls.getInitClusterStr(2)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if cs != expected {
+			t.Errorf("Unexpected cluster with order %v, expected: %s, got: %s", order, expected, cs)
+		}
+	}
+}
+
+func TestGetInitClusterStrPeerScheme(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/66",
+			peerURLsMap: "infra2=https://192.168.0.102:2380",
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/67",
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+		},
+	}
+
+	cases := []struct {
+		name          string
+		peerScheme    string
+		clusterSize   int
+		expectedError error
+	}{
+		{
+			name:        "no check",
+			peerScheme:  "",
+			clusterSize: 2,
+		},
+		{
+			name:        "matching scheme",
+			peerScheme:  "https",
+			clusterSize: 1,
+		},
+		{
+			name:          "mismatched https scheme",
+			peerScheme:    "https",
+			clusterSize:   2,
+			expectedError: ErrSchemeMismatch,
+		},
+		{
+			name:          "mismatched http scheme",
+			peerScheme:    "http",
+			clusterSize:   1,
+			expectedError: ErrSchemeMismatch,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			clsInfo := &clusterInfo{
+				members:    members,
+				peerScheme: tc.peerScheme,
+			}
+
+			_, err := clsInfo.getInitClusterStr(tc.clusterSize)
+			if !errors.Is(err, tc.expectedError) {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "infra") {
+				t.Errorf("Expected the error to name the member, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	cases := []struct {
+		name              string
+		prefix            string
+		expectedSizeKey   string
+		expectedMemberKey string
+	}{
+		{
+			name:              "default prefix",
+			expectedSizeKey:   "/_etcd/registry/fakeToken/_config/size",
+			expectedMemberKey: "/_etcd/registry/fakeToken/members/65",
+		},
+		{
+			name:              "custom prefix",
+			prefix:            "/tenant1/discovery",
+			expectedSizeKey:   "/tenant1/discovery/fakeToken/_config/size",
+			expectedMemberKey: "/tenant1/discovery/fakeToken/members/65",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if key := geClusterSizeKey(tc.prefix, "fakeToken"); key != tc.expectedSizeKey {
+				t.Errorf("Unexpected size key, expected: %s, got: %s", tc.expectedSizeKey, key)
+			}
+			memberKey := getMemberKey(tc.prefix, "fakeToken", types.ID(101).String())
+			if memberKey != tc.expectedMemberKey {
+				t.Errorf("Unexpected member key, expected: %s, got: %s", tc.expectedMemberKey, memberKey)
+			}
+
+			cls := &clusterInfo{clusterToken: "fakeToken", keyPrefix: tc.prefix}
+			if err := cls.add(memberKey, "infra1=http://192.168.0.101:2380", 8); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			otherKey := "/other/fakeToken/members/" + types.ID(102).String()
+			if err := cls.add(otherKey, "infra2=http://192.168.0.102:2380", 9); err == nil {
+				t.Errorf("Expected an error for a key out of the prefix")
+			}
+		})
+	}
+}
+
+func TestGetPeerURLsByMember(t *testing.T) {
+	cls := &clusterInfo{
+		members: []memberInfo{
+			{peerURLsMap: "infra1=http://192.168.0.101:2380,infra1=http://10.0.0.101:2380"},
+			{peerURLsMap: "infra2=http://192.168.0.102:2380"},
+			{peerURLsMap: "infra3=http://192.168.0.103:2380"},
+		},
+	}
+
+	m, err := cls.getPeerURLsByMember(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string][]string{
+		"infra1": {"http://192.168.0.101:2380", "http://10.0.0.101:2380"},
+		"infra2": {"http://192.168.0.102:2380"},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Errorf("Unexpected peer URLs, expected: %v, got: %v", expected, m)
+	}
+
+	if _, err := cls.getPeerURLsByMember(4); err != ErrInsufficientMembers {
+		t.Errorf("Unexpected error, expected: %v, got: %v", ErrInsufficientMembers, err)
+	}
+}
+
+func TestGetMemberAddPlan(t *testing.T) {
+	cls := &clusterInfo{clusterToken: "fakeToken"}
+	// the members are added out of order, the plan follows CreateRevision.
+	for _, m := range []memberInfo{
+		{peerRegKey: "/_etcd/registry/fakeToken/members/" + types.ID(102).String(), peerURLsMap: "infra2=http://192.168.0.102:2380", createRev: 9},
+		{peerRegKey: "/_etcd/registry/fakeToken/members/" + types.ID(103).String(), peerURLsMap: "infra3=http://192.168.0.103:2380", createRev: 10},
+		{peerRegKey: "/_etcd/registry/fakeToken/members/" + types.ID(101).String(), peerURLsMap: "infra1=http://192.168.0.101:2380,infra1=http://10.0.0.101:2380", createRev: 8},
+	} {
+		if err := cls.add(m.peerRegKey, m.peerURLsMap, m.createRev); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	plan, err := cls.getMemberAddPlan(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []MemberAddStep{
+		{Name: "infra1", PeerURLs: []string{"http://192.168.0.101:2380", "http://10.0.0.101:2380"}},
+		{Name: "infra2", PeerURLs: []string{"http://192.168.0.102:2380"}},
+	}
+	if !reflect.DeepEqual(plan, expected) {
+		t.Errorf("Unexpected plan, expected: %v, got: %v", expected, plan)
+	}
+
+	if _, err := cls.getMemberAddPlan(4); err != ErrInsufficientMembers {
+		t.Errorf("Unexpected error, expected: %v, got: %v", ErrInsufficientMembers, err)
+	}
+}
+
+func TestRegisteredMembers(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.101:2380",
+			createRev:   8,
+			modRev:      8,
+		},
+		{
+			// re-registered during the bootstrap.
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   9,
+			modRev:      12,
+		},
+	}
+
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForCheckCluster{
+				fakeBaseKV:     &fakeBaseKV{},
+				t:              t,
+				token:          "fakeToken",
+				clusterSizeStr: "2",
+				members:        members,
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+	}
+
+	cls, _, err := d.getClusterMembers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// infra1 registers again, which is seen by the watch.
+	d.addPeer(cls, &mvccpb.KeyValue{
+		Key:            []byte(members[0].peerRegKey),
+		Value:          []byte(members[0].peerURLsMap),
+		CreateRevision: 8,
+		ModRevision:    13,
+	})
+
+	expected := []RegisteredMember{
+		{
+			Key:            members[0].peerRegKey,
+			ID:             101,
+			Name:           "infra1",
+			PeerURLs:       []string{"http://192.168.0.101:2380"},
+			CreateRevision: 8,
+			ModRevision:    13,
+		},
+		{
+			Key:            members[1].peerRegKey,
+			ID:             102,
+			Name:           "infra2",
+			PeerURLs:       []string{"http://192.168.0.102:2380"},
+			CreateRevision: 9,
+			ModRevision:    12,
+		},
+	}
+	if got := cls.getRegisteredMembers(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Unexpected registered members, expected: %+v, got: %+v", expected, got)
+	}
+}
+
+// fakeKVForReadOnly fails the test on any write, and doesn't have the size
+// key if clusterSizeStr is empty.
+type fakeKVForReadOnly struct {
+	*fakeKVForCheckCluster
+}
+
+func (fkv *fakeKVForReadOnly) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	if fkv.clusterSizeStr == "" && strings.HasSuffix(key, "/_config/size") {
+		return &clientv3.GetResponse{}, nil
+	}
+	return fkv.fakeKVForCheckCluster.Get(ctx, key, opts...)
+}
+
+func (fkv *fakeKVForReadOnly) Put(ctx context.Context, key string, val string, opts ...clientv3.OpOption) (*clientv3.PutResponse, error) {
+	fkv.t.Errorf("unexpected put: %s", key)
+	return nil, errors.New("read-only")
+}
+
+func (fkv *fakeKVForReadOnly) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
+	fkv.t.Errorf("unexpected delete: %s", key)
+	return nil, errors.New("read-only")
+}
+
+func TestGetClusterMembersResult(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.101:2380",
+			createRev:   8,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   9,
+		},
+	}
+
+	cases := []struct {
+		name                string
+		clusterSizeStr      string
+		expectedClusterSize int
+	}{
+		{
+			name:                "cluster forming",
+			clusterSizeStr:      "3",
+			expectedClusterSize: 3,
+		},
+		{
+			name: "size not configured yet",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForReadOnly{
+						fakeKVForCheckCluster: &fakeKVForCheckCluster{
+							fakeBaseKV:     &fakeBaseKV{},
+							t:              t,
+							token:          "fakeToken",
+							clusterSizeStr: tc.clusterSizeStr,
+							members:        members,
+						},
+					},
+				},
+				cfg:          &DiscoveryConfig{},
+				clusterToken: "fakeToken",
+			}
+
+			// polling again gives the same result.
+			for i := 0; i < 2; i++ {
+				r, err := d.getClusterMembersResult()
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if r.ClusterSize != tc.expectedClusterSize || r.Revision != 10 {
+					t.Errorf("Unexpected cluster size and revision, expected: (%d, 10), got: (%d, %d)", tc.expectedClusterSize, r.ClusterSize, r.Revision)
+				}
+				if len(r.Members) != 2 || r.Members[0].Name != "infra1" || r.Members[1].ID != 102 || r.Members[1].CreateRevision != 9 {
+					t.Errorf("Unexpected members: %+v", r.Members)
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateMemberName(t *testing.T) {
+	first := memberInfo{
+		peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+		peerURLsMap: "infra1=http://192.168.0.102:2380",
+		createRev:   8,
+	}
+	second := memberInfo{
+		peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+		peerURLsMap: "infra1=http://192.168.0.101:2380",
+		createRev:   9,
+	}
+
+	cases := []struct {
+		name    string
+		members []memberInfo
+	}{
+		{
+			name:    "first registered added first",
+			members: []memberInfo{first, second},
+		},
+		{
+			name:    "first registered added last",
+			members: []memberInfo{second, first},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cls := &clusterInfo{clusterToken: "fakeToken"}
+			if err := cls.add(tc.members[0].peerRegKey, tc.members[0].peerURLsMap, tc.members[0].createRev); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			err := cls.add(tc.members[1].peerRegKey, tc.members[1].peerURLsMap, tc.members[1].createRev)
+			if !errors.Is(err, ErrDuplicateName) {
+				t.Fatalf("Expected ErrDuplicateName, got: %v", err)
+			}
+			if !strings.Contains(err.Error(), first.peerRegKey) || !strings.Contains(err.Error(), second.peerRegKey) {
+				t.Errorf("Expected both keys in the error, got: %v", err)
+			}
+			if !reflect.DeepEqual(cls.members, []memberInfo{first}) {
+				t.Errorf("Unexpected members, expected: %v, got: %v", []memberInfo{first}, cls.members)
+			}
+		})
+	}
+
+	// the members are read in the order of their keys.
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForCheckCluster{
+				fakeBaseKV: &fakeBaseKV{},
+				t:          t,
+				token:      "fakeToken",
+				members:    []memberInfo{second, first},
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+	}
+	cls, _, err := d.getClusterMembers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cls.Len() != 1 || cls.members[0].peerRegKey != first.peerRegKey {
+		t.Errorf("Unexpected members, expected only %s, got: %v", first.peerRegKey, cls.members)
+	}
+}
+
+func TestLearnerFormation(t *testing.T) {
+	learner := func(s string) string {
+		v, err := withMeta(s, metaLearner, "true")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	key := func(id types.ID) string {
+		return "/_etcd/registry/fakeToken/members/" + id.String()
+	}
+
+	cls := &clusterInfo{clusterToken: "fakeToken"}
+	for i, m := range []struct {
+		id    types.ID
+		value string
+	}{
+		{101, "infra1=http://192.168.0.101:2380"},
+		{201, learner("learner1=http://192.168.0.201:2380")},
+		{102, "infra2=http://192.168.0.102:2380"},
+		{202, learner("learner2=http://192.168.0.202:2380")},
+		{103, "infra3=http://192.168.0.103:2380"},
+		{104, "infra4=http://192.168.0.104:2380"},
+		{203, learner("learner3=http://192.168.0.203:2380")},
+	} {
+		if err := cls.add(key(m.id), m.value, int64(5+i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	if cls.voters() != 4 {
+		t.Errorf("Unexpected voting members, expected: 4, got: %d", cls.voters())
+	}
+
+	// The learners don't count toward the cluster size.
+	for _, tc := range []struct {
+		id       types.ID
+		expected int
+	}{
+		{101, 0}, {201, 1}, {202, 2}, {103, 2}, {104, 3}, {203, 4}, {105, 4},
+	} {
+		if rank := selfRank(cls, key(tc.id)); rank != tc.expected {
+			t.Errorf("Unexpected rank of %s, expected: %d, got: %d", tc.id, tc.expected, rank)
+		}
+	}
+	if !cls.isSeed(key(101), 3) || cls.isSeed(key(201), 3) {
+		t.Errorf("Unexpected seed")
+	}
+
+	r, err := cls.getClusterResult(3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var members []string
+	for _, m := range r.Members {
+		members = append(members, fmt.Sprintf("%s:%t", m.Name, m.IsLearner))
+	}
+	expectedMembers := []string{"infra1:false", "learner1:true", "infra2:false", "learner2:true", "infra3:false"}
+	if !reflect.DeepEqual(members, expectedMembers) {
+		t.Errorf("Unexpected members, expected: %v, got: %v", expectedMembers, members)
+	}
+	expectedStr := "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380"
+	if r.String() != expectedStr {
+		t.Errorf("Unexpected cluster, expected: %s, got: %s", expectedStr, r.String())
+	}
+	if cs, err := cls.getInitClusterStr(3); err != nil || cs != expectedStr {
+		t.Errorf("Unexpected initial cluster, expected: %s, got: %s (%v)", expectedStr, cs, err)
+	}
+
+	// Only two voting members registered before the first learner.
+	partial := &clusterInfo{clusterToken: "fakeToken", members: cls.members[:4]}
+	if _, err := partial.getClusterResult(3); err != ErrInsufficientMembers {
+		t.Errorf("Unexpected error, expected: %v, got: %v", ErrInsufficientMembers, err)
+	}
+}
+
+func TestRegisterSelfAsLearner(t *testing.T) {
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForRegisterSelf{
+				fakeBaseKV:       &fakeBaseKV{},
+				t:                t,
+				expectedRegKey:   "/_etcd/registry/fakeToken/members/" + types.ID(201).String(),
+				expectedRegValue: `{"name":"learner1","peerURLs":["http://192.168.0.201:2380"],"meta":{"learner":"true"}}`,
+			},
+		},
+		cfg:          &DiscoveryConfig{RegisterAsLearner: true},
+		clusterToken: "fakeToken",
+		memberId:     201,
+		clock:        clockwork.NewFakeClock(),
+	}
+
+	if err := d.registerSelf("learner1=http://192.168.0.201:2380"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestGetClusterResult(t *testing.T) {
+	newClusterInfo := func(keyByName bool) *clusterInfo {
+		cls := &clusterInfo{clusterToken: "fakeToken", keyByName: keyByName}
+		for i, v := range []string{
+			"infra1=http://192.168.0.101:2380",
+			"infra2=http://192.168.0.102:2380,infra2=http://10.0.0.102:2380",
+			"infra3=http://192.168.0.103:2380",
+		} {
+			key := "/_etcd/registry/fakeToken/members/" + types.ID(101+i).String()
+			if keyByName {
+				key = fmt.Sprintf("/_etcd/registry/fakeToken/members/infra%d", i+1)
+			}
+			if err := cls.add(key, v, int64(8+i)); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		return cls
+	}
+
+	r, err := newClusterInfo(false).getClusterResult(2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &ClusterResult{
+		ClusterToken: "fakeToken",
+		ClusterSize:  2,
+		Members: []RegisteredMember{
+			{
+				Key:            "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+				ID:             101,
+				Name:           "infra1",
+				PeerURLs:       []string{"http://192.168.0.101:2380"},
+				CreateRevision: 8,
+			},
+			{
+				Key:            "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+				ID:             102,
+				Name:           "infra2",
+				PeerURLs:       []string{"http://192.168.0.102:2380", "http://10.0.0.102:2380"},
+				CreateRevision: 9,
+			},
+		},
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("Unexpected result, expected: %+v, got: %+v", expected, r)
+	}
+	expectedStr := "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380,infra2=http://10.0.0.102:2380"
+	if r.String() != expectedStr {
+		t.Errorf("Unexpected string, expected: %s, got: %s", expectedStr, r.String())
+	}
+
+	r, err = newClusterInfo(true).getClusterResult(3)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, m := range r.Members {
+		if m.ID != 0 {
+			t.Errorf("Unexpected ID of member %s keyed by name: %s", m.Name, m.ID)
+		}
+	}
+
+	if _, err := newClusterInfo(false).getClusterResult(4); err != ErrInsufficientMembers {
+		t.Errorf("Expected ErrInsufficientMembers, got: %v", err)
+	}
+}
+
+func TestValidateInitialCluster(t *testing.T) {
 	cases := []struct {
-		name           string
-		members        []memberInfo
-		clusterSize    int
-		expectedResult string
-		expectedError  error
+		name          string
+		cluster       string
+		insecure      bool
+		expectedError error
 	}{
 		{
-			name: "1 member",
-			members: []memberInfo{
-				{
-					peerURLsMap: "infra2=http://192.168.0.102:2380",
-				},
-			},
-			clusterSize:    1,
-			expectedResult: "infra2=http://192.168.0.102:2380",
-			expectedError:  nil,
+			name:     "valid cluster",
+			cluster:  "infra1=http://192.168.0.100:2380,infra2=http://192.168.0.102:2380",
+			insecure: true,
 		},
 		{
-			name: "2 members",
-			members: []memberInfo{
-				{
-					peerURLsMap: "infra2=http://192.168.0.102:2380",
-				},
-				{
-					peerURLsMap: "infra3=http://192.168.0.103:2380",
-				},
-			},
-			clusterSize:    2,
-			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380",
-			expectedError:  nil,
+			name:    "valid secure cluster",
+			cluster: "infra1=https://192.168.0.100:2380,infra2=https://192.168.0.102:2380",
 		},
 		{
-			name: "3 members",
-			members: []memberInfo{
-				{
-					peerURLsMap: "infra2=http://192.168.0.102:2380",
-				},
-				{
-					peerURLsMap: "infra3=http://192.168.0.103:2380",
-				},
-				{
-					peerURLsMap: "infra1=http://192.168.0.100:2380",
-				},
-			},
-			clusterSize:    3,
-			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380,infra1=http://192.168.0.100:2380",
-			expectedError:  nil,
+			name:     "member with multiple peer URLs",
+			cluster:  "infra1=http://192.168.0.100:2380,infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380",
+			insecure: true,
 		},
 		{
-			name: "should ignore redundant member",
-			members: []memberInfo{
-				{
-					peerURLsMap: "infra2=http://192.168.0.102:2380",
-				},
-				{
-					peerURLsMap: "infra3=http://192.168.0.103:2380",
-				},
-				{
-					peerURLsMap: "infra1=http://192.168.0.100:2380",
-				},
-				{
-					peerURLsMap: "infra4=http://192.168.0.104:2380",
-				},
-			},
-			clusterSize:    3,
-			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380,infra1=http://192.168.0.100:2380",
-			expectedError:  nil,
+			name:          "invalid peer URL",
+			cluster:       "infra1=http://192.168.0.100:2380,infra2=http://192.168.0.102",
+			insecure:      true,
+			expectedError: ErrInvalidURL,
 		},
 		{
-			name: "invalid_peer_url",
-			members: []memberInfo{
-				{
-					peerURLsMap: "infra2=http://192.168.0.102:2380",
-				},
-				{
-					peerURLsMap: "infra3=http://192.168.0.103", //not host:port
-				},
-			},
-			clusterSize:    2,
-			expectedResult: "infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380",
-			expectedError:  ErrInvalidURL,
+			name:          "missing member name",
+			cluster:       "http://192.168.0.100:2380",
+			insecure:      true,
+			expectedError: ErrInvalidURL,
+		},
+		{
+			name:          "duplicate member name",
+			cluster:       "infra1=http://192.168.0.100:2380,infra2=http://192.168.0.102:2380,infra1=http://192.168.0.103:2380",
+			insecure:      true,
+			expectedError: ErrDuplicateName,
+		},
+		{
+			name:          "mixed schemes",
+			cluster:       "infra1=http://192.168.0.100:2380,infra2=https://192.168.0.102:2380",
+			insecure:      true,
+			expectedError: ErrSchemeMismatch,
+		},
+		{
+			name:          "insecure scheme in secure mode",
+			cluster:       "infra1=http://192.168.0.100:2380,infra2=http://192.168.0.102:2380",
+			expectedError: ErrSchemeMismatch,
 		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			clsInfo := &clusterInfo{
-				members: tc.members,
+			if err := ValidateInitialCluster(tc.cluster, tc.insecure); !errors.Is(err, tc.expectedError) {
+				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
 			}
+		})
+	}
+}
 
-			retStr, err := clsInfo.getInitClusterStr(tc.clusterSize)
-			if err != tc.expectedError {
-				t.Errorf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+func TestNewDiscoveryClock(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	cases := []struct {
+		name  string
+		clock clockwork.Clock
+	}{
+		{name: "default clock"},
+		{name: "injected clock", clock: fc},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &DiscoveryConfig{
+				DialTimeout:    time.Second,
+				RequestTimeOut: time.Second,
+				Clock:          tc.clock,
+			}
+			d, err := newDiscovery(context.Background(), zap.NewNop(), "http://127.0.0.1:2379/fakeToken", cfg, 0)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
 			}
+			defer d.close()
 
-			if err == nil {
-				if retStr != tc.expectedResult {
-					t.Errorf("Unexpected result, expected: %s, got: %s", tc.expectedResult, retStr)
-				}
+			if tc.clock != nil && d.clock != tc.clock {
+				t.Errorf("The injected clock isn't used")
+			}
+			if tc.clock == nil && d.clock == nil {
+				t.Errorf("Expected a default clock")
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cases := []struct {
+		name                string
+		baseBackoffInterval time.Duration
+		maxBackoffInterval  time.Duration
+		retries             uint
+		expectedBackoff     time.Duration
+	}{
+		{
+			name:            "first retry",
+			retries:         1,
+			expectedBackoff: 2 * time.Second,
+		},
+		{
+			name:            "default cap",
+			retries:         20,
+			expectedBackoff: 256 * time.Second,
+		},
+		{
+			name:               "below the configured cap",
+			maxBackoffInterval: 30 * time.Second,
+			retries:            4,
+			expectedBackoff:    16 * time.Second,
+		},
+		{
+			name:               "configured cap",
+			maxBackoffInterval: 30 * time.Second,
+			retries:            5,
+			expectedBackoff:    30 * time.Second,
+		},
+		{
+			name:               "configured cap above the default one",
+			maxBackoffInterval: time.Hour,
+			retries:            20,
+			expectedBackoff:    time.Hour,
+		},
+		{
+			name:                "configured base",
+			baseBackoffInterval: 50 * time.Millisecond,
+			retries:             3,
+			expectedBackoff:     400 * time.Millisecond,
+		},
+		{
+			name:                "default cap with configured base",
+			baseBackoffInterval: 50 * time.Millisecond,
+			retries:             20,
+			expectedBackoff:     256 * 50 * time.Millisecond,
+		},
+		{
+			name:                "configured base and cap",
+			baseBackoffInterval: 50 * time.Millisecond,
+			maxBackoffInterval:  time.Second,
+			retries:             100,
+			expectedBackoff:     time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &discovery{
+				cfg:     &DiscoveryConfig{BaseBackoffInterval: tc.baseBackoffInterval, MaxBackoffInterval: tc.maxBackoffInterval},
+				retries: tc.retries,
+			}
+			if backoff := d.backoff(); backoff != tc.expectedBackoff {
+				t.Errorf("Unexpected backoff, expected: %v, got: %v", tc.expectedBackoff, backoff)
+			}
+		})
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	d := &discovery{
+		lg:    zap.NewNop(),
+		cfg:   &DiscoveryConfig{},
+		clock: clockwork.NewFakeClock(),
+		rand:  rand.New(rand.NewSource(1)),
+	}
+	expected := rand.New(rand.NewSource(1))
+
+	for i := 1; i <= 10; i++ {
+		backoff := time.Duration(0x1<<uint(i)) * time.Second
+		if i > int(maxExponentialRetries) {
+			backoff = time.Duration(0x1<<maxExponentialRetries) * time.Second
+		}
+		expectedJitter := time.Duration(expected.Int63n(int64(backoff) + 1))
+
+		d.retries = uint(i)
+		jitter := d.jitter(d.backoff())
+		if jitter != expectedJitter {
+			t.Errorf("Unexpected jitter of retry %d, expected: %v, got: %v", i, expectedJitter, jitter)
+		}
+		if jitter < 0 || jitter > backoff {
+			t.Errorf("Jitter of retry %d out of range [0, %v]: %v", i, backoff, jitter)
+		}
+	}
+
+	// no jitter without a source.
+	d.rand = nil
+	if jitter := d.jitter(2 * time.Second); jitter != 2*time.Second {
+		t.Errorf("Unexpected backoff without jitter, expected: %v, got: %v", 2*time.Second, jitter)
+	}
+}
+
+func TestParseDiscoveryURLs(t *testing.T) {
+	cases := []struct {
+		name              string
+		durl              string
+		expectedEndpoints []string
+		expectedToken     string
+		expectedError     error
+	}{
+		{
+			name:              "single url",
+			durl:              "https://disco.example.com/token",
+			expectedEndpoints: []string{"https://disco.example.com"},
+			expectedToken:     "/token",
+		},
+		{
+			name:              "multiple urls",
+			durl:              "https://disco1.example.com:2379/token, disco2.example.com:2379/token/",
+			expectedEndpoints: []string{"https://disco1.example.com:2379", "https://disco2.example.com:2379"},
+			expectedToken:     "/token",
+		},
+		{
+			name:          "inconsistent tokens",
+			durl:          "https://disco1.example.com/token1,https://disco2.example.com/token2",
+			expectedError: ErrInvalidDiscoveryURL,
+		},
+		{
+			name:          "invalid url",
+			durl:          "https://disco1.example.com/token,http:///token",
+			expectedError: ErrInvalidDiscoveryURL,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoints, token, err := parseDiscoveryURLs(tc.durl, false)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(endpoints, tc.expectedEndpoints) {
+				t.Errorf("Unexpected endpoints, expected: %v, got: %v", tc.expectedEndpoints, endpoints)
+			}
+			if token != tc.expectedToken {
+				t.Errorf("Unexpected token, expected: %s, got: %s", tc.expectedToken, token)
+			}
+		})
+	}
+}
+
+func TestParseDiscoveryURL(t *testing.T) {
+	cases := []struct {
+		name             string
+		durl             string
+		insecure         bool
+		expectedEndpoint string
+		expectedToken    string
+		expectedError    error
+	}{
+		{
+			name:             "full url",
+			durl:             "https://disco.example.com/token",
+			expectedEndpoint: "https://disco.example.com",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "scheme-less url with secure transport",
+			durl:             "disco.example.com/token",
+			expectedEndpoint: "https://disco.example.com",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "scheme-less url with insecure transport",
+			durl:             "disco.example.com/token",
+			insecure:         true,
+			expectedEndpoint: "http://disco.example.com",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "trailing slash",
+			durl:             "http://disco.example.com/token/",
+			expectedEndpoint: "http://disco.example.com",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "port-bearing url",
+			durl:             "http://disco.example.com:2379/token",
+			expectedEndpoint: "http://disco.example.com:2379",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "scheme-less port-bearing url",
+			durl:             "disco.example.com:2379/token",
+			insecure:         true,
+			expectedEndpoint: "http://disco.example.com:2379",
+			expectedToken:    "/token",
+		},
+		{
+			name:          "no host",
+			durl:          "http:///token",
+			expectedError: ErrInvalidDiscoveryURL,
+		},
+		{
+			name:          "no token",
+			durl:          "https://disco.example.com",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:          "root path",
+			durl:          "https://disco.example.com/",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:          "nested token",
+			durl:          "https://disco.example.com/token/members",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:          "escaped slash",
+			durl:          "https://disco.example.com/token%2Fmembers",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:          "dot dot",
+			durl:          "https://disco.example.com/..",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:          "space",
+			durl:          "https://disco.example.com/to%20ken",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:             "absolute unix socket",
+			durl:             "unix:///var/run/etcd.sock/token",
+			expectedEndpoint: "unix:///var/run/etcd.sock",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "relative unix socket",
+			durl:             "unix://etcd.sock/token/",
+			expectedEndpoint: "unix://etcd.sock",
+			expectedToken:    "/token",
+		},
+		{
+			name:             "unixs socket",
+			durl:             "unixs:///var/run/etcd.sock/token",
+			expectedEndpoint: "unixs:///var/run/etcd.sock",
+			expectedToken:    "/token",
+		},
+		{
+			name:          "unix socket without token",
+			durl:          "unix://etcd.sock",
+			expectedError: ErrInvalidClusterToken,
+		},
+		{
+			name:          "unix socket without path",
+			durl:          "unix:///token",
+			expectedError: ErrInvalidDiscoveryURL,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			u, token, err := parseDiscoveryURL(tc.durl, tc.insecure)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			if u.String() != tc.expectedEndpoint {
+				t.Errorf("Unexpected endpoint, expected: %s, got: %s", tc.expectedEndpoint, u.String())
+			}
+			if token != tc.expectedToken {
+				t.Errorf("Unexpected token, expected: %s, got: %s", tc.expectedToken, token)
 			}
 		})
 	}
 }
 
+// fakeKVServerForUnixSocket serves the cluster size over gRPC.
+type fakeKVServerForUnixSocket struct {
+	etcdserverpb.UnimplementedKVServer
+	sizeKey string
+}
+
+func (s *fakeKVServerForUnixSocket) Range(ctx context.Context, req *etcdserverpb.RangeRequest) (*etcdserverpb.RangeResponse, error) {
+	if string(req.Key) != s.sizeKey {
+		return &etcdserverpb.RangeResponse{Header: &etcdserverpb.ResponseHeader{}}, nil
+	}
+	return &etcdserverpb.RangeResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Kvs:    []*mvccpb.KeyValue{{Key: req.Key, Value: []byte("3")}},
+		Count:  1,
+	}, nil
+}
+
+func TestDiscoveryOverUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "etcd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	etcdserverpb.RegisterKVServer(srv, &fakeKVServerForUnixSocket{sizeKey: geClusterSizeKey("", "/fakeToken")})
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	// The transport security defaults to TLS, but not over a unix socket.
+	cfg := &DiscoveryConfig{
+		DialTimeout:    5 * time.Second,
+		RequestTimeOut: 5 * time.Second,
+	}
+	d, err := newDiscovery(context.Background(), zap.NewNop(), "unix://"+sock+"/fakeToken", cfg, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.close()
+
+	if d.clusterToken != "/fakeToken" {
+		t.Errorf("Unexpected cluster token: %s", d.clusterToken)
+	}
+	if d.c.Endpoints()[0] != "unix://"+sock {
+		t.Errorf("Unexpected endpoints: %v", d.c.Endpoints())
+	}
+	size, err := d.getClusterSize()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if size != 3 {
+		t.Errorf("Unexpected cluster size, expected: 3, got: %d", size)
+	}
+}
+
 // fakeBaseKV is the base struct implementing the interface `clientv3.KV`.
 type fakeBaseKV struct{}
 
@@ -748,7 +4297,7 @@ func (fkv *fakeBaseKV) Put(ctx context.Context, key string, val string, opts ...
 }
 
 func (fkv *fakeBaseKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
-	return nil, nil
+	return &clientv3.GetResponse{}, nil
 }
 
 func (fkv *fakeBaseKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.DeleteResponse, error) {
@@ -0,0 +1,157 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DiscoveryEventType is the type of DiscoveryEvent.
+type DiscoveryEventType int
+
+const (
+	// EventConnected is published once the discovery client is created.
+	EventConnected DiscoveryEventType = iota
+	// EventSizeRead is published when the cluster size is read.
+	EventSizeRead
+	// EventRegisteredSelf is published when the local member registers itself.
+	EventRegisteredSelf
+	// EventPeerJoined is published when a peer is found.
+	EventPeerJoined
+	// EventRetrying is published before backing off for a retry.
+	EventRetrying
+	// EventClusterComplete is published when all needed peers are found.
+	EventClusterComplete
+)
+
+func (t DiscoveryEventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventSizeRead:
+		return "size-read"
+	case EventRegisteredSelf:
+		return "registered-self"
+	case EventPeerJoined:
+		return "peer-joined"
+	case EventRetrying:
+		return "retrying"
+	case EventClusterComplete:
+		return "cluster-complete"
+	default:
+		return "unknown"
+	}
+}
+
+// DiscoveryEvent describes the progress of the discovery. Only the fields
+// relevant to the Type are set.
+type DiscoveryEvent struct {
+	Type DiscoveryEventType
+
+	// ClusterSize is set for EventSizeRead and EventClusterComplete.
+	ClusterSize int
+	// Peer is the peer info in the format "peerName=peerURLs", which is set
+	// for EventRegisteredSelf and EventPeerJoined.
+	Peer string
+	// PeersFound is set for EventPeerJoined and EventClusterComplete.
+	PeersFound int
+	// Reason and Backoff are set for EventRetrying.
+	Reason  string
+	Backoff time.Duration
+}
+
+// emit publishes the event to the configured channel without blocking.
+func (d *discovery) emit(ev DiscoveryEvent) {
+	if d.cfg == nil || d.cfg.Events == nil {
+		return
+	}
+	select {
+	case d.cfg.Events <- ev:
+	default:
+	}
+}
+
+// The lifecycle events of the discovery are logged with the logEventKey
+// field, so that they can be filtered by log pipelines. The other fields of
+// these logs use consistent keys as well: "phase", "retries", "backoff",
+// "found-peers", "cluster-size" and "outcome".
+const (
+	logEventKey = "discovery_event"
+
+	logEventRetry             = "retry"
+	logEventRegisteredSelf    = "registered_self"
+	logEventPeerFound         = "peer_found"
+	logEventPeersComplete     = "peers_complete"
+	logEventClusterFull       = "cluster_full"
+	logEventFormationComplete = "formation_complete"
+	logEventFormationFailed   = "formation_failed"
+)
+
+// The phases of the discovery, as logged and as labels of the metrics.
+const (
+	phaseCheckCluster = "check_cluster"
+	phaseRegisterSelf = "register_self"
+	phaseWaitPeers    = "wait_peers"
+)
+
+// retryPhases maps the steps retried by logAndBackoffForRetry to the phase
+// they belong to.
+var retryPhases = map[string]string{
+	"cluster status check":   phaseCheckCluster,
+	"register member itself": phaseRegisterSelf,
+	"watch peers":            phaseWaitPeers,
+}
+
+// logEvent returns the field tagging a log with the given lifecycle event.
+func logEvent(name string) zap.Field {
+	return zap.String(logEventKey, name)
+}
+
+// logOutcome logs the outcome of the discovery, i.e. the cluster r or the
+// error err, as a formation_complete, cluster_full or formation_failed event
+// with the given success or failure message.
+func (d *discovery) logOutcome(r *ClusterResult, err error, successMsg, failureMsg string) {
+	switch {
+	case err == nil:
+		d.lg.Info(
+			successMsg,
+			logEvent(logEventFormationComplete),
+			zap.String("outcome", "success"),
+			zap.Int("cluster-size", r.ClusterSize),
+			zap.String("cluster", r.String()),
+			zap.Duration("elapsed", r.Elapsed),
+			zap.Int("retries", r.Retries),
+			zap.Uint("peak-retries", d.peakRetries),
+		)
+	case errors.Is(err, ErrFullCluster):
+		d.lg.Error(
+			failureMsg,
+			logEvent(logEventClusterFull),
+			zap.String("outcome", "cluster_full"),
+			zap.Int("cluster-size", d.clusterSize),
+			zap.Error(err),
+		)
+	default:
+		d.lg.Error(
+			failureMsg,
+			logEvent(logEventFormationFailed),
+			zap.String("outcome", "error"),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+)
+
+var ErrInvalidMemberValue = errors.New("discovery: invalid member value")
+
+// metaClientURLs is the metadata key of the structured format carrying the
+// comma separated client URLs of the member, which are used to verify the
+// formed cluster.
+const metaClientURLs = "client-urls"
+
+// metaRegisteredAt is the metadata key of the structured format carrying
+// the time the member registered, in RFC 3339 format, which is used to
+// prune the stale registrations.
+const metaRegisteredAt = "registered-at"
+
+// metaLearner is the metadata key of the structured format marking the
+// member as a learner, if its value is "true". Learners don't count toward
+// the cluster size.
+const metaLearner = "learner"
+
+// MemberAddStep is a step of a member-add plan, i.e. a member to add with
+// the MemberAdd API.
+type MemberAddStep struct {
+	Name     string
+	PeerURLs []string
+}
+
+// structuredMemberValue is the structured form of a member registration.
+type structuredMemberValue struct {
+	Name     string            `json:"name"`
+	PeerURLs []string          `json:"peerURLs"`
+	Meta     map[string]string `json:"meta,omitempty"`
+}
+
+// ParseMemberValue parses the value of a member registration, which is
+// either in the legacy format "name=peerURL1,name=peerURL2", or in the
+// structured JSON format
+//
+//	{"name": "name", "peerURLs": ["peerURL1", "peerURL2"], "meta": {"key": "value"}}
+//
+// and validates the peer URLs. meta is always nil for the legacy format.
+// The returned error wraps ErrInvalidMemberValue.
+func ParseMemberValue(s string) (name string, peerURLs []string, meta map[string]string, err error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		var v structuredMemberValue
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return "", nil, nil, fmt.Errorf("%w: %v", ErrInvalidMemberValue, err)
+		}
+		name, peerURLs, meta = v.Name, v.PeerURLs, v.Meta
+	} else {
+		for _, pair := range strings.Split(s, ",") {
+			i := strings.IndexRune(pair, '=')
+			if i == -1 {
+				// It must be in the format "member1=http://127.0.0.1:2380".
+				return "", nil, nil, fmt.Errorf("%w: %q is not in the format name=peerURL", ErrInvalidMemberValue, pair)
+			}
+			if name != "" && pair[:i] != name {
+				return "", nil, nil, fmt.Errorf("%w: more than one name (%q, %q)", ErrInvalidMemberValue, name, pair[:i])
+			}
+			name = pair[:i]
+			peerURLs = append(peerURLs, pair[i+1:])
+		}
+	}
+
+	if name == "" {
+		return "", nil, nil, fmt.Errorf("%w: empty name", ErrInvalidMemberValue)
+	}
+	if len(peerURLs) == 0 {
+		return "", nil, nil, fmt.Errorf("%w: no peer URLs", ErrInvalidMemberValue)
+	}
+	if _, err := types.NewURLs(peerURLs); err != nil {
+		return "", nil, nil, fmt.Errorf("%w: %v", ErrInvalidMemberValue, err)
+	}
+	return name, peerURLs, meta, nil
+}
+
+// withRegistrationTime returns the member value in the structured format,
+// with the given registration time in its metadata.
+func withRegistrationTime(s string, t time.Time) (string, error) {
+	return withMeta(s, metaRegisteredAt, t.UTC().Format(time.RFC3339))
+}
+
+// withMeta returns the member value in the structured format, with the
+// given key set to the given value in its metadata.
+func withMeta(s, key, value string) (string, error) {
+	name, peerURLs, meta, err := ParseMemberValue(s)
+	if err != nil {
+		return "", err
+	}
+	v := structuredMemberValue{Name: name, PeerURLs: peerURLs, Meta: map[string]string{}}
+	for k, mv := range meta {
+		v.Meta[k] = mv
+	}
+	v.Meta[key] = value
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// legacyMemberValue returns the member value in the legacy format
+// "name=peerURL1,name=peerURL2", which is the format of "--initial-cluster".
+func legacyMemberValue(name string, peerURLs []string) string {
+	pairs := make([]string, len(peerURLs))
+	for i, u := range peerURLs {
+		pairs[i] = name + "=" + u
+	}
+	return strings.Join(pairs, ",")
+}
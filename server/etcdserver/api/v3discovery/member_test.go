@@ -0,0 +1,106 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseMemberValue(t *testing.T) {
+	cases := []struct {
+		name             string
+		value            string
+		expectedName     string
+		expectedPeerURLs []string
+		expectedMeta     map[string]string
+		expectError      bool
+	}{
+		{
+			name:             "single URL",
+			value:            "infra1=http://192.168.0.101:2380",
+			expectedName:     "infra1",
+			expectedPeerURLs: []string{"http://192.168.0.101:2380"},
+		},
+		{
+			name:             "multiple URLs",
+			value:            "infra1=http://192.168.0.101:2380,infra1=http://10.0.0.101:2380",
+			expectedName:     "infra1",
+			expectedPeerURLs: []string{"http://192.168.0.101:2380", "http://10.0.0.101:2380"},
+		},
+		{
+			name:        "no separator",
+			value:       "http://192.168.0.101:2380",
+			expectError: true,
+		},
+		{
+			name:        "empty name",
+			value:       "=http://192.168.0.101:2380",
+			expectError: true,
+		},
+		{
+			name:        "different names",
+			value:       "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380",
+			expectError: true,
+		},
+		{
+			name:        "invalid URL",
+			value:       "infra1=http://192.168.0.101",
+			expectError: true,
+		},
+		{
+			name:             "structured",
+			value:            `{"name":"infra1","peerURLs":["http://192.168.0.101:2380"],"meta":{"zone":"a"}}`,
+			expectedName:     "infra1",
+			expectedPeerURLs: []string{"http://192.168.0.101:2380"},
+			expectedMeta:     map[string]string{"zone": "a"},
+		},
+		{
+			name:        "structured without peer URLs",
+			value:       `{"name":"infra1"}`,
+			expectError: true,
+		},
+		{
+			name:        "malformed structured",
+			value:       `{"name":"infra1",`,
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, peerURLs, meta, err := ParseMemberValue(tc.value)
+			if tc.expectError {
+				if !errors.Is(err, ErrInvalidMemberValue) {
+					t.Fatalf("Expected ErrInvalidMemberValue, got: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if name != tc.expectedName {
+				t.Errorf("Unexpected name, expected: %s, got: %s", tc.expectedName, name)
+			}
+			if !reflect.DeepEqual(peerURLs, tc.expectedPeerURLs) {
+				t.Errorf("Unexpected peer URLs, expected: %v, got: %v", tc.expectedPeerURLs, peerURLs)
+			}
+			if !reflect.DeepEqual(meta, tc.expectedMeta) {
+				t.Errorf("Unexpected meta, expected: %v, got: %v", tc.expectedMeta, meta)
+			}
+		})
+	}
+}
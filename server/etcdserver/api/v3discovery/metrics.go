@@ -0,0 +1,120 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// discoveryMetrics are the metrics of a discovery. A nil *discoveryMetrics
+// records nothing.
+type discoveryMetrics struct {
+	retriesTotal  *prometheus.CounterVec
+	phaseDuration *prometheus.HistogramVec
+	peersFound    prometheus.Gauge
+}
+
+// newDiscoveryMetrics returns the discovery metrics registered with the
+// given registerer, or with the default one if it is nil. The collectors
+// already registered with the same registerer, e.g. by a previous
+// discovery, are reused.
+func newDiscoveryMetrics(r prometheus.Registerer) (*discoveryMetrics, error) {
+	if r == nil {
+		r = prometheus.DefaultRegisterer
+	}
+	m := &discoveryMetrics{
+		retriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "etcd",
+			Subsystem: "discovery",
+			Name:      "retries_total",
+			Help:      "The total number of retries of the requests to the discovery service.",
+		},
+			[]string{"step"},
+		),
+
+		phaseDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "etcd",
+			Subsystem: "discovery",
+			Name:      "phase_duration_seconds",
+			Help:      "The latency distributions of the phases of the discovery, including the retries.",
+
+			// lowest bucket start of upper bound 0.01 sec (10 ms) with factor 2
+			// highest bucket start of 0.01 sec * 2^15 == 327.68 sec
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 16),
+		},
+			[]string{"phase"},
+		),
+
+		peersFound: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "etcd",
+			Subsystem: "discovery",
+			Name:      "peers_found",
+			Help:      "The number of peers found from the discovery service.",
+		}),
+	}
+
+	c, err := registerCollector(r, m.retriesTotal)
+	if err != nil {
+		return nil, err
+	}
+	m.retriesTotal = c.(*prometheus.CounterVec)
+	if c, err = registerCollector(r, m.phaseDuration); err != nil {
+		return nil, err
+	}
+	m.phaseDuration = c.(*prometheus.HistogramVec)
+	if c, err = registerCollector(r, m.peersFound); err != nil {
+		return nil, err
+	}
+	m.peersFound = c.(prometheus.Gauge)
+	return m, nil
+}
+
+// registerCollector registers c with r, and returns the collector registered
+// with r, which is the existing one if c is already registered.
+func registerCollector(r prometheus.Registerer, c prometheus.Collector) (prometheus.Collector, error) {
+	if err := r.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector, nil
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// retried counts a retry of the given phase.
+func (m *discoveryMetrics) retried(phase string) {
+	if m == nil {
+		return
+	}
+	m.retriesTotal.WithLabelValues(phase).Inc()
+}
+
+// observePhase records the given duration of the given phase.
+func (m *discoveryMetrics) observePhase(phase string, took time.Duration) {
+	if m == nil {
+		return
+	}
+	m.phaseDuration.WithLabelValues(phase).Observe(took.Seconds())
+}
+
+// setPeersFound records the number of peers found.
+func (m *discoveryMetrics) setPeersFound(n int) {
+	if m == nil {
+		return
+	}
+	m.peersFound.Set(float64(n))
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestNewDiscoveryMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := newDiscoveryMetrics(reg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// the collectors already registered are reused.
+	m2, err := newDiscoveryMetrics(reg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if m2.retriesTotal != m.retriesTotal || m2.phaseDuration != m.phaseDuration || m2.peersFound != m.peersFound {
+		t.Errorf("Collectors registered again instead of being reused")
+	}
+
+	// the metrics without any sample aren't gathered.
+	m.retried(phaseCheckCluster)
+	m.observePhase(phaseCheckCluster, time.Second)
+
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{
+		"etcd_discovery_retries_total",
+		"etcd_discovery_phase_duration_seconds",
+		"etcd_discovery_peers_found",
+	} {
+		if !names[name] {
+			t.Errorf("Metric %s not registered", name)
+		}
+	}
+
+	// a nil *discoveryMetrics records nothing.
+	var nilMetrics *discoveryMetrics
+	nilMetrics.retried(phaseCheckCluster)
+	nilMetrics.observePhase(phaseCheckCluster, time.Second)
+	nilMetrics.setPeersFound(1)
+}
+
+func TestRetriesMetric(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	// the backoff returns right away once the context is done.
+	cancel()
+
+	m, err := newDiscoveryMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	d := &discovery{
+		lg:      zap.NewNop(),
+		cfg:     &DiscoveryConfig{},
+		clock:   clockwork.NewFakeClock(),
+		ctx:     ctx,
+		metrics: m,
+	}
+
+	d.logAndBackoffForRetry("register member itself")
+	d.logAndBackoffForRetry("register member itself")
+	if got := testutil.ToFloat64(m.retriesTotal.WithLabelValues(phaseRegisterSelf)); got != 2 {
+		t.Errorf("Unexpected retries, expected: 2, got: %v", got)
+	}
+}
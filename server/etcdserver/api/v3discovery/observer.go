@@ -0,0 +1,149 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"strings"
+
+	"go.etcd.io/etcd/client/v3"
+
+	"go.uber.org/zap"
+)
+
+// WatchCluster will connect to the discovery service at the given url, and
+// call fn with the current registered members each time they change, until
+// the given context is done. The members are in the format "name=peerURLs",
+// in the order they registered. Only the current members are retained, so
+// the memory usage is proportional to the number of live members rather than
+// the number of changes.
+func WatchCluster(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig, fn func(members []string, rev int64)) error {
+	d, err := newDiscovery(ctx, lg, durl, cfg, 0)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+
+	return d.watchCluster(ctx, fn)
+}
+
+// WatchClusterFormation will connect to the discovery service at the given
+// url, and wait until the cluster size is read and as many members have
+// registered, without registering itself, e.g. for monitoring tools. The
+// returned string has the same format as "--initial-cluster". It never
+// writes to the discovery service.
+func WatchClusterFormation(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig) (string, error) {
+	d, err := newDiscovery(ctx, lg, durl, cfg, 0)
+	if err != nil {
+		return "", err
+	}
+	defer d.close()
+
+	d.observer = true
+	r, err := d.getClusterResult()
+	if err != nil {
+		return "", err
+	}
+	return r.String(), nil
+}
+
+// MembersSnapshot is the registered members at a revision of the discovery
+// service, as sent by WatchMembers.
+type MembersSnapshot struct {
+	// Members are in the format "name=peerURLs", in the order they
+	// registered.
+	Members  []string
+	Revision int64
+}
+
+// WatchMembers is the same as WatchCluster, but it sends the snapshots of
+// the registered members on the returned channel, e.g. to detect the members
+// leaving or re-registering after the cluster is formed. The watch doesn't
+// end once the cluster is complete. The channel is closed once the given
+// context is done, or if the watch fails, which is logged.
+func WatchMembers(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig) (<-chan MembersSnapshot, error) {
+	d, err := newDiscovery(ctx, lg, durl, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan MembersSnapshot)
+	go func() {
+		defer close(ch)
+		defer d.close()
+
+		if err := d.watchMembers(ctx, ch); err != nil && ctx.Err() == nil {
+			d.lg.Warn(
+				"stopped watching members from discovery service",
+				zap.Error(err),
+			)
+		}
+	}()
+	return ch, nil
+}
+
+// watchMembers sends the snapshots of the registered members on ch until the
+// given context is done or the watch fails.
+func (d *discovery) watchMembers(ctx context.Context, ch chan<- MembersSnapshot) error {
+	return d.watchCluster(ctx, func(members []string, rev int64) {
+		select {
+		case ch <- MembersSnapshot{Members: members, Revision: rev}:
+		case <-ctx.Done():
+		}
+	})
+}
+
+func (d *discovery) watchCluster(ctx context.Context, fn func(members []string, rev int64)) error {
+	cls, rev, err := d.getClusterMembers(d.pollingReadOpts()...)
+	if err != nil {
+		return err
+	}
+	fn(cls.getPeerURLs(), rev)
+
+	membersKeyPrefix := getMemberKeyPrefix(d.keyPrefix(), d.clusterToken)
+	w := d.c.Watch(ctx, membersKeyPrefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1))
+	for wresp := range w {
+		if len(wresp.Events) == 0 {
+			continue
+		}
+		for _, ev := range wresp.Events {
+			d.applyEvent(cls, ev)
+		}
+		fn(cls.getPeerURLs(), wresp.Header.Revision)
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrWatchClosed
+}
+
+// applyEvent applies a watch event to cls, so that cls always reflects the
+// current registered members.
+func (d *discovery) applyEvent(cls *clusterInfo, ev *clientv3.Event) {
+	mKey := strings.TrimSpace(string(ev.Kv.Key))
+	switch ev.Type {
+	case clientv3.EventTypeDelete:
+		cls.remove(mKey)
+		d.lg.Info(
+			"peer removed from discovery service",
+			zap.String("memberKey", mKey),
+		)
+	case clientv3.EventTypePut:
+		// The member may have re-registered with a new value.
+		cls.remove(mKey)
+		d.addPeer(cls, ev.Kv)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/client/v3"
+
+	"github.com/jonboulle/clockwork"
+	"go.uber.org/zap"
+)
+
+// fakeWatcherForWatchCluster is used to test watchCluster.
+type fakeWatcherForWatchCluster struct {
+	*fakeBaseWatcher
+	responses []clientv3.WatchResponse
+}
+
+// We only need to overwrite method `Watch`.
+func (fw *fakeWatcherForWatchCluster) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(ch)
+		for _, resp := range fw.responses {
+			ch <- resp
+		}
+	}()
+	return ch
+}
+
+func TestWatchClusterBounded(t *testing.T) {
+	registered := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.100:2380",
+			createRev:   5,
+		},
+	}
+
+	// Many members join and leave again, and the last one stays.
+	cycles := 1000
+	var responses []clientv3.WatchResponse
+	rev := int64(10)
+	for i := 0; i < cycles; i++ {
+		key := []byte("/_etcd/registry/fakeToken/members/" + types.ID(1000+i).String())
+		rev++
+		responses = append(responses, clientv3.WatchResponse{
+			Header: etcdserverpb.ResponseHeader{Revision: rev},
+			Events: []*clientv3.Event{
+				{
+					Type: clientv3.EventTypePut,
+					Kv: &mvccpb.KeyValue{
+						Key:            key,
+						Value:          []byte(fmt.Sprintf("infra%d=http://192.168.1.%d:2380", 1000+i, i%250)),
+						CreateRevision: rev,
+					},
+				},
+			},
+		})
+		if i == cycles-1 {
+			break
+		}
+		rev++
+		responses = append(responses, clientv3.WatchResponse{
+			Header: etcdserverpb.ResponseHeader{Revision: rev},
+			Events: []*clientv3.Event{
+				{
+					Type: clientv3.EventTypeDelete,
+					Kv:   &mvccpb.KeyValue{Key: key},
+				},
+			},
+		})
+	}
+
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForClusterMembers{
+				fakeBaseKV: &fakeBaseKV{},
+				members:    registered,
+			},
+			Watcher: &fakeWatcherForWatchCluster{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+				responses:       responses,
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+	}
+
+	calls, maxMembers := 0, 0
+	var lastMembers []string
+	var lastRev int64
+	err := d.watchCluster(context.Background(), func(members []string, rev int64) {
+		calls++
+		if len(members) > maxMembers {
+			maxMembers = len(members)
+		}
+		lastMembers, lastRev = members, rev
+	})
+	if err != ErrWatchClosed {
+		t.Errorf("Unexpected error, expected: %v, got: %v", ErrWatchClosed, err)
+	}
+
+	if calls != len(responses)+1 {
+		t.Errorf("Unexpected number of snapshots, expected: %d, got: %d", len(responses)+1, calls)
+	}
+	if maxMembers > 2 {
+		t.Errorf("Member snapshot is not bounded by live members, max: %d", maxMembers)
+	}
+	expectedMembers := []string{
+		"infra1=http://192.168.0.100:2380",
+		fmt.Sprintf("infra%d=http://192.168.1.%d:2380", 1000+cycles-1, (cycles-1)%250),
+	}
+	if fmt.Sprint(lastMembers) != fmt.Sprint(expectedMembers) {
+		t.Errorf("Unexpected members, expected: %v, got: %v", expectedMembers, lastMembers)
+	}
+	if lastRev != rev {
+		t.Errorf("Unexpected revision, expected: %d, got: %d", rev, lastRev)
+	}
+}
+
+func TestWatchClusterFormation(t *testing.T) {
+	var members []memberInfo
+	for i, id := range []types.ID{101, 102, 103, 104} {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + id.String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.%d:2380", i+1, id),
+			createRev:   int64(5 + i),
+		})
+	}
+
+	cases := []struct {
+		name       string
+		registered []memberInfo
+		watched    []memberInfo
+	}{
+		{
+			name:       "waiting for the last member",
+			registered: members[:2],
+			watched:    members[2:3],
+		},
+		{
+			name:       "cluster already formed",
+			registered: members,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var responses []clientv3.WatchResponse
+			for _, m := range tc.watched {
+				responses = append(responses, clientv3.WatchResponse{
+					Header: etcdserverpb.ResponseHeader{Revision: m.createRev},
+					Events: []*clientv3.Event{
+						{
+							Type: clientv3.EventTypePut,
+							Kv: &mvccpb.KeyValue{
+								Key:            []byte(m.peerRegKey),
+								Value:          []byte(m.peerURLsMap),
+								CreateRevision: m.createRev,
+							},
+						},
+					},
+				})
+			}
+
+			d := &discovery{
+				lg: zap.NewNop(),
+				c: &clientv3.Client{
+					KV: &fakeKVForReadOnly{
+						fakeKVForCheckCluster: &fakeKVForCheckCluster{
+							fakeBaseKV:     &fakeBaseKV{},
+							t:              t,
+							token:          "fakeToken",
+							clusterSizeStr: "3",
+							members:        tc.registered,
+						},
+					},
+					Watcher: &fakeWatcherForWatchCluster{
+						fakeBaseWatcher: &fakeBaseWatcher{},
+						responses:       responses,
+					},
+				},
+				cfg:          &DiscoveryConfig{},
+				clusterToken: "fakeToken",
+				clock:        clockwork.NewFakeClock(),
+				observer:     true,
+			}
+
+			r, err := d.getClusterResult()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380"
+			if r.String() != expected {
+				t.Errorf("Unexpected cluster, expected: %s, got: %s", expected, r.String())
+			}
+		})
+	}
+}
+
+// fakeWatcherForWatchMembers sends the responses, and then keeps the watch
+// open until the context is done.
+type fakeWatcherForWatchMembers struct {
+	*fakeBaseWatcher
+	responses []clientv3.WatchResponse
+}
+
+func (fw *fakeWatcherForWatchMembers) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	ch := make(chan clientv3.WatchResponse)
+	go func() {
+		defer close(ch)
+		for _, resp := range fw.responses {
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return ch
+}
+
+func TestWatchMembers(t *testing.T) {
+	var members []memberInfo
+	for i, id := range []types.ID{101, 102, 103} {
+		members = append(members, memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + id.String(),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.%d:2380", i+1, id),
+			createRev:   int64(5 + i),
+		})
+	}
+
+	// The cluster is formed, and then a member leaves and registers again.
+	responses := []clientv3.WatchResponse{
+		{
+			Header: etcdserverpb.ResponseHeader{Revision: 11},
+			Events: []*clientv3.Event{
+				{Type: clientv3.EventTypeDelete, Kv: &mvccpb.KeyValue{Key: []byte(members[1].peerRegKey)}},
+			},
+		},
+		{
+			Header: etcdserverpb.ResponseHeader{Revision: 12},
+			Events: []*clientv3.Event{
+				{
+					Type: clientv3.EventTypePut,
+					Kv: &mvccpb.KeyValue{
+						Key:            []byte(members[1].peerRegKey),
+						Value:          []byte(members[1].peerURLsMap),
+						CreateRevision: 12,
+					},
+				},
+			},
+		},
+	}
+
+	d := &discovery{
+		lg: zap.NewNop(),
+		c: &clientv3.Client{
+			KV: &fakeKVForClusterMembers{
+				fakeBaseKV: &fakeBaseKV{},
+				members:    members,
+			},
+			Watcher: &fakeWatcherForWatchMembers{
+				fakeBaseWatcher: &fakeBaseWatcher{},
+				responses:       responses,
+			},
+		},
+		cfg:          &DiscoveryConfig{},
+		clusterToken: "fakeToken",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan MembersSnapshot)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- d.watchMembers(ctx, ch)
+	}()
+
+	expected := []MembersSnapshot{
+		{Members: []string{members[0].peerURLsMap, members[1].peerURLsMap, members[2].peerURLsMap}, Revision: 10},
+		{Members: []string{members[0].peerURLsMap, members[2].peerURLsMap}, Revision: 11},
+		{Members: []string{members[0].peerURLsMap, members[2].peerURLsMap, members[1].peerURLsMap}, Revision: 12},
+	}
+	for i, exp := range expected {
+		s := <-ch
+		if fmt.Sprint(s) != fmt.Sprint(exp) {
+			t.Errorf("Unexpected snapshot %d, expected: %v, got: %v", i, exp, s)
+		}
+	}
+
+	// The watch ends once the context is done, without a reader.
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("Unexpected error, expected: %v, got: %v", context.Canceled, err)
+	}
+}
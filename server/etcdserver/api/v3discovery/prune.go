@@ -0,0 +1,106 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.etcd.io/etcd/client/v3"
+
+	"go.uber.org/zap"
+)
+
+var ErrInvalidPruneAge = errors.New("discovery: the age of the registrations to prune must be positive")
+
+// PruneStaleMembers will connect to the discovery service at the given url,
+// and delete the member registrations which are older than olderThan, e.g.
+// to free the slots occupied by an abandoned bootstrap. It returns the
+// pruned members.
+//
+// The age of a registration is only known if the member recorded its
+// registration time, see RecordRegistrationTime; the other registrations
+// are never pruned. A registration is only deleted if it hasn't changed
+// since it was read, and every deletion is logged.
+func PruneStaleMembers(lg *zap.Logger, durl string, cfg *DiscoveryConfig, olderThan time.Duration) ([]RegisteredMember, error) {
+	if olderThan <= 0 {
+		return nil, ErrInvalidPruneAge
+	}
+	d, err := newDiscovery(context.Background(), lg, durl, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.close()
+
+	return d.pruneStaleMembers(olderThan)
+}
+
+func (d *discovery) pruneStaleMembers(olderThan time.Duration) ([]RegisteredMember, error) {
+	cls, _, err := d.getClusterMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	now := d.clock.Now()
+	var pruned []RegisteredMember
+	for _, m := range cls.getRegisteredMembers() {
+		if m.RegisteredAt.IsZero() {
+			d.lg.Debug(
+				"registration time unknown, not pruning member",
+				zap.String("memberKey", m.Key),
+			)
+			continue
+		}
+		age := now.Sub(m.RegisteredAt)
+		if age <= olderThan {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(d.context(), d.cfg.RequestTimeOut)
+		resp, err := d.c.Txn(ctx).If(
+			clientv3.Compare(clientv3.ModRevision(m.Key), "=", m.ModRevision),
+		).Then(
+			clientv3.OpDelete(m.Key),
+		).Commit()
+		cancel()
+		if err != nil {
+			d.lg.Warn(
+				"failed to prune stale member registration",
+				zap.String("memberKey", m.Key),
+				zap.Error(err),
+			)
+			return pruned, err
+		}
+		if !resp.Succeeded {
+			d.lg.Info(
+				"member registered again, not pruning it",
+				zap.String("memberKey", m.Key),
+			)
+			continue
+		}
+
+		d.lg.Warn(
+			"pruned stale member registration",
+			zap.String("memberKey", m.Key),
+			zap.String("name", m.Name),
+			zap.Strings("peerURLs", m.PeerURLs),
+			zap.Time("registered-at", m.RegisteredAt),
+			zap.Duration("age", age),
+		)
+		pruned = append(pruned, m)
+	}
+	return pruned, nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/client/v3"
+
+	"github.com/jonboulle/clockwork"
+	"go.uber.org/zap"
+)
+
+// fakeKVForPrune serves the members, and deletes them in transactions
+// comparing their current ModRevision.
+type fakeKVForPrune struct {
+	*fakeKVForCheckCluster
+	// modRevs are the current ModRevisions of the members, which may
+	// have changed since they were read.
+	modRevs map[string]int64
+	deleted []string
+}
+
+func (fkv *fakeKVForPrune) Txn(ctx context.Context) clientv3.Txn {
+	return &fakeTxnForPrune{fkv: fkv}
+}
+
+type fakeTxnForPrune struct {
+	fkv  *fakeKVForPrune
+	cmps []clientv3.Cmp
+	ops  []clientv3.Op
+}
+
+func (txn *fakeTxnForPrune) If(cs ...clientv3.Cmp) clientv3.Txn {
+	txn.cmps = cs
+	return txn
+}
+
+func (txn *fakeTxnForPrune) Then(ops ...clientv3.Op) clientv3.Txn {
+	txn.ops = ops
+	return txn
+}
+
+func (txn *fakeTxnForPrune) Else(ops ...clientv3.Op) clientv3.Txn { return txn }
+
+func (txn *fakeTxnForPrune) Commit() (*clientv3.TxnResponse, error) {
+	for _, c := range txn.cmps {
+		target := c.TargetUnion.(*etcdserverpb.Compare_ModRevision)
+		if txn.fkv.modRevs[string(c.Key)] != target.ModRevision {
+			return &clientv3.TxnResponse{Succeeded: false}, nil
+		}
+	}
+	for _, op := range txn.ops {
+		txn.fkv.deleted = append(txn.fkv.deleted, string(op.KeyBytes()))
+	}
+	return &clientv3.TxnResponse{Succeeded: true}, nil
+}
+
+func TestPruneStaleMembers(t *testing.T) {
+	fc := clockwork.NewFakeClock()
+	newMember := func(id int, registeredAt time.Time) memberInfo {
+		value := fmt.Sprintf("infra%d=http://192.168.0.%d:2380", id, id)
+		if !registeredAt.IsZero() {
+			var err error
+			if value, err = withRegistrationTime(value, registeredAt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return memberInfo{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(id).String(),
+			peerURLsMap: value,
+			createRev:   int64(id),
+			modRev:      int64(id),
+		}
+	}
+	members := []memberInfo{
+		newMember(101, fc.Now().Add(-2*time.Hour)),
+		newMember(102, fc.Now().Add(-10*time.Minute)),
+		// the registration time isn't recorded.
+		newMember(103, time.Time{}),
+		// registered again since it was read.
+		newMember(104, fc.Now().Add(-3*time.Hour)),
+	}
+	modRevs := map[string]int64{}
+	for _, m := range members {
+		modRevs[m.peerRegKey] = m.modRev
+	}
+	modRevs[members[3].peerRegKey] = 200
+
+	fkv := &fakeKVForPrune{
+		fakeKVForCheckCluster: &fakeKVForCheckCluster{
+			fakeBaseKV: &fakeBaseKV{},
+			t:          t,
+			token:      "fakeToken",
+			members:    members,
+		},
+		modRevs: modRevs,
+	}
+	d := &discovery{
+		lg:           zap.NewNop(),
+		c:            &clientv3.Client{KV: fkv},
+		cfg:          &DiscoveryConfig{RequestTimeOut: time.Second},
+		clusterToken: "fakeToken",
+		clock:        fc,
+	}
+
+	pruned, err := d.pruneStaleMembers(time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{members[0].peerRegKey}
+	if !reflect.DeepEqual(fkv.deleted, expected) {
+		t.Errorf("Unexpected deleted keys, expected: %v, got: %v", expected, fkv.deleted)
+	}
+	if len(pruned) != 1 || pruned[0].Name != "infra101" || !pruned[0].RegisteredAt.Equal(fc.Now().Add(-2*time.Hour).Truncate(time.Second)) {
+		t.Errorf("Unexpected pruned members: %+v", pruned)
+	}
+
+	if _, err := PruneStaleMembers(zap.NewNop(), "http://127.0.0.1:2379/fakeToken", &DiscoveryConfig{}, 0); err != ErrInvalidPruneAge {
+		t.Errorf("Expected ErrInvalidPruneAge, got: %v", err)
+	}
+}
+
+func TestWithRegistrationTime(t *testing.T) {
+	registeredAt := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name  string
+		value string
+	}{
+		{
+			name:  "legacy format",
+			value: "infra1=http://192.168.0.101:2380,infra1=http://10.0.0.101:2380",
+		},
+		{
+			name:  "structured format",
+			value: `{"name":"infra1","peerURLs":["http://192.168.0.101:2380","http://10.0.0.101:2380"],"meta":{"client-urls":"http://192.168.0.101:2379"}}`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := withRegistrationTime(tc.value, registeredAt)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			name, peerURLs, meta, err := ParseMemberValue(v)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if name != "infra1" || !reflect.DeepEqual(peerURLs, []string{"http://192.168.0.101:2380", "http://10.0.0.101:2380"}) {
+				t.Errorf("Unexpected member: %s %v", name, peerURLs)
+			}
+			if meta[metaRegisteredAt] != "2022-03-01T10:00:00Z" {
+				t.Errorf("Unexpected registration time: %q", meta[metaRegisteredAt])
+			}
+
+			cls := &clusterInfo{clusterToken: "fakeToken"}
+			if err := cls.add("/_etcd/registry/fakeToken/members/"+types.ID(101).String(), v, 8); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := cls.getRegisteredMembers()[0].RegisteredAt; !got.Equal(registeredAt) {
+				t.Errorf("Unexpected registration time, expected: %v, got: %v", registeredAt, got)
+			}
+		})
+	}
+}
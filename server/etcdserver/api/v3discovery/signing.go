@@ -0,0 +1,75 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// signatureSeparator separates the member info from its signature. It isn't
+// a valid character in URLs, so it can't be part of the member info.
+const signatureSeparator = "|hmac-sha256="
+
+var (
+	ErrInvalidSignature = errors.New("discovery: invalid member signature")
+)
+
+// signMemberValue signs the member info registered under the given key with
+// the shared signing key, and returns the value to register.
+//
+// The signature protects against a compromised or spoofed discovery service
+// serving forged member info: without the shared key, nobody can register a
+// member that will be accepted by the others, nor modify the peer URLs of a
+// registered member, nor move a registration to another member key. It
+// doesn't protect against a member being deleted or the registrations being
+// hidden, and it's only as secure as the distribution of the shared key.
+func signMemberValue(key []byte, memberKey, memberValue string) string {
+	return memberValue + signatureSeparator + computeSignature(key, memberKey, memberValue)
+}
+
+// verifyMemberValue verifies the signed value registered under the given key,
+// and returns the member info without the signature.
+func verifyMemberValue(key []byte, memberKey, signedValue string) (string, error) {
+	idx := strings.LastIndex(signedValue, signatureSeparator)
+	if idx == -1 {
+		return "", ErrInvalidSignature
+	}
+	memberValue, sig := signedValue[:idx], signedValue[idx+len(signatureSeparator):]
+
+	expected := computeSignature(key, memberKey, memberValue)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", ErrInvalidSignature
+	}
+	return memberValue, nil
+}
+
+func computeSignature(key []byte, memberKey, memberValue string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(memberKey))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(memberValue))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *discovery) signingKey() []byte {
+	if d.cfg == nil || d.cfg.SigningKey == "" {
+		return nil
+	}
+	return []byte(d.cfg.SigningKey)
+}
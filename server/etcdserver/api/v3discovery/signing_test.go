@@ -0,0 +1,80 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+)
+
+func TestMemberSignature(t *testing.T) {
+	key := []byte("secret")
+	memberKey := "/_etcd/registry/fakeToken/members/" + types.ID(101).String()
+	otherMemberKey := "/_etcd/registry/fakeToken/members/" + types.ID(102).String()
+	memberValue := "infra1=http://192.168.0.100:2380"
+	signed := signMemberValue(key, memberKey, memberValue)
+
+	cases := []struct {
+		name          string
+		memberKey     string
+		value         string
+		expectedError error
+	}{
+		{
+			name:      "valid signature",
+			memberKey: memberKey,
+			value:     signed,
+		},
+		{
+			name:          "unsigned value",
+			memberKey:     memberKey,
+			value:         memberValue,
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "forged peer URL",
+			memberKey:     memberKey,
+			value:         strings.Replace(signed, "192.168.0.100", "10.0.0.1", 1),
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "signed with another key",
+			memberKey:     memberKey,
+			value:         signMemberValue([]byte("another secret"), memberKey, memberValue),
+			expectedError: ErrInvalidSignature,
+		},
+		{
+			name:          "replayed under another member key",
+			memberKey:     otherMemberKey,
+			value:         signed,
+			expectedError: ErrInvalidSignature,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cls := &clusterInfo{clusterToken: "fakeToken", signingKey: key}
+			err := cls.add(tc.memberKey, tc.value, 1)
+			if err != tc.expectedError {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if err == nil && cls.members[0].peerURLsMap != memberValue {
+				t.Errorf("Unexpected member info, expected: %s, got: %s", memberValue, cls.members[0].peerURLsMap)
+			}
+		})
+	}
+}
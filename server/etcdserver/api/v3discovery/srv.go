@@ -0,0 +1,75 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"go.etcd.io/etcd/client/pkg/v3/srv"
+)
+
+// srvSchemePrefix is the scheme prefix of the discovery urls whose host is
+// a domain to resolve with DNS SRV records, e.g.
+// "srv+https://example.com/<ClusterToken>".
+const srvSchemePrefix = "srv+"
+
+// indirection for testing
+var lookupSRV = net.DefaultResolver.LookupSRV
+
+// resolveSRVEndpoints replaces each endpoint using the "srv+http" or
+// "srv+https" scheme by the endpoints published by the SRV records of its
+// domain, i.e. "_etcd-client._tcp.<domain>" for "srv+http" and
+// "_etcd-client-ssl._tcp.<domain>" for "srv+https". serviceName is the
+// suffix of the service, as etcd's "--discovery-srv-name".
+func resolveSRVEndpoints(ctx context.Context, endpoints []string, serviceName string) ([]string, error) {
+	var resolved []string
+	for _, ep := range endpoints {
+		if !strings.HasPrefix(ep, srvSchemePrefix) {
+			resolved = append(resolved, ep)
+			continue
+		}
+		u, err := url.Parse(ep)
+		if err != nil {
+			return nil, err
+		}
+		scheme := strings.TrimPrefix(u.Scheme, srvSchemePrefix)
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidDiscoveryURL, u.Scheme)
+		}
+		if u.Port() != "" {
+			return nil, fmt.Errorf("%w: %q has a port, expected a domain to resolve with DNS SRV records", ErrInvalidDiscoveryURL, ep)
+		}
+
+		service := srv.GetSRVService("etcd-client", serviceName, scheme)
+		_, addrs, err := lookupSRV(ctx, service, "tcp", u.Hostname())
+		if err != nil {
+			return nil, fmt.Errorf("discovery: failed to resolve the SRV records of %q: %w", ep, err)
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("discovery: no SRV records of service %q found for %q", service, u.Hostname())
+		}
+		for _, addr := range addrs {
+			resolved = append(resolved, (&url.URL{
+				Scheme: scheme,
+				Host:   net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), fmt.Sprintf("%d", addr.Port)),
+			}).String())
+		}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestResolveSRVEndpoints(t *testing.T) {
+	defer func() { lookupSRV = net.DefaultResolver.LookupSRV }()
+
+	records := map[string][]*net.SRV{
+		"etcd-client-ssl/disco.example.com": {
+			{Target: "disco1.example.com.", Port: 2379},
+			{Target: "disco2.example.com.", Port: 2379},
+		},
+		"etcd-client/disco.example.com": {
+			{Target: "disco1.example.com.", Port: 2381},
+		},
+		"etcd-client-ssl-prod/disco.example.com": {
+			{Target: "disco3.example.com.", Port: 2379},
+		},
+	}
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if proto != "tcp" {
+			t.Errorf("Unexpected protocol: %s", proto)
+		}
+		addrs, ok := records[service+"/"+name]
+		if !ok {
+			return "", nil, errors.New("no such host")
+		}
+		return "", addrs, nil
+	}
+
+	cases := []struct {
+		name              string
+		endpoints         []string
+		serviceName       string
+		expectedEndpoints []string
+		expectError       bool
+	}{
+		{
+			name:              "no srv endpoint",
+			endpoints:         []string{"https://disco.example.com:2379"},
+			expectedEndpoints: []string{"https://disco.example.com:2379"},
+		},
+		{
+			name:              "srv+https",
+			endpoints:         []string{"srv+https://disco.example.com"},
+			expectedEndpoints: []string{"https://disco1.example.com:2379", "https://disco2.example.com:2379"},
+		},
+		{
+			name:              "srv+http",
+			endpoints:         []string{"srv+http://disco.example.com"},
+			expectedEndpoints: []string{"http://disco1.example.com:2381"},
+		},
+		{
+			name:              "service name",
+			endpoints:         []string{"srv+https://disco.example.com"},
+			serviceName:       "prod",
+			expectedEndpoints: []string{"https://disco3.example.com:2379"},
+		},
+		{
+			name:              "mixed endpoints",
+			endpoints:         []string{"https://disco0.example.com:2379", "srv+http://disco.example.com"},
+			expectedEndpoints: []string{"https://disco0.example.com:2379", "http://disco1.example.com:2381"},
+		},
+		{
+			name:        "unknown domain",
+			endpoints:   []string{"srv+https://unknown.example.com"},
+			expectError: true,
+		},
+		{
+			name:        "unsupported scheme",
+			endpoints:   []string{"srv+unix://disco.example.com"},
+			expectError: true,
+		},
+		{
+			name:        "port",
+			endpoints:   []string{"srv+https://disco.example.com:2379"},
+			expectError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			endpoints, err := resolveSRVEndpoints(context.Background(), tc.endpoints, tc.serviceName)
+			if (err != nil) != tc.expectError {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err == nil && !reflect.DeepEqual(endpoints, tc.expectedEndpoints) {
+				t.Errorf("Unexpected endpoints, expected: %v, got: %v", tc.expectedEndpoints, endpoints)
+			}
+		})
+	}
+}
+
+func TestParseSRVDiscoveryURL(t *testing.T) {
+	endpoints, token, err := parseDiscoveryURLs("srv+https://disco.example.com/token", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(endpoints, []string{"srv+https://disco.example.com"}) {
+		t.Errorf("Unexpected endpoints: %v", endpoints)
+	}
+	if token != "/token" {
+		t.Errorf("Unexpected token, expected: /token, got: %s", token)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+
+	"go.uber.org/zap"
+)
+
+// Discovery exposes the individual steps of the discovery, so that they can
+// be composed by embedders and tools. Most users should use GetCluster or
+// JoinCluster instead.
+type Discovery struct {
+	d *discovery
+
+	// cls, clusterSize and rev are the result of the latest CheckCluster.
+	cls         *clusterInfo
+	clusterSize int
+	rev         int64
+}
+
+// NewDiscovery connects to the discovery service at the given url. The id is
+// the ID of the local member; it should be 0 if the local member isn't going
+// to register itself. The returned Discovery must be closed after use.
+func NewDiscovery(lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID) (*Discovery, error) {
+	return NewDiscoveryWithContext(context.Background(), lg, durl, cfg, id)
+}
+
+// NewDiscoveryWithContext is the same as NewDiscovery, but all the steps
+// give up as soon as the given context is done, including the watch of
+// WaitPeers, in which case the returned error wraps the error of the
+// context.
+func NewDiscoveryWithContext(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig, id types.ID) (*Discovery, error) {
+	d, err := newDiscovery(ctx, lg, durl, cfg, id)
+	if err != nil {
+		return nil, err
+	}
+	return &Discovery{d: d}, nil
+}
+
+// CheckCluster reads the cluster size and the registered members from the
+// discovery service. The members are returned in the format "name=peerURLs",
+// in the order they registered. ErrFullCluster is returned, together with
+// the members, if the cluster is already full without the local member.
+func (dis *Discovery) CheckCluster() ([]string, int, error) {
+	cls, clusterSize, rev, err := dis.d.checkCluster()
+	if cls != nil {
+		dis.cls, dis.clusterSize, dis.rev = cls, clusterSize, rev
+		return cls.getPeerURLs(), clusterSize, err
+	}
+	return nil, 0, err
+}
+
+// RegisterSelf registers the local member to the discovery service. The
+// parameter `config` is supposed to be in the format "memberName=peerURLs".
+func (dis *Discovery) RegisterSelf(config string) error {
+	if err := dis.d.setSelfKey(config); err != nil {
+		return err
+	}
+	if dis.cls != nil {
+		if err := dis.d.checkSchemeChange(dis.cls, config); err != nil {
+			return err
+		}
+	}
+	return dis.d.registerSelf(config)
+}
+
+// WaitPeers blocks until the number of registered members reaches the
+// cluster size, and returns a string in the same format as
+// "--initial-cluster". CheckCluster is called first if it has not been
+// called yet.
+func (dis *Discovery) WaitPeers() (string, error) {
+	if dis.cls == nil {
+		if _, _, err := dis.CheckCluster(); err != nil && err != ErrFullCluster {
+			return "", err
+		}
+	}
+
+	for dis.cls.voters() < dis.clusterSize {
+		if err := dis.d.waitPeers(dis.cls, dis.clusterSize, dis.rev); err != nil {
+			return "", err
+		}
+	}
+
+	r, err := dis.d.clusterResult(dis.cls, dis.clusterSize)
+	if err != nil {
+		return "", err
+	}
+	return r.String(), nil
+}
+
+// PeerURLsByMember returns the peer URLs of each member selected for the
+// cluster, keyed by member name, e.g. to add the members programmatically.
+// It is only meaningful after WaitPeers has returned successfully.
+// ErrInsufficientMembers is returned if the cluster is not complete.
+func (dis *Discovery) PeerURLsByMember() (map[string][]string, error) {
+	if dis.cls == nil {
+		return nil, ErrInsufficientMembers
+	}
+	return dis.cls.getPeerURLsByMember(dis.clusterSize)
+}
+
+// RegisteredMember is a member registered in the discovery service.
+type RegisteredMember struct {
+	// Key is the registry key of the member.
+	Key string
+	// ID is the member ID the registry key is derived from, or 0 if it is
+	// derived from the member name.
+	ID       types.ID
+	Name     string
+	PeerURLs []string
+	// CreateRevision is the revision of the first registration of the
+	// member, which determines the order of the members.
+	CreateRevision int64
+	// ModRevision is the revision of the latest registration of the
+	// member, which is larger than CreateRevision if it registered again.
+	ModRevision int64
+	// RegisteredAt is the time of the latest registration of the member,
+	// or the zero time if it wasn't recorded, see RecordRegistrationTime.
+	RegisteredAt time.Time
+	// IsLearner is true if the member registered as a learner, see
+	// RegisterAsLearner.
+	IsLearner bool
+}
+
+// RegisteredMembers returns all the members registered in the discovery
+// service, in the order they registered, as of the latest CheckCluster or
+// WaitPeers. Members which registered again, e.g. flapping members, have a
+// ModRevision larger than their CreateRevision.
+func (dis *Discovery) RegisteredMembers() []RegisteredMember {
+	if dis.cls == nil {
+		return nil
+	}
+	return dis.cls.getRegisteredMembers()
+}
+
+// MemberAddPlan returns the members selected for the cluster, in the order
+// they registered, as a plan to grow a single-node cluster, started with the
+// first member, into the discovered topology by adding the other members one
+// by one. It is only meaningful after WaitPeers has returned successfully.
+// ErrInsufficientMembers is returned if the cluster is not complete.
+func (dis *Discovery) MemberAddPlan() ([]MemberAddStep, error) {
+	if dis.cls == nil {
+		return nil, ErrInsufficientMembers
+	}
+	return dis.cls.getMemberAddPlan(dis.clusterSize)
+}
+
+// IsSeed reports whether the local member is the seed of the cluster, i.e.
+// the selected member which registered first. It gives a deterministic
+// "who goes first" signal, e.g. to perform one-time initialization. It is
+// only meaningful after WaitPeers has returned successfully.
+func (dis *Discovery) IsSeed() bool {
+	if dis.cls == nil {
+		return false
+	}
+	return dis.cls.isSeed(dis.d.getSelfKey(), dis.clusterSize)
+}
+
+// Close closes the connection to the discovery service.
+func (dis *Discovery) Close() error {
+	return dis.d.close()
+}
@@ -0,0 +1,384 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/types"
+	"go.etcd.io/etcd/client/v3"
+
+	"github.com/jonboulle/clockwork"
+	"go.uber.org/zap"
+)
+
+func TestDiscoveryRegisterSelfRetryBudget(t *testing.T) {
+	origRetries := nRetries
+	nRetries = 3
+	defer func() { nRetries = origRetries }()
+
+	// The cluster status check exhausts its retries, and the registration
+	// afterwards still needs all the retries it's allowed.
+	fkv := &fakeKVForJoinCluster{
+		fakeKVForCheckCluster: &fakeKVForCheckCluster{
+			fakeBaseKV:     &fakeBaseKV{},
+			t:              t,
+			token:          "fakeToken",
+			clusterSizeStr: "1",
+			getSizeRetries: 4,
+		},
+		putRetries: 3,
+	}
+
+	fc := clockwork.NewFakeClock()
+	stop := advanceClock(fc)
+	defer stop()
+
+	dis := &Discovery{
+		d: &discovery{
+			lg: zap.NewNop(),
+			c: &clientv3.Client{
+				KV: fkv,
+			},
+			cfg:          &DiscoveryConfig{},
+			clusterToken: "fakeToken",
+			memberId:     101,
+			clock:        fc,
+		},
+	}
+
+	if _, _, err := dis.CheckCluster(); err != ErrTooManyRetries {
+		t.Fatalf("Unexpected error, expected: %v, got: %v", ErrTooManyRetries, err)
+	}
+	if err := dis.RegisterSelf("infra1=http://192.168.0.100:2380"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !fkv.registered {
+		t.Errorf("Member wasn't registered")
+	}
+}
+
+func TestIsSeed(t *testing.T) {
+	clusterToken := "fakeToken"
+	var members []memberInfo
+	for i, id := range []types.ID{102, 103, 101} {
+		members = append(members, memberInfo{
+			peerRegKey:  getMemberKey(discoveryPrefix, clusterToken, id.String()),
+			peerURLsMap: fmt.Sprintf("infra%d=http://192.168.0.%d:2380", id, id),
+			createRev:   int64(8 + i),
+		})
+	}
+
+	cases := []struct {
+		name        string
+		memberId    types.ID
+		clusterSize int
+		expected    bool
+	}{
+		{
+			name:        "local member is the seed",
+			memberId:    102,
+			clusterSize: 3,
+			expected:    true,
+		},
+		{
+			name:        "local member is not the seed",
+			memberId:    103,
+			clusterSize: 3,
+			expected:    false,
+		},
+		{
+			name:        "local member is not selected",
+			memberId:    101,
+			clusterSize: 2,
+			expected:    false,
+		},
+		{
+			name:        "cluster not complete",
+			memberId:    102,
+			clusterSize: 5,
+			expected:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cls := &clusterInfo{clusterToken: clusterToken}
+			// add the members in reverse order to make sure they are sorted.
+			for i := len(members) - 1; i >= 0; i-- {
+				if err := cls.add(members[i].peerRegKey, members[i].peerURLsMap, members[i].createRev); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+
+			dis := &Discovery{
+				d: &discovery{
+					clusterToken: clusterToken,
+					memberId:     tc.memberId,
+				},
+				cls:         cls,
+				clusterSize: tc.clusterSize,
+			}
+			if got := dis.IsSeed(); got != tc.expected {
+				t.Errorf("Unexpected IsSeed, expected: %t, got: %t", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDiscoveryCheckCluster(t *testing.T) {
+	members := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   7,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   6,
+		},
+	}
+
+	cases := []struct {
+		name           string
+		clusterSizeStr string
+
+		expectedSize  int
+		expectedError error
+	}{
+		{
+			name:           "not full",
+			clusterSizeStr: "3",
+			expectedSize:   3,
+		},
+		{
+			name:           "full without the local member",
+			clusterSizeStr: "2",
+			expectedSize:   2,
+			expectedError:  ErrFullCluster,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			dis := &Discovery{
+				d: &discovery{
+					lg: zap.NewNop(),
+					c: &clientv3.Client{
+						KV: &fakeKVForCheckCluster{
+							fakeBaseKV:     &fakeBaseKV{},
+							t:              t,
+							token:          "fakeToken",
+							clusterSizeStr: tc.clusterSizeStr,
+							members:        members,
+						},
+					},
+					cfg:          &DiscoveryConfig{},
+					clusterToken: "fakeToken",
+					memberId:     101,
+					clock:        clockwork.NewFakeClock(),
+				},
+			}
+
+			peers, clusterSize, err := dis.CheckCluster()
+			if err != tc.expectedError {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if clusterSize != tc.expectedSize {
+				t.Errorf("Unexpected cluster size, expected: %d, got: %d", tc.expectedSize, clusterSize)
+			}
+			// The members are returned in the order they registered, even
+			// if the cluster is full.
+			expectedPeers := []string{"infra3=http://192.168.0.103:2380", "infra2=http://192.168.0.102:2380"}
+			if !reflect.DeepEqual(peers, expectedPeers) {
+				t.Errorf("Unexpected members, expected: %v, got: %v", expectedPeers, peers)
+			}
+			if got := len(dis.RegisteredMembers()); got != len(members) {
+				t.Errorf("Unexpected registered members, expected: %d, got: %d", len(members), got)
+			}
+		})
+	}
+}
+
+func TestDiscoveryRegisterSelf(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     *DiscoveryConfig
+		members []memberInfo
+		// checkCluster is true if CheckCluster is called first.
+		checkCluster bool
+		config       string
+
+		expectedRegistered bool
+		expectedError      error
+	}{
+		{
+			name:               "without CheckCluster",
+			cfg:                &DiscoveryConfig{},
+			config:             "infra1=http://192.168.0.101:2380",
+			expectedRegistered: true,
+		},
+		{
+			name: "scheme downgrade since the previous registration",
+			cfg:  &DiscoveryConfig{RejectSchemeDowngrade: true},
+			members: []memberInfo{
+				{
+					peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+					peerURLsMap: "infra1=https://192.168.0.101:2380",
+					createRev:   8,
+				},
+			},
+			checkCluster:  true,
+			config:        "infra1=http://192.168.0.101:2380",
+			expectedError: ErrSchemeDowngrade,
+		},
+		{
+			name:          "registry key derived from an invalid member value",
+			cfg:           &DiscoveryConfig{MemberKeyEncoding: MemberKeyByName},
+			config:        "http://192.168.0.101:2380",
+			expectedError: ErrInvalidMemberValue,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fkv := &fakeKVForJoinCluster{
+				fakeKVForCheckCluster: &fakeKVForCheckCluster{
+					fakeBaseKV:     &fakeBaseKV{},
+					t:              t,
+					token:          "fakeToken",
+					clusterSizeStr: "1",
+					members:        tc.members,
+				},
+			}
+			dis := &Discovery{
+				d: &discovery{
+					lg: zap.NewNop(),
+					c: &clientv3.Client{
+						KV: fkv,
+					},
+					cfg:          tc.cfg,
+					clusterToken: "fakeToken",
+					memberId:     101,
+					clock:        clockwork.NewFakeClock(),
+				},
+			}
+
+			if tc.checkCluster {
+				if _, _, err := dis.CheckCluster(); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+			}
+			if err := dis.RegisterSelf(tc.config); !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Unexpected error, expected: %v, got: %v", tc.expectedError, err)
+			}
+			if fkv.registered != tc.expectedRegistered {
+				t.Errorf("Unexpected registration, expected: %t, got: %t", tc.expectedRegistered, fkv.registered)
+			}
+		})
+	}
+}
+
+func TestDiscoveryWaitPeers(t *testing.T) {
+	registered := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(101).String(),
+			peerURLsMap: "infra1=http://192.168.0.101:2380",
+			createRev:   8,
+		},
+	}
+	// The members registering while WaitPeers is watching.
+	joining := []memberInfo{
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(103).String(),
+			peerURLsMap: "infra3=http://192.168.0.103:2380",
+			createRev:   12,
+		},
+		{
+			peerRegKey:  "/_etcd/registry/fakeToken/members/" + types.ID(102).String(),
+			peerURLsMap: "infra2=http://192.168.0.102:2380",
+			createRev:   11,
+		},
+	}
+
+	dis := &Discovery{
+		d: &discovery{
+			lg: zap.NewNop(),
+			c: &clientv3.Client{
+				KV: &fakeKVForCheckCluster{
+					fakeBaseKV:     &fakeBaseKV{},
+					t:              t,
+					token:          "fakeToken",
+					clusterSizeStr: "3",
+					members:        registered,
+				},
+				Watcher: &fakeWatcherForWaitPeers{
+					fakeBaseWatcher: &fakeBaseWatcher{},
+					t:               t,
+					token:           "fakeToken",
+					members:         joining,
+				},
+			},
+			cfg:          &DiscoveryConfig{},
+			clusterToken: "fakeToken",
+			memberId:     101,
+			clock:        clockwork.NewFakeClock(),
+		},
+	}
+
+	// CheckCluster isn't called beforehand, so WaitPeers calls it.
+	cs, err := dis.WaitPeers()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := "infra1=http://192.168.0.101:2380,infra2=http://192.168.0.102:2380,infra3=http://192.168.0.103:2380"
+	if cs != expected {
+		t.Errorf("Unexpected cluster, expected: %s, got: %s", expected, cs)
+	}
+	if !dis.IsSeed() {
+		t.Errorf("Expected the local member to be the seed")
+	}
+}
+
+func TestDiscoveryClose(t *testing.T) {
+	keepAliveStopped := false
+	dis := &Discovery{
+		d: &discovery{
+			lg:            zap.NewNop(),
+			cfg:           &DiscoveryConfig{TotalTimeout: time.Hour},
+			clock:         clockwork.NewFakeClock(),
+			stopKeepAlive: func() { keepAliveStopped = true },
+		},
+	}
+	dis.d.setContext(context.Background())
+
+	if err := dis.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !keepAliveStopped {
+		t.Errorf("Expected the keepalive of the registration to be stopped")
+	}
+	// The steps give up once the discovery is closed, which isn't a timeout.
+	err := dis.d.canceled()
+	if err == nil || errors.Is(err, ErrDiscoveryTimeout) {
+		t.Errorf("Unexpected error after close, expected: %v, got: %v", context.Canceled, err)
+	}
+}
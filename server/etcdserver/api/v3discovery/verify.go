@@ -0,0 +1,168 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/client/v3"
+
+	"go.uber.org/zap"
+)
+
+var (
+	ErrNoClientURLs    = errors.New("discovery: no client URLs registered by the members")
+	ErrClusterMismatch = errors.New("discovery: formed cluster doesn't match discovery")
+)
+
+// VerifyClusterFormed will connect to the discovery service at the given url
+// to get the members selected for the cluster, then connect to the cluster
+// through the client URLs registered by the members, and check that the
+// live membership matches the selected members. It is read-only, and is
+// meant to be used after the bootstrap.
+//
+// The client URLs are registered in the "client-urls" metadata of the
+// structured format, see ParseMemberValue. ErrNoClientURLs is returned if
+// no member registered them. The TLS settings of cfg are reused to connect
+// to the cluster, but not its credentials nor its ServerName. On mismatch,
+// the returned error wraps ErrClusterMismatch and details the differences.
+func VerifyClusterFormed(ctx context.Context, lg *zap.Logger, durl string, cfg *DiscoveryConfig) error {
+	d, err := newDiscovery(ctx, lg, durl, cfg, 0)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+
+	return d.verifyClusterFormed(ctx)
+}
+
+func (d *discovery) verifyClusterFormed(ctx context.Context) error {
+	cls, clusterSize, _, err := d.checkCluster()
+	if err != nil && err != ErrFullCluster {
+		return err
+	}
+	members, err := cls.selected(clusterSize)
+	if err != nil {
+		return err
+	}
+
+	expected := make(map[string][]string, len(members))
+	var clientURLs []string
+	for _, m := range members {
+		name, peerURLs, _, err := ParseMemberValue(m.peerURLsMap)
+		if err != nil {
+			return err
+		}
+		expected[name] = peerURLs
+		if m.clientURLs != "" {
+			clientURLs = append(clientURLs, strings.Split(m.clientURLs, ",")...)
+		}
+	}
+	if len(clientURLs) == 0 {
+		return ErrNoClientURLs
+	}
+
+	ccfg, err := newClientCfg(d.cfg, clientURLs, d.lg)
+	if err != nil {
+		return err
+	}
+	ccfg.Username, ccfg.Password, ccfg.DialOptions = "", "", nil
+	if !usesScheme(clientURLs, "https") {
+		ccfg.TLS = nil
+	} else {
+		// The server name is the one of the discovery service.
+		ccfg.TLS.ServerName = ""
+	}
+	c, err := clientv3.New(*ccfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	resp, err := c.MemberList(ctx)
+	if err != nil {
+		return err
+	}
+	return diffMembers(expected, resp.Members)
+}
+
+// diffMembers compares the expected peer URLs of each member, keyed by
+// member name, with the live members.
+func diffMembers(expected map[string][]string, live []*etcdserverpb.Member) error {
+	var missing, unexpected, mismatched []string
+	seen := make(map[string]bool, len(live))
+	for _, m := range live {
+		if m.Name == "" {
+			unexpected = append(unexpected, fmt.Sprintf("unstarted member %v", m.PeerURLs))
+			continue
+		}
+		seen[m.Name] = true
+		peerURLs, ok := expected[m.Name]
+		if !ok {
+			unexpected = append(unexpected, fmt.Sprintf("%s %v", m.Name, m.PeerURLs))
+			continue
+		}
+		if !sameURLs(peerURLs, m.PeerURLs) {
+			mismatched = append(mismatched, fmt.Sprintf("%s expected %v, got %v", m.Name, peerURLs, m.PeerURLs))
+		}
+	}
+	for name, peerURLs := range expected {
+		if !seen[name] {
+			missing = append(missing, fmt.Sprintf("%s %v", name, peerURLs))
+		}
+	}
+
+	if len(missing) == 0 && len(unexpected) == 0 && len(mismatched) == 0 {
+		return nil
+	}
+	var diffs []string
+	for _, d := range []struct {
+		kind    string
+		members []string
+	}{
+		{"missing members", missing},
+		{"unexpected members", unexpected},
+		{"mismatched peer URLs", mismatched},
+	} {
+		if len(d.members) > 0 {
+			sort.Strings(d.members)
+			diffs = append(diffs, d.kind+": "+strings.Join(d.members, ", "))
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrClusterMismatch, strings.Join(diffs, "; "))
+}
+
+// sameURLs returns true if the given lists contain the same URLs,
+// regardless of the order.
+func sameURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sa := append([]string(nil), a...)
+	sb := append([]string(nil), b...)
+	sort.Strings(sa)
+	sort.Strings(sb)
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+	return true
+}
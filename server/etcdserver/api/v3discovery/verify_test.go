@@ -0,0 +1,89 @@
+// Copyright 2022 The etcd Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v3discovery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+func TestDiffMembers(t *testing.T) {
+	expected := map[string][]string{
+		"infra1": {"http://192.168.0.101:2380"},
+		"infra2": {"http://192.168.0.102:2380", "http://10.0.0.102:2380"},
+	}
+
+	cases := []struct {
+		name          string
+		live          []*etcdserverpb.Member
+		expectedDiffs []string
+	}{
+		{
+			name: "match",
+			live: []*etcdserverpb.Member{
+				{Name: "infra1", PeerURLs: []string{"http://192.168.0.101:2380"}},
+				{Name: "infra2", PeerURLs: []string{"http://10.0.0.102:2380", "http://192.168.0.102:2380"}},
+			},
+		},
+		{
+			name: "missing member",
+			live: []*etcdserverpb.Member{
+				{Name: "infra1", PeerURLs: []string{"http://192.168.0.101:2380"}},
+			},
+			expectedDiffs: []string{"missing members: infra2"},
+		},
+		{
+			name: "unexpected members",
+			live: []*etcdserverpb.Member{
+				{Name: "infra1", PeerURLs: []string{"http://192.168.0.101:2380"}},
+				{Name: "infra2", PeerURLs: []string{"http://192.168.0.102:2380", "http://10.0.0.102:2380"}},
+				{Name: "infra3", PeerURLs: []string{"http://192.168.0.103:2380"}},
+				{PeerURLs: []string{"http://192.168.0.104:2380"}},
+			},
+			expectedDiffs: []string{"unexpected members: infra3", "unstarted member"},
+		},
+		{
+			name: "mismatched peer URLs",
+			live: []*etcdserverpb.Member{
+				{Name: "infra1", PeerURLs: []string{"https://192.168.0.101:2380"}},
+				{Name: "infra2", PeerURLs: []string{"http://192.168.0.102:2380", "http://10.0.0.102:2380"}},
+			},
+			expectedDiffs: []string{"mismatched peer URLs: infra1"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := diffMembers(expected, tc.live)
+			if len(tc.expectedDiffs) == 0 {
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrClusterMismatch) {
+				t.Fatalf("Expected ErrClusterMismatch, got: %v", err)
+			}
+			for _, diff := range tc.expectedDiffs {
+				if !strings.Contains(err.Error(), diff) {
+					t.Errorf("Expected %q in error: %v", diff, err)
+				}
+			}
+		})
+	}
+}
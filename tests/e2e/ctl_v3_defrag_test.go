@@ -15,12 +15,32 @@
 package e2e
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
 	"testing"
 
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/tests/v3/framework/e2e"
 )
 
-func TestCtlV3DefragOnline(t *testing.T) { testCtl(t, defragOnlineTest) }
+func TestCtlV3DefragOnline(t *testing.T)          { testCtl(t, defragOnlineTest) }
+func TestCtlV3DefragJSONOutput(t *testing.T)      { testCtl(t, defragJSONOutputTest) }
+func TestCtlV3DefragMaxFailures(t *testing.T)     { testCtl(t, defragMaxFailuresTest) }
+func TestCtlV3DefragMinTotalReclaim(t *testing.T) { testCtl(t, defragMinTotalReclaimTest) }
+func TestCtlV3DefragAnalyzeKeyspace(t *testing.T) { testCtl(t, defragAnalyzeKeyspaceTest) }
+func TestCtlV3DefragInterval(t *testing.T)        { testCtl(t, defragIntervalTest) }
+func TestCtlV3DefragClusterConfirm(t *testing.T)  { testCtl(t, defragClusterConfirmTest, withQuorum()) }
+func TestCtlV3DefragDryRun(t *testing.T)          { testCtl(t, defragDryRunTest) }
+func TestCtlV3DefragExclude(t *testing.T)         { testCtl(t, defragExcludeTest, withQuorum()) }
+func TestCtlV3DefragLeaderLast(t *testing.T)      { testCtl(t, defragLeaderLastTest, withQuorum()) }
+func TestCtlV3DefragCompact(t *testing.T)         { testCtl(t, defragCompactTest) }
+func TestCtlV3DefragConfirmEach(t *testing.T)     { testCtl(t, defragConfirmEachTest) }
+func TestCtlV3DefragRecordToEtcd(t *testing.T)    { testCtl(t, defragRecordToEtcdTest) }
+func TestCtlV3DefragPlan(t *testing.T)            { testCtl(t, defragPlanTest) }
+func TestCtlV3DefragLogStatus(t *testing.T)       { testCtl(t, defragLogStatusTest) }
 
 func TestCtlV3DefragOffline(t *testing.T) {
 	testCtlWithOffline(t, maintenanceInitKeys, defragOfflineTest)
@@ -59,6 +79,34 @@ func ctlV3OnlineDefrag(cx ctlCtx) error {
 	return e2e.SpawnWithExpects(cmdArgs, cx.envMap, lines...)
 }
 
+// defragJSONOutputTest checks that the informational messages of the flags
+// printing extra output don't break the JSON output.
+func defragJSONOutputTest(cx ctlCtx) {
+	// Overwritten values leave reclaimable space behind once compacted, so
+	// that --min-total-reclaim doesn't skip the defragmentation.
+	val := strings.Repeat("v", 64*1024)
+	for i := 0; i < 10; i++ {
+		if err := ctlV3Put(cx, "key", val, ""); err != nil {
+			cx.t.Fatal(err)
+		}
+	}
+
+	cmdArgs := append(cx.PrefixArgs(), "--write-out", "json", "defrag",
+		"--compact", "--min-total-reclaim", "1", "--log-status", "--analyze-keyspace", "--record-to-etcd")
+	stdout, stderr, err := ctlV3RunWithoutTTY(cmdArgs)
+	if err != nil {
+		cx.t.Fatalf("defragJSONOutputTest ctlV3Defrag error (%v): %s", err, stderr)
+	}
+
+	var results []map[string]interface{}
+	if err := json.Unmarshal([]byte(stdout), &results); err != nil {
+		cx.t.Fatalf("defragJSONOutputTest failed to parse the output %q (%v)", stdout, err)
+	}
+	if len(results) != cx.epc.Cfg.ClusterSize {
+		cx.t.Fatalf("defragJSONOutputTest expected %d results, got %d", cx.epc.Cfg.ClusterSize, len(results))
+	}
+}
+
 func ctlV3OfflineDefrag(cx ctlCtx) error {
 	cmdArgs := append(cx.PrefixArgsUtl(), "defrag", "--data-dir", cx.dataDir)
 	lines := []string{"finished defragmenting directory"}
@@ -70,3 +118,276 @@ func defragOfflineTest(cx ctlCtx) {
 		cx.t.Fatalf("defragTest ctlV3Defrag error (%v)", err)
 	}
 }
+
+// defragMaxFailuresTest checks that the defragmentation is aborted once
+// --max-failures members have failed, and not before.
+func defragMaxFailuresTest(cx ctlCtx) {
+	// Nothing listens on port 1, so the defragmentation of this endpoint
+	// fails once the short command timeout expires.
+	eps := append([]string{"http://localhost:1"}, cx.epc.EndpointsV3()...)
+	prefixArgs := append(cx.prefixArgs(eps), "--command-timeout", "1s")
+
+	cmdArgs := append(prefixArgs, "defrag", "--max-failures", "1")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"Failed to defragment etcd member[http://localhost:1]",
+		fmt.Sprintf("Aborted defragmentation after 1 failure(s). completed: [], skipped: %v", cx.epc.EndpointsV3()),
+	); err != nil {
+		cx.t.Fatalf("defragMaxFailuresTest --max-failures=1 error (%v)", err)
+	}
+
+	cmdArgs = append(prefixArgs, "defrag", "--stop-on-failure")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"Failed to defragment etcd member[http://localhost:1]",
+		fmt.Sprintf("Aborted defragmentation after 1 failure(s). completed: [], skipped: %v", cx.epc.EndpointsV3()),
+	); err != nil {
+		cx.t.Fatalf("defragMaxFailuresTest --stop-on-failure error (%v)", err)
+	}
+
+	// --stop-on-failure is --max-failures=1, so any explicit --max-failures
+	// is rejected, even if it is 1.
+	cmdArgs = append(prefixArgs, "defrag", "--stop-on-failure", "--max-failures", "1")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap, "--stop-on-failure can't be used with --max-failures"); err != nil {
+		cx.t.Fatalf("defragMaxFailuresTest --stop-on-failure --max-failures=1 error (%v)", err)
+	}
+
+	cmdArgs = append(prefixArgs, "defrag", "--max-failures", "2")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"Failed to defragment etcd member[http://localhost:1]",
+		"Finished defragmenting etcd member",
+	); err != nil {
+		cx.t.Fatalf("defragMaxFailuresTest --max-failures=2 error (%v)", err)
+	}
+}
+
+func defragLogStatusTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--log-status")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		`"msg":"member status","stage":"before defragmentation"`,
+		`"msg":"member status","stage":"after defragmentation"`,
+	); err != nil {
+		cx.t.Fatalf("defragLogStatusTest ctlV3Defrag error (%v)", err)
+	}
+}
+
+func defragPlanTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--plan", "--plan-rate", "1048576")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"assuming a defragmentation throughput of 1.0 MB/s",
+		"estimated defragmentation time",
+		"Estimated total defragmentation time",
+	); err != nil {
+		cx.t.Fatalf("defragPlanTest ctlV3Defrag error (%v)", err)
+	}
+}
+
+func defragMinTotalReclaimTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--min-total-reclaim", "1099511627776")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"Estimated total reclaimable space",
+		"Skipped defragmentation, the estimated reclaimable space",
+	); err != nil {
+		cx.t.Fatalf("defragMinTotalReclaimTest ctlV3Defrag error (%v)", err)
+	}
+}
+
+func defragAnalyzeKeyspaceTest(cx ctlCtx) {
+	maintenanceInitKeys(cx)
+
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--analyze-keyspace")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"Key space before defragmentation (1 keys sampled)",
+		"key: 1, 4 B, 1/0/0/0",
+		"Finished defragmenting etcd member",
+		"Key space after defragmentation (1 keys sampled)",
+		"key: 1, 4 B, 1/0/0/0",
+	); err != nil {
+		cx.t.Fatalf("defragAnalyzeKeyspaceTest ctlV3Defrag error (%v)", err)
+	}
+}
+
+func defragRecordToEtcdTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--record-to-etcd", "--record-prefix", "/records/")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		"Finished defragmenting etcd member",
+		`Recorded the defragmentation at key "/records/`,
+	); err != nil {
+		cx.t.Fatalf("defragRecordToEtcdTest ctlV3Defrag error (%v)", err)
+	}
+
+	cmdArgs = append(cx.PrefixArgs(), "get", "--prefix", "/records/", "--print-value-only")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap, `"results":[{"endpoint":`); err != nil {
+		cx.t.Fatalf("defragRecordToEtcdTest ctlV3Get error (%v)", err)
+	}
+}
+
+func defragConfirmEachTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--confirm-each")
+	proc, err := e2e.SpawnCmd(cmdArgs, cx.envMap)
+	if err != nil {
+		cx.t.Fatal(err)
+	}
+	defer proc.Close()
+
+	// The prompt doesn't end with a newline, so wait for the status line
+	// printed before it.
+	if _, err = proc.Expect("fragmentation"); err != nil {
+		cx.t.Fatal(err)
+	}
+	if err = proc.Send("skip\r"); err != nil {
+		cx.t.Fatal(err)
+	}
+	if _, err = proc.Expect("Skipped defragmenting etcd member"); err != nil {
+		cx.t.Fatal(err)
+	}
+}
+
+func defragCompactTest(cx ctlCtx) {
+	maintenanceInitKeys(cx)
+
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--compact")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap, "Compacted revision 4", "Finished defragmenting etcd member"); err != nil {
+		cx.t.Fatalf("defragCompactTest ctlV3Defrag error (%v)", err)
+	}
+	cmdArgs = append(cx.PrefixArgs(), "get", "key", "--rev", "2")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap, "required revision has been compacted"); err != nil {
+		cx.t.Fatalf("defragCompactTest ctlV3Get error (%v)", err)
+	}
+}
+
+func defragLeaderLastTest(cx ctlCtx) {
+	leader := leaderEndpoint(cx)
+
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--leader-last")
+	stdout, stderr, err := ctlV3RunWithoutTTY(cmdArgs)
+	if err != nil {
+		cx.t.Fatalf("defragLeaderLastTest ctlV3Defrag error (%v): %s", err, stderr)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout), "\n")
+	if len(lines) != cx.epc.Cfg.ClusterSize {
+		cx.t.Fatalf("defragLeaderLastTest expected %d results, got %q", cx.epc.Cfg.ClusterSize, stdout)
+	}
+	if !strings.HasPrefix(lines[len(lines)-1], fmt.Sprintf("Finished defragmenting etcd member[%s]", leader)) {
+		cx.t.Fatalf("defragLeaderLastTest expected the leader %s to be defragmented last, got %q", leader, stdout)
+	}
+}
+
+// ctlV3RunWithoutTTY runs an etcdctl command with stdin not being a terminal,
+// and returns its stdout and stderr separately, unlike the spawned processes
+// which merge them.
+func ctlV3RunWithoutTTY(args []string) (stdout, stderr string, err error) {
+	var outb, errb bytes.Buffer
+	cmd := exec.Command(e2e.CtlBinPath, args[1:]...)
+	cmd.Stdin = strings.NewReader("")
+	cmd.Stdout = &outb
+	cmd.Stderr = &errb
+	err = cmd.Run()
+	return outb.String(), errb.String(), err
+}
+
+// leaderEndpoint returns the client URL of the leader of the cluster.
+func leaderEndpoint(cx ctlCtx) string {
+	cmdArgs := append(cx.PrefixArgs(), "--write-out", "json", "endpoint", "status")
+	stdout, stderr, err := ctlV3RunWithoutTTY(cmdArgs)
+	if err != nil {
+		cx.t.Fatalf("leaderEndpoint error (%v): %s", err, stderr)
+	}
+	var statuses []struct {
+		Endpoint string
+		Status   etcdserverpb.StatusResponse
+	}
+	if err := json.Unmarshal([]byte(stdout), &statuses); err != nil {
+		cx.t.Fatalf("leaderEndpoint failed to parse the output %q (%v)", stdout, err)
+	}
+	for _, st := range statuses {
+		if st.Status.Header.MemberId == st.Status.Leader {
+			return st.Endpoint
+		}
+	}
+	cx.t.Fatalf("leaderEndpoint found no leader in %q", stdout)
+	return ""
+}
+
+func defragExcludeTest(cx ctlCtx) {
+	eps := cx.epc.EndpointsV3()
+
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--cluster", "--yes", "--exclude", eps[1])
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap,
+		fmt.Sprintf("Excluded etcd member[%s]", eps[1]),
+		fmt.Sprintf("Finished defragmenting etcd member[%s]", eps[0]),
+		fmt.Sprintf("Finished defragmenting etcd member[%s]", eps[2]),
+	); err != nil {
+		cx.t.Fatalf("defragExcludeTest ctlV3Defrag error (%v)", err)
+	}
+
+	cmdArgs = append(cx.PrefixArgs(), "defrag", "--exclude", "unknown")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap, `--exclude "unknown" doesn't match any cluster member`); err != nil {
+		cx.t.Fatalf("defragExcludeTest ctlV3Defrag error (%v)", err)
+	}
+}
+
+func defragDryRunTest(cx ctlCtx) {
+	maintenanceInitKeys(cx)
+
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--dry-run", "--compact")
+	if err := e2e.SpawnWithExpects(cmdArgs, cx.envMap, "Would defragment etcd member"); err != nil {
+		cx.t.Fatalf("defragDryRunTest ctlV3Defrag error (%v)", err)
+	}
+	// --compact is ignored by --dry-run.
+	if err := ctlV3Get(cx, []string{"key", "--rev", "2"}, kv{"key", "val1"}); err != nil {
+		cx.t.Fatalf("defragDryRunTest ctlV3Get error (%v)", err)
+	}
+}
+
+// defragClusterConfirmTest checks that --cluster refuses to run without a
+// terminal, aborts unless the operator confirms the listed endpoints, and
+// doesn't prompt with --yes.
+func defragClusterConfirmTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--cluster")
+	if _, stderr, err := ctlV3RunWithoutTTY(cmdArgs); err == nil || !strings.Contains(stderr, "--cluster requires a confirmation from an interactive terminal") {
+		cx.t.Fatalf("defragClusterConfirmTest expected a refusal without a terminal, got (%v): %s", err, stderr)
+	}
+
+	proc, err := e2e.SpawnCmd(cmdArgs, cx.envMap)
+	if err != nil {
+		cx.t.Fatal(err)
+	}
+	// The prompt doesn't end with a newline, so wait for the endpoints
+	// listed before it.
+	if _, err = proc.Expect("will be defragmented"); err != nil {
+		cx.t.Fatal(err)
+	}
+	if err = proc.Send("n\r"); err != nil {
+		cx.t.Fatal(err)
+	}
+	if _, err = proc.Expect("Aborted defragmentation."); err != nil {
+		cx.t.Fatal(err)
+	}
+	proc.Close()
+
+	cmdArgs = append(cmdArgs, "--yes")
+	stdout, stderr, err := ctlV3RunWithoutTTY(cmdArgs)
+	if err != nil {
+		cx.t.Fatalf("defragClusterConfirmTest ctlV3Defrag --yes error (%v): %s", err, stderr)
+	}
+	if n := strings.Count(stdout, "Finished defragmenting etcd member"); n != cx.epc.Cfg.ClusterSize {
+		cx.t.Fatalf("defragClusterConfirmTest expected %d members defragmented, got %q", cx.epc.Cfg.ClusterSize, stdout)
+	}
+}
+
+func defragIntervalTest(cx ctlCtx) {
+	cmdArgs := append(cx.PrefixArgs(), "defrag", "--interval", "1s", "--compact")
+	proc, err := e2e.SpawnCmd(cmdArgs, cx.envMap)
+	if err != nil {
+		cx.t.Fatal(err)
+	}
+	defer proc.Stop()
+
+	for _, s := range []string{
+		`"msg":"finished defragmentation cycle","cycle":1`,
+		`"msg":"finished defragmentation cycle","cycle":2`,
+	} {
+		if _, err = proc.Expect(s); err != nil {
+			cx.t.Fatal(err)
+		}
+	}
+}